@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// ValidateEmailAddress checks the syntax of an address and that its domain accepts email, and reports whether
+// the domain is disposable. An invalid address is reported in the response rather than as an error.
+func (s *EmailManagerService) ValidateEmailAddress(ctx context.Context, in *pb.ValidateEmailAddressRequest) (*pb.ValidateEmailAddressResponse, error) {
+	normalized, err := utils.NormalizeEmailAddress(in.Address)
+	if err != nil {
+		return &pb.ValidateEmailAddressResponse{Reason: err.Error()}, nil
+	}
+
+	response := &pb.ValidateEmailAddressResponse{NormalizedAddress: normalized}
+	domain := normalized[strings.LastIndex(normalized, "@")+1:]
+
+	response.Disposable, err = utils.IsDisposableDomain(s.emailServiceDB.Db, domain)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response.HasMx, err = utils.HasMailServer(ctx, s.mxResolver, domain)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to look up the mail servers of %s: %s", domain, err)
+	}
+
+	response.Valid = response.HasMx
+	if !response.HasMx {
+		response.Reason = fmt.Sprintf("%s does not accept email", domain)
+	}
+
+	return response, nil
+}
+
+// SetDisposableDomains replaces the list of disposable domains reported by ValidateEmailAddress
+func (s *EmailManagerService) SetDisposableDomains(ctx context.Context, in *pb.SetDisposableDomainsRequest) (*pb.SetDisposableDomainsResponse, error) {
+	domains := []string{}
+	for _, domain := range in.Domains {
+		normalized, err := utils.NormalizeDomain(domain)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid domain %s: %s", domain, err)
+		}
+		domains = append(domains, normalized)
+	}
+
+	if err := utils.ReplaceDisposableDomains(s.emailServiceDB.Db, domains); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	s.recordAuditEvent(ctx, "SetDisposableDomains", "disposable_domains", nil, map[string]string{"domains": strings.Join(domains, ",")})
+
+	return &pb.SetDisposableDomainsResponse{Message: "Disposable domains set successfully!"}, nil
+}
+
+// normalizeRecipient checks the address of a recipient before anything is rendered or sent and returns
+// its normalized form along with its display name. The mail servers of the domain are only looked up
+// when EMAIL_MX_CHECK is enabled, and a failed lookup does not reject the address.
+func (s *EmailManagerService) normalizeRecipient(ctx context.Context, to string) (mail.Address, error) {
+	recipient, err := utils.ParseRecipient(to)
+	if err != nil {
+		return mail.Address{}, err
+	}
+
+	if !s.config.MXCheck {
+		return recipient, nil
+	}
+
+	domain := recipient.Address[strings.LastIndex(recipient.Address, "@")+1:]
+	hasMailServer, err := utils.HasMailServer(ctx, s.mxResolver, domain)
+	if err != nil {
+		log.Printf("Failed to look up the mail servers of %s: %s", domain, err)
+		return recipient, nil
+	}
+
+	if !hasMailServer {
+		return mail.Address{}, fmt.Errorf("%s does not accept email", domain)
+	}
+
+	return recipient, nil
+}
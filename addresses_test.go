@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+)
+
+// nullMXResolver answers every lookup with a null MX record, so no domain accepts email
+type nullMXResolver struct{}
+
+func (nullMXResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return []*net.MX{{Host: "."}}, nil
+}
+
+func (nullMXResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return []string{"192.0.2.1"}, nil
+}
+
+// countRows returns the number of rows of a table
+func countRows(t *testing.T, s *EmailManagerService, table string) int {
+	t.Helper()
+
+	var count int
+	if err := s.emailServiceDB.Db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestSendRejectsInvalidAddresses(t *testing.T) {
+	s := newTestService(t)
+	s.config.MXCheck = true
+	s.mxResolver = nullMXResolver{}
+
+	sends := map[string]func(context.Context, *pb.SendEmailRequest) (*pb.SendEmailResponse, error){
+		"SendVerifyEmailEmail":   s.SendVerifyEmailEmail,
+		"SendPasswordResetEmail": s.SendPasswordResetEmail,
+		"SendMFAEmail":           s.SendMFAEmail,
+		"SendMagicLinkEmail":     s.SendMagicLinkEmail,
+	}
+
+	addresses := []string{"plainaddress", "user@localhost", "user@[127.0.0.1]", "first@example.com, second@example.com", "user@no-mail.example"}
+
+	for name, send := range sends {
+		for _, address := range addresses {
+			for _, sendAt := range []*timestamppb.Timestamp{nil, timestamppb.New(time.Now().Add(time.Hour))} {
+				_, err := send(context.Background(), &pb.SendEmailRequest{To: address, Token: "token", SendAt: sendAt})
+				if status.Code(err) != codes.InvalidArgument {
+					t.Errorf("%s to %q with send_at %v returned %v, expected InvalidArgument", name, address, sendAt, err)
+				}
+			}
+		}
+	}
+
+	// nothing was rendered, queued or sent
+	if count := countRows(t, s, "delivery_events"); count != 0 {
+		t.Errorf("recorded %d delivery events, expected none", count)
+	}
+	if count := countRows(t, s, "email_queue"); count != 0 {
+		t.Errorf("queued %d emails, expected none", count)
+	}
+}
+
+func TestBatchSendRejectsInvalidAddresses(t *testing.T) {
+	s := newTestService(t)
+	setMFATemplate(t, s)
+	s.config.MXCheck = true
+	s.mxResolver = nullMXResolver{}
+
+	response, err := s.BatchSend(context.Background(), &pb.BatchSendRequest{
+		EmailType:  pb.EmailType_MFA,
+		Recipients: []*pb.BatchRecipient{{To: "plainaddress"}, {To: "user@localhost"}, {To: "user@no-mail.example"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Accepted != 0 || response.Rejected != 3 {
+		t.Errorf("accepted %d and rejected %d recipients, expected every recipient to be rejected", response.Accepted, response.Rejected)
+	}
+	for _, result := range response.Results {
+		if result.Error == "" || result.MessageId != "" {
+			t.Errorf("the result of %s is %+v, expected an error", result.To, result)
+		}
+	}
+
+	stream := &fakeIngestCampaignStream{requests: []*pb.IngestCampaignRequest{
+		{CampaignName: "invalid", EmailType: pb.EmailType_MFA, Recipient: &pb.BatchRecipient{To: "plainaddress"}},
+		{Recipient: &pb.BatchRecipient{To: "user@no-mail.example"}},
+	}}
+	if err := s.IngestCampaign(stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.response.Accepted != 0 || stream.response.Rejected != 2 {
+		t.Errorf("the campaign accepted %d and rejected %d recipients, expected every recipient to be rejected", stream.response.Accepted, stream.response.Rejected)
+	}
+
+	if count := countRows(t, s, "email_queue"); count != 0 {
+		t.Errorf("queued %d emails, expected none", count)
+	}
+	if count := countRows(t, s, "mfa_codes"); count != 0 {
+		t.Errorf("generated %d MFA codes, expected none", count)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// UploadAsset stores a file under a name that send requests can use as the storage reference of an attachment.
+// Uploading under an existing name replaces the file.
+func (s *EmailManagerService) UploadAsset(ctx context.Context, in *pb.UploadAssetRequest) (*pb.UploadAssetResponse, error) {
+	if in.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "asset name is required")
+	}
+
+	asset := utils.Attachment{
+		Filename:    in.Filename,
+		ContentType: in.ContentType,
+		Content:     in.Content,
+	}
+
+	if err := utils.ValidateAttachment(asset); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := utils.InsertAsset(s.emailServiceDB.Db, in.Name, asset); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	s.recordAuditEvent(ctx, "UploadAsset", in.Name, nil, map[string]string{
+		"filename":     in.Filename,
+		"content_type": in.ContentType,
+		"size":         strconv.Itoa(len(in.Content)),
+	})
+
+	return &pb.UploadAssetResponse{Message: "Asset uploaded successfully!"}, nil
+}
+
+// inlineAssetsFromPB validates the inline assets declared by a template, every one of which needs a content ID
+func inlineAssetsFromPB(pbAssets []*pb.Attachment) ([]utils.Attachment, error) {
+	assets := []utils.Attachment{}
+	contentIDs := map[string]bool{}
+	for _, pbAsset := range pbAssets {
+		if pbAsset.ContentId == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "inline asset %s needs a content ID", pbAsset.Filename)
+		}
+
+		if contentIDs[pbAsset.ContentId] {
+			return nil, status.Errorf(codes.InvalidArgument, "content ID %s is declared twice", pbAsset.ContentId)
+		}
+		contentIDs[pbAsset.ContentId] = true
+
+		assets = append(assets, utils.Attachment{
+			Filename:    pbAsset.Filename,
+			ContentType: pbAsset.ContentType,
+			ContentID:   pbAsset.ContentId,
+			Content:     pbAsset.Content,
+		})
+	}
+
+	if err := utils.ValidateAttachments(assets); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return assets, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+func TestUploadAssetRejectsInvalidFiles(t *testing.T) {
+	s := newTestService(t)
+
+	tests := []struct {
+		name    string
+		request *pb.UploadAssetRequest
+		code    codes.Code
+	}{
+		{"valid", &pb.UploadAssetRequest{Name: "logo", Filename: "logo.png", ContentType: "image/png", Content: []byte("png")}, codes.OK},
+		{"missing name", &pb.UploadAssetRequest{Filename: "logo.png", ContentType: "image/png", Content: []byte("png")}, codes.InvalidArgument},
+		{"content type not allowed", &pb.UploadAssetRequest{Name: "page", Filename: "page.html", ContentType: "text/html", Content: []byte("<p>")}, codes.InvalidArgument},
+		{"over the size limit", &pb.UploadAssetRequest{Name: "large", Filename: "large.pdf", ContentType: "application/pdf", Content: make([]byte, utils.MaxAttachmentSize+1)}, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := s.UploadAsset(context.Background(), test.request); status.Code(err) != test.code {
+				t.Errorf("UploadAsset() = %v, expected %s", err, test.code)
+			}
+		})
+	}
+}
+
+func TestInlineAssetsFromPB(t *testing.T) {
+	logo := &pb.Attachment{Filename: "logo.png", ContentType: "image/png", ContentId: "logo", Content: []byte("png")}
+
+	tests := []struct {
+		name   string
+		assets []*pb.Attachment
+		valid  bool
+	}{
+		{"valid", []*pb.Attachment{logo}, true},
+		{"missing content ID", []*pb.Attachment{{Filename: "logo.png", ContentType: "image/png", Content: []byte("png")}}, false},
+		{"content ID declared twice", []*pb.Attachment{logo, logo}, false},
+		{"content type not allowed", []*pb.Attachment{{Filename: "script.js", ContentType: "text/javascript", ContentId: "script", Content: []byte("js")}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assets, err := inlineAssetsFromPB(test.assets)
+			if test.valid && (err != nil || len(assets) != len(test.assets) || assets[0].ContentID != "logo") {
+				t.Errorf("inlineAssetsFromPB() = %+v, %v, expected the assets", assets, err)
+			}
+			if !test.valid && status.Code(err) != codes.InvalidArgument {
+				t.Errorf("inlineAssetsFromPB() = %v, expected InvalidArgument", err)
+			}
+		})
+	}
+}
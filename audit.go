@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+const (
+	defaultAuditEventsLimit = 50
+	maxAuditEventsLimit     = 500
+)
+
+// ListAuditEvents returns the configuration changes matching the filters, newest first.
+// The next page starts before the NextBeforeId of the response.
+func (s *EmailManagerService) ListAuditEvents(ctx context.Context, in *pb.ListAuditEventsRequest) (*pb.ListAuditEventsResponse, error) {
+	limit := int(in.Limit)
+	if limit <= 0 {
+		limit = defaultAuditEventsLimit
+	}
+	if limit > maxAuditEventsLimit {
+		limit = maxAuditEventsLimit
+	}
+
+	filter := utils.AuditEventFilter{
+		Actor:    in.Actor,
+		RPC:      in.Rpc,
+		Target:   in.Target,
+		BeforeID: in.BeforeId,
+	}
+	if in.Since != nil {
+		filter.Since = in.Since.AsTime()
+	}
+	if in.Until != nil {
+		filter.Until = in.Until.AsTime()
+	}
+
+	events, err := utils.GetAuditEvents(s.emailServiceDB.Db, filter, limit)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.ListAuditEventsResponse{}
+	for _, event := range events {
+		response.Events = append(response.Events, &pb.AuditEvent{
+			Id:        event.ID,
+			Actor:     event.Actor,
+			Rpc:       event.RPC,
+			Target:    event.Target,
+			Before:    event.Before,
+			After:     event.After,
+			CallerIp:  event.CallerIP,
+			CreatedAt: timestamppb.New(event.CreatedAt),
+		})
+	}
+
+	// a full page may be followed by another one
+	if len(events) == limit {
+		response.NextBeforeId = events[len(events)-1].ID
+	}
+
+	return response, nil
+}
+
+// recordAuditEvent appends a change that is already stored to the audit log, a failure being logged
+// since the change cannot be undone anymore
+func (s *EmailManagerService) recordAuditEvent(ctx context.Context, rpc string, target string, before map[string]string, after map[string]string) {
+	event := utils.NewAuditEvent(ctx, rpc, target, before, after)
+	if err := utils.InsertAuditEvent(s.emailServiceDB.Db, event); err != nil {
+		log.Printf("Failed to record the audit event of %s on %s by %s: %s", rpc, target, event.Actor, err)
+	}
+}
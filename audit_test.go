@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+func TestSetSMTPCredentialsIsAudited(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	request := &pb.SetSMTPCredentialsRequest{Host: "smtp.example.com", Port: 25, Username: "user", Password: "password", Sender: "sender@example.com"}
+	if _, err := s.SetSMTPCredentials(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	request.Port = 587
+	request.Password = "new-password"
+	if _, err := s.SetSMTPCredentials(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := s.ListAuditEvents(ctx, &pb.ListAuditEventsRequest{Rpc: "SetSMTPCredentials"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Events) != 2 {
+		t.Fatalf("ListAuditEvents() returned %d events, expected 2", len(response.Events))
+	}
+
+	// the latest change only records the port and the password, which is redacted
+	latest := response.Events[0]
+	if expected := map[string]string{"SMTP_PORT": "25", "SMTP_PASSWORD": utils.RedactedValue}; !reflect.DeepEqual(latest.Before, expected) {
+		t.Errorf("the event records the previous values %v, expected %v", latest.Before, expected)
+	}
+	if expected := map[string]string{"SMTP_PORT": "587", "SMTP_PASSWORD": utils.RedactedValue}; !reflect.DeepEqual(latest.After, expected) {
+		t.Errorf("the event records the new values %v, expected %v", latest.After, expected)
+	}
+	if latest.Actor != "anonymous" || latest.Target != "SMTP" {
+		t.Errorf("the event was recorded for %s on %s, expected an anonymous change of SMTP", latest.Actor, latest.Target)
+	}
+}
+
+func TestListAuditEventsPages(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	origins := []string{"https://a.example.com", "https://b.example.com", "https://c.example.com"}
+	for _, origin := range origins {
+		if _, err := s.AddRedirectOrigin(ctx, &pb.AddRedirectOriginRequest{Origin: origin}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the pages follow each other newest first, the last one having no next page
+	found := []string{}
+	request := &pb.ListAuditEventsRequest{Rpc: "AddRedirectOrigin", Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages == len(origins) {
+			t.Fatal("ListAuditEvents() kept returning pages")
+		}
+
+		response, err := s.ListAuditEvents(ctx, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range response.Events {
+			found = append(found, event.Target)
+		}
+
+		if response.NextBeforeId == 0 {
+			break
+		}
+		request.BeforeId = response.NextBeforeId
+	}
+
+	if expected := []string{origins[2], origins[1], origins[0]}; !reflect.DeepEqual(found, expected) {
+		t.Errorf("the pages returned the events of %v, expected %v", found, expected)
+	}
+}
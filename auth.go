@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// senderMethods lists the RPCs the sender role can call, every other RPC requiring the admin role
+var senderMethods = map[string]bool{
+	"SendVerifyEmailEmail":   true,
+	"SendPasswordResetEmail": true,
+	"SendMFAEmail":           true,
+	"SendMagicLinkEmail":     true,
+	"BatchSend":              true,
+	"IngestCampaign":         true,
+	"GetCampaign":            true,
+	"CancelScheduledEmail":   true,
+	"StreamDeliveryEvents":   true,
+	"VerifyMFACode":          true,
+	"ConsumeMagicLink":       true,
+	"ValidateEmailAddress":   true,
+}
+
+// methodRole returns the role required to call a method given as /<package>.<service>/<method>
+func methodRole(fullMethod string) string {
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	if senderMethods[method] {
+		return utils.RoleSender
+	}
+
+	return utils.RoleAdmin
+}
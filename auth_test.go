@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/isaacwassou/email-service/utils"
+)
+
+func TestMethodRole(t *testing.T) {
+	tests := []struct {
+		method string
+		role   string
+	}{
+		{"SendVerifyEmailEmail", utils.RoleSender},
+		{"SendMFAEmail", utils.RoleSender},
+		{"BatchSend", utils.RoleSender},
+		{"StreamDeliveryEvents", utils.RoleSender},
+		{"VerifyMFACode", utils.RoleSender},
+		{"SetSMTPCredentials", utils.RoleAdmin},
+		{"GetSMTPCredentials", utils.RoleAdmin},
+		{"SetEmailTemplate", utils.RoleAdmin},
+		{"GetEmailTemplate", utils.RoleAdmin},
+		{"CreateWebhookEndpoint", utils.RoleAdmin},
+		{"ReportDeliveryFeedback", utils.RoleAdmin},
+		// a method missing from the list requires the admin role
+		{"SomeNewMethod", utils.RoleAdmin},
+	}
+
+	for _, test := range tests {
+		if role := methodRole("/email_management_service.EmailManager/" + test.method); role != test.role {
+			t.Errorf("methodRole(%s) = %s, expected %s", test.method, role, test.role)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// maxBatchRecipients is the largest number of recipients accepted by a single BatchSend call
+const maxBatchRecipients = 1000
+
+// BatchSend renders the template of the email type for every recipient and queues the emails for delivery.
+// Recipients that fail validation or rendering are reported in their result and do not fail the call.
+func (s *EmailManagerService) BatchSend(ctx context.Context, in *pb.BatchSendRequest) (*pb.BatchSendResponse, error) {
+	if len(in.Recipients) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one recipient is required")
+	}
+
+	if len(in.Recipients) > maxBatchRecipients {
+		return nil, status.Errorf(codes.InvalidArgument, "a batch accepts at most %d recipients", maxBatchRecipients)
+	}
+
+	if _, found := templateNames[in.EmailType]; !found {
+		return nil, status.Error(codes.InvalidArgument, "Invalid email type")
+	}
+
+	// the magic link tokens are generated for a single recipient
+	if in.EmailType == pb.EmailType_MAGIC_LINK {
+		return nil, status.Error(codes.InvalidArgument, "magic link emails are sent through SendMagicLinkEmail")
+	}
+
+	// get the email template details once for the whole batch
+	emailTemplate, err := s.settingsCache.GetEmailTemplateDetails(in.EmailType)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	sendAt := time.Now()
+	if in.SendAt != nil {
+		sendAt = in.SendAt.AsTime()
+	}
+
+	if err := checkLinkTTL(emailTemplate, sendAt); err != nil {
+		return nil, err
+	}
+
+	response := &pb.BatchSendResponse{}
+	emails := []utils.QueuedEmail{}
+	for _, recipient := range in.Recipients {
+		result := &pb.BatchSendResult{To: recipient.To}
+		response.Results = append(response.Results, result)
+
+		email, err := s.renderRecipient(ctx, emailTemplate, in.EmailType, recipient, sendAt)
+		if err != nil {
+			result.Error = err.Error()
+			response.Rejected++
+			continue
+		}
+
+		emails = append(emails, email)
+
+		result.MessageId = email.MessageID
+		response.Accepted++
+	}
+
+	if err := s.enqueueEmails(emails...); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return response, nil
+}
+
+// renderRecipient validates the address of a batch recipient and renders the email template for them, to be sent
+// at sendAt. MFA emails requested without a token carry a code generated for the recipient, which is stored to be
+// checked through VerifyMFACode.
+func (s *EmailManagerService) renderRecipient(ctx context.Context, emailTemplate utils.EmailTemplateDetails, emailType pb.EmailType, recipient *pb.BatchRecipient, sendAt time.Time) (utils.QueuedEmail, error) {
+	to, err := s.normalizeRecipient(ctx, recipient.To)
+	if err != nil {
+		return utils.QueuedEmail{}, err
+	}
+
+	// the generated code is also used as the token of the redirect URL
+	token := recipient.Token
+	generateCode := emailType == pb.EmailType_MFA && token == ""
+	if generateCode {
+		if sendAt.After(time.Now()) {
+			return utils.QueuedEmail{}, errors.New("emails with a generated code cannot be scheduled")
+		}
+
+		emailTemplate.Code, err = utils.GenerateMFACode(emailTemplate.CodeLength)
+		if err != nil {
+			return utils.QueuedEmail{}, err
+		}
+		token = emailTemplate.Code
+	}
+
+	email, err := s.renderEmail(emailTemplate, emailType, to, token, recipient.Variables)
+	if err != nil {
+		return utils.QueuedEmail{}, err
+	}
+	email.SendAt = sendAt
+
+	if generateCode {
+		// the generated code is only stored encrypted in the queue
+		if err := s.encryptEmailBody(ctx, &email); err != nil {
+			return utils.QueuedEmail{}, err
+		}
+
+		// store the hash of the generated code to be checked through VerifyMFACode
+		if err := utils.InsertMFACode(s.emailServiceDB.Db, s.config.MFACodeKey, email.MessageID, email.Recipient, emailTemplate.Code, emailTemplate.CodeTTL); err != nil {
+			return utils.QueuedEmail{}, err
+		}
+	}
+
+	return email, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+)
+
+func TestBatchSend(t *testing.T) {
+	s := newTestService(t)
+	setMFATemplate(t, s)
+
+	sendAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	response, err := s.BatchSend(context.Background(), &pb.BatchSendRequest{
+		EmailType: pb.EmailType_MFA,
+		Recipients: []*pb.BatchRecipient{
+			{To: "first@example.com", Token: "first-token"},
+			{To: "plainaddress", Token: "invalid-token"},
+			{To: "second@example.com", Token: "second-token"},
+		},
+		SendAt: timestamppb.New(sendAt),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Accepted != 2 || response.Rejected != 1 {
+		t.Fatalf("accepted %d and rejected %d recipients, expected 2 and 1", response.Accepted, response.Rejected)
+	}
+	// the results are in the order of the recipients
+	for i, to := range []string{"first@example.com", "plainaddress", "second@example.com"} {
+		result := response.Results[i]
+		if result.To != to {
+			t.Errorf("result %d is for %s, expected %s", i, result.To, to)
+		}
+		rejected := to == "plainaddress"
+		if rejected != (result.Error != "") || rejected != (result.MessageId == "") {
+			t.Errorf("the result of %s is %+v, expected either a message ID or an error", to, result)
+		}
+	}
+
+	for _, result := range []*pb.BatchSendResult{response.Results[0], response.Results[2]} {
+		var recipient string
+		var queuedSendAt time.Time
+		err := s.emailServiceDB.Db.QueryRow("SELECT recipient, send_at FROM email_queue WHERE message_id = ? AND status = 'pending'", result.MessageId).Scan(&recipient, &queuedSendAt)
+		if err != nil {
+			t.Fatalf("the email of %s is not queued: %s", result.To, err)
+		}
+		if recipient != result.To || !queuedSendAt.Equal(sendAt) {
+			t.Errorf("the email of %s is queued to %s at %s, expected it to be sent at %s", result.To, recipient, queuedSendAt, sendAt)
+		}
+	}
+	if count := countRows(t, s, "email_queue"); count != 2 {
+		t.Errorf("queued %d emails, expected 2", count)
+	}
+}
+
+func TestBatchSendRejectsInvalidRequests(t *testing.T) {
+	s := newTestService(t)
+	setMFATemplate(t, s)
+
+	tooMany := []*pb.BatchRecipient{}
+	for i := 0; i <= maxBatchRecipients; i++ {
+		tooMany = append(tooMany, &pb.BatchRecipient{To: "user@example.com", Token: "token"})
+	}
+
+	tests := []struct {
+		name    string
+		request *pb.BatchSendRequest
+	}{
+		{"no recipients", &pb.BatchSendRequest{EmailType: pb.EmailType_MFA}},
+		{"too many recipients", &pb.BatchSendRequest{EmailType: pb.EmailType_MFA, Recipients: tooMany}},
+		{"invalid email type", &pb.BatchSendRequest{EmailType: pb.EmailType(-1), Recipients: tooMany[:1]}},
+		{"magic link", &pb.BatchSendRequest{EmailType: pb.EmailType_MAGIC_LINK, Recipients: tooMany[:1]}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := s.BatchSend(context.Background(), test.request); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("BatchSend() = %v, expected InvalidArgument", err)
+			}
+		})
+	}
+
+	if count := countRows(t, s, "email_queue"); count != 0 {
+		t.Errorf("queued %d emails, expected none", count)
+	}
+}
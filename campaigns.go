@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+const (
+	// campaignFlushSize is the number of rendered emails buffered before they are written to the queue
+	campaignFlushSize = 500
+	// maxCampaignRejections is the number of rejected recipients detailed in the ingestion summary
+	maxCampaignRejections = 100
+)
+
+// IngestCampaign queues the recipients streamed by the caller for a named campaign.
+// The campaign name, email type and send_at time are taken from the first message. Every message is
+// validated, rendered and buffered before the next one is read, and the buffer is written to the queue
+// once full, so a caller streaming faster than the queue accepts is held back by gRPC flow control.
+func (s *EmailManagerService) IngestCampaign(stream pb.EmailManager_IngestCampaignServer) error {
+	var campaignID int64
+	var emailType pb.EmailType
+	var emailTemplate utils.EmailTemplateDetails
+	var accepted, rejected int
+	sendAt := time.Now()
+	response := &pb.IngestCampaignResponse{}
+	emails := []utils.QueuedEmail{}
+
+	// flush writes the buffered emails to the queue
+	flush := func() error {
+		if err := s.enqueueEmails(emails...); err != nil {
+			return err
+		}
+		accepted += len(emails)
+		emails = emails[:0]
+
+		return nil
+	}
+
+	for {
+		in, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if campaignID != 0 {
+				// keep the recipients received before the stream broke
+				if err := flush(); err != nil {
+					log.Printf("Failed to queue the buffered emails of the campaign %d: %s", campaignID, err)
+				}
+				s.abortCampaign(campaignID, accepted, rejected)
+			}
+			return err
+		}
+
+		// create the campaign from the first message
+		if campaignID == 0 {
+			if in.CampaignName == "" {
+				return status.Error(codes.InvalidArgument, "campaign name is required")
+			}
+
+			if _, found := templateNames[in.EmailType]; !found {
+				return status.Error(codes.InvalidArgument, "Invalid email type")
+			}
+
+			// the magic link tokens are generated for a single recipient
+			if in.EmailType == pb.EmailType_MAGIC_LINK {
+				return status.Error(codes.InvalidArgument, "magic link emails are sent through SendMagicLinkEmail")
+			}
+
+			emailType = in.EmailType
+			emailTemplate, err = s.settingsCache.GetEmailTemplateDetails(emailType)
+			if err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+
+			if in.SendAt != nil {
+				sendAt = in.SendAt.AsTime()
+			}
+
+			if err := checkLinkTTL(emailTemplate, sendAt); err != nil {
+				return err
+			}
+
+			campaignID, err = utils.InsertCampaign(s.emailServiceDB.Db, in.CampaignName, emailType.String())
+			if err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+
+		if in.Recipient == nil {
+			continue
+		}
+
+		email, err := s.renderRecipient(stream.Context(), emailTemplate, emailType, in.Recipient, sendAt)
+		if err != nil {
+			rejected++
+			if len(response.Rejections) < maxCampaignRejections {
+				response.Rejections = append(response.Rejections, &pb.BatchSendResult{To: in.Recipient.To, Error: err.Error()})
+			}
+			continue
+		}
+
+		email.CampaignID = campaignID
+		emails = append(emails, email)
+
+		if len(emails) >= campaignFlushSize {
+			if err := flush(); err != nil {
+				s.abortCampaign(campaignID, accepted, rejected)
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+	}
+
+	if campaignID == 0 {
+		return status.Error(codes.InvalidArgument, "the stream did not contain any campaign message")
+	}
+
+	if err := flush(); err != nil {
+		s.abortCampaign(campaignID, accepted, rejected)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if err := utils.UpdateCampaign(s.emailServiceDB.Db, campaignID, utils.CampaignStatusIngested, accepted, rejected); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	response.CampaignId = campaignID
+	response.Accepted = int32(accepted)
+	response.Rejected = int32(rejected)
+
+	return stream.SendAndClose(response)
+}
+
+// abortCampaign records the counts of a campaign whose ingestion did not complete and marks it as aborted
+func (s *EmailManagerService) abortCampaign(campaignID int64, accepted int, rejected int) {
+	if err := utils.UpdateCampaign(s.emailServiceDB.Db, campaignID, utils.CampaignStatusAborted, accepted, rejected); err != nil {
+		log.Printf("Failed to mark the campaign %d as aborted: %s", campaignID, err)
+	}
+}
+
+// GetCampaign returns the ingestion summary of a campaign and the progress of its emails through the queue
+func (s *EmailManagerService) GetCampaign(ctx context.Context, in *pb.GetCampaignRequest) (*pb.Campaign, error) {
+	campaign, err := utils.GetCampaign(s.emailServiceDB.Db, in.CampaignId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.NotFound, "campaign %d not found", in.CampaignId)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.Campaign{
+		Id:        campaign.ID,
+		Name:      campaign.Name,
+		EmailType: pb.EmailType(pb.EmailType_value[campaign.EmailType]),
+		Status:    campaign.Status,
+		Accepted:  int32(campaign.Accepted),
+		Rejected:  int32(campaign.Rejected),
+		Pending:   int32(campaign.QueueStatuses["pending"] + campaign.QueueStatuses["sending"]),
+		Sent:      int32(campaign.QueueStatuses["sent"]),
+		Failed:    int32(campaign.QueueStatuses["failed"]),
+		Cancelled: int32(campaign.QueueStatuses["cancelled"]),
+		CreatedAt: timestamppb.New(campaign.CreatedAt),
+	}, nil
+}
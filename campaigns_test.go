@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// campaignRequests returns the requests of a campaign of MFA emails, one per recipient
+func campaignRequests(name string, recipients ...string) []*pb.IngestCampaignRequest {
+	requests := []*pb.IngestCampaignRequest{}
+	for _, recipient := range recipients {
+		requests = append(requests, &pb.IngestCampaignRequest{Recipient: &pb.BatchRecipient{To: recipient, Token: "token"}})
+	}
+	if len(requests) > 0 {
+		requests[0].CampaignName = name
+		requests[0].EmailType = pb.EmailType_MFA
+	}
+
+	return requests
+}
+
+// campaignRecipients returns count distinct recipient addresses
+func campaignRecipients(count int) []string {
+	addresses := []string{}
+	for i := 0; i < count; i++ {
+		addresses = append(addresses, fmt.Sprintf("user%d@example.com", i))
+	}
+
+	return addresses
+}
+
+func TestIngestCampaignFlushesTheBuffer(t *testing.T) {
+	s := newTestService(t)
+	setMFATemplate(t, s)
+
+	// the buffer is written to the queue once full, before the next recipient is received
+	queued := -1
+	stream := &fakeIngestCampaignStream{requests: campaignRequests("flush", campaignRecipients(campaignFlushSize+1)...)}
+	stream.beforeRecv = func(remaining int) {
+		if remaining == 0 {
+			queued = countRows(t, s, "email_queue")
+		}
+	}
+	if err := s.IngestCampaign(stream); err != nil {
+		t.Fatal(err)
+	}
+	if queued != campaignFlushSize {
+		t.Errorf("%d emails were queued before the last recipient, expected %d", queued, campaignFlushSize)
+	}
+
+	// the rest of the buffer is written once the stream ends
+	if count := countRows(t, s, "email_queue"); count != campaignFlushSize+1 {
+		t.Errorf("queued %d emails, expected %d", count, campaignFlushSize+1)
+	}
+	if stream.response.Accepted != campaignFlushSize+1 || stream.response.Rejected != 0 {
+		t.Errorf("the campaign accepted %d and rejected %d recipients, expected %d accepted", stream.response.Accepted, stream.response.Rejected, campaignFlushSize+1)
+	}
+
+	campaign, err := s.GetCampaign(context.Background(), &pb.GetCampaignRequest{CampaignId: stream.response.CampaignId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if campaign.Status != utils.CampaignStatusIngested || campaign.Accepted != campaignFlushSize+1 || campaign.Pending != campaignFlushSize+1 {
+		t.Errorf("GetCampaign() = %+v, expected an ingested campaign with every email pending", campaign)
+	}
+}
+
+func TestIngestCampaignSummary(t *testing.T) {
+	s := newTestService(t)
+	setMFATemplate(t, s)
+
+	// only the first rejections are detailed, all of them being counted
+	invalid := []string{}
+	for i := 0; i <= maxCampaignRejections; i++ {
+		invalid = append(invalid, fmt.Sprintf("invalid-%d", i))
+	}
+	stream := &fakeIngestCampaignStream{requests: campaignRequests("summary", append(campaignRecipients(2), invalid...)...)}
+	if err := s.IngestCampaign(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	response := stream.response
+	if response.Accepted != 2 || response.Rejected != int32(len(invalid)) {
+		t.Errorf("the campaign accepted %d and rejected %d recipients, expected 2 and %d", response.Accepted, response.Rejected, len(invalid))
+	}
+	if len(response.Rejections) != maxCampaignRejections {
+		t.Fatalf("the summary details %d rejections, expected %d", len(response.Rejections), maxCampaignRejections)
+	}
+	if response.Rejections[0].To != "invalid-0" || response.Rejections[0].Error == "" {
+		t.Errorf("the first rejection is %+v, expected the first invalid recipient with its error", response.Rejections[0])
+	}
+
+	campaign, err := s.GetCampaign(context.Background(), &pb.GetCampaignRequest{CampaignId: response.CampaignId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if campaign.Name != "summary" || campaign.Accepted != 2 || campaign.Rejected != int32(len(invalid)) {
+		t.Errorf("GetCampaign() = %+v, expected the counts of the summary", campaign)
+	}
+}
+
+func TestIngestCampaignAborted(t *testing.T) {
+	s := newTestService(t)
+	setMFATemplate(t, s)
+
+	// the recipients received before the stream broke are kept
+	streamErr := status.Error(codes.Canceled, "context canceled")
+	stream := &fakeIngestCampaignStream{requests: campaignRequests("aborted", "first@example.com", "second@example.com", "invalid"), err: streamErr}
+	if err := s.IngestCampaign(stream); err != streamErr {
+		t.Fatalf("IngestCampaign() = %v, expected the error of the stream", err)
+	}
+	if stream.response != nil {
+		t.Errorf("IngestCampaign() sent %+v, expected no summary", stream.response)
+	}
+	if count := countRows(t, s, "email_queue"); count != 2 {
+		t.Errorf("queued %d emails, expected the 2 received before the stream broke", count)
+	}
+
+	var campaignStatus string
+	var accepted, rejected int
+	err := s.emailServiceDB.Db.QueryRow("SELECT status, accepted, rejected FROM campaigns WHERE name = ?", "aborted").Scan(&campaignStatus, &accepted, &rejected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if campaignStatus != utils.CampaignStatusAborted || accepted != 2 || rejected != 1 {
+		t.Errorf("the campaign is %s with %d accepted and %d rejected recipients, expected aborted with 2 and 1", campaignStatus, accepted, rejected)
+	}
+}
+
+func TestIngestCampaignRejectsInvalidCampaigns(t *testing.T) {
+	s := newTestService(t)
+	setMFATemplate(t, s)
+
+	tests := []struct {
+		name     string
+		requests []*pb.IngestCampaignRequest
+	}{
+		{"empty stream", nil},
+		{"missing name", campaignRequests("", "user@example.com")},
+		{"invalid email type", []*pb.IngestCampaignRequest{{CampaignName: "invalid", EmailType: pb.EmailType(100)}}},
+		{"magic link", []*pb.IngestCampaignRequest{{CampaignName: "magic", EmailType: pb.EmailType_MAGIC_LINK}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := s.IngestCampaign(&fakeIngestCampaignStream{requests: test.requests}); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("IngestCampaign() = %v, expected InvalidArgument", err)
+			}
+		})
+	}
+
+	if count := countRows(t, s, "campaigns"); count != 0 {
+		t.Errorf("created %d campaigns, expected none", count)
+	}
+}
@@ -0,0 +1,215 @@
+package database
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redacted replaces the secrets when the configuration is logged
+const redacted = "[redacted]"
+
+var (
+	// mysqlDSNPasswordPattern matches the password of a MySQL DSN, user:password@tcp(host:port)/database,
+	// up to the last @ as the password may contain one
+	mysqlDSNPasswordPattern = regexp.MustCompile(`^([^:@/]*):.*@`)
+	// postgresDSNPasswordPattern matches the password of a PostgreSQL DSN in the key=value form
+	postgresDSNPasswordPattern = regexp.MustCompile(`(password=)('[^']*'|\S+)`)
+)
+
+// Config is the connection to the database and the settings of its connection pool
+type Config struct {
+	// Driver is mysql, postgres or sqlite
+	Driver string
+	// DSN replaces the connection string built from Host, Port, User, Password, Database, SSLMode and Path
+	DSN      string
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Database string
+	// SSLMode is the sslmode of PostgreSQL, verify-full when TLSCAFile is set and disable otherwise
+	SSLMode string
+	// Path is the SQLite database file
+	Path string
+	// TLSCAFile holds the certificates the server certificate is verified against, enabling TLS when set
+	TLSCAFile string
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	ConnectTimeout  time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+}
+
+// ParseConfig reads the database configuration from the settings returned by get and validates it.
+//
+// DB_DRIVER selects the database. The connection is read from DB_DSN or from the <DRIVER>_HOST, <DRIVER>_PORT,
+// <DRIVER>_USER, <DRIVER>_PASSWORD and <DRIVER>_DATABASE settings of MySQL and PostgreSQL, along with
+// POSTGRES_SSLMODE, and from SQLITE_PATH for SQLite. DB_TLS_CA_FILE enables TLS. The pool is sized by
+// DB_MAX_OPEN_CONNS and DB_MAX_IDLE_CONNS, the idle connections being capped to the open ones, and limited by
+// DB_CONN_MAX_LIFETIME, DB_CONN_MAX_IDLE_TIME, DB_CONNECT_TIMEOUT, DB_READ_TIMEOUT and DB_WRITE_TIMEOUT.
+// An empty or zero setting disables a limit.
+func ParseConfig(get func(name string) string) (Config, error) {
+	config := Config{
+		Driver:    get("DB_DRIVER"),
+		DSN:       get("DB_DSN"),
+		SSLMode:   get("POSTGRES_SSLMODE"),
+		Path:      get("SQLITE_PATH"),
+		TLSCAFile: get("DB_TLS_CA_FILE"),
+	}
+
+	prefix := strings.ToUpper(config.Driver) + "_"
+	config.Host = get(prefix + "HOST")
+	config.Port = get(prefix + "PORT")
+	config.User = get(prefix + "USER")
+	config.Password = get(prefix + "PASSWORD")
+	config.Database = get(prefix + "DATABASE")
+
+	// parse the pool settings and the timeouts
+	errs := []error{}
+	parseInt := func(name string) int {
+		value := get(name)
+		if value == "" {
+			return 0
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s must be an integer, got %q", name, value))
+		}
+		return n
+	}
+	parseDuration := func(name string) time.Duration {
+		value := get(name)
+		if value == "" {
+			return 0
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s must be a duration such as 30s, got %q", name, value))
+		}
+		return duration
+	}
+
+	config.MaxOpenConns = parseInt("DB_MAX_OPEN_CONNS")
+	config.MaxIdleConns = parseInt("DB_MAX_IDLE_CONNS")
+	config.ConnMaxLifetime = parseDuration("DB_CONN_MAX_LIFETIME")
+	config.ConnMaxIdleTime = parseDuration("DB_CONN_MAX_IDLE_TIME")
+	config.ConnectTimeout = parseDuration("DB_CONNECT_TIMEOUT")
+	config.ReadTimeout = parseDuration("DB_READ_TIMEOUT")
+	config.WriteTimeout = parseDuration("DB_WRITE_TIMEOUT")
+
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, err
+	}
+
+	return config, config.Validate()
+}
+
+// Validate reports every invalid setting of the configuration at once
+func (c Config) Validate() error {
+	errs := []error{}
+
+	if _, found := dialects[c.Driver]; !found {
+		errs = append(errs, fmt.Errorf("unsupported DB_DRIVER %q, expected mysql, postgres or sqlite", c.Driver))
+	}
+
+	// the connection settings are only needed without a DSN
+	if c.DSN == "" && (c.Driver == "mysql" || c.Driver == "postgres") {
+		prefix := strings.ToUpper(c.Driver) + "_"
+		for _, setting := range []struct{ name, value string }{{"HOST", c.Host}, {"USER", c.User}, {"DATABASE", c.Database}} {
+			if setting.value == "" {
+				errs = append(errs, fmt.Errorf("%s%s is required", prefix, setting.name))
+			}
+		}
+		if c.Port != "" {
+			if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+				errs = append(errs, fmt.Errorf("%sPORT must be a port number, got %q", prefix, c.Port))
+			}
+		}
+	}
+
+	if c.DSN == "" && c.Driver == "sqlite" && c.Path == "" {
+		errs = append(errs, errors.New("SQLITE_PATH is required"))
+	}
+
+	if c.TLSCAFile != "" {
+		if c.Driver == "sqlite" {
+			errs = append(errs, errors.New("DB_TLS_CA_FILE does not apply to sqlite"))
+		} else if _, err := c.tlsConfig(c.Host); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.MaxOpenConns < 0 {
+		errs = append(errs, errors.New("DB_MAX_OPEN_CONNS must not be negative"))
+	}
+	if c.MaxIdleConns < 0 {
+		errs = append(errs, errors.New("DB_MAX_IDLE_CONNS must not be negative"))
+	}
+
+	for _, setting := range []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"DB_CONN_MAX_LIFETIME", c.ConnMaxLifetime},
+		{"DB_CONN_MAX_IDLE_TIME", c.ConnMaxIdleTime},
+		{"DB_CONNECT_TIMEOUT", c.ConnectTimeout},
+		{"DB_READ_TIMEOUT", c.ReadTimeout},
+		{"DB_WRITE_TIMEOUT", c.WriteTimeout},
+	} {
+		if setting.duration < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", setting.name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// String describes the configuration for the logs, with the password and the password of the DSN redacted
+func (c Config) String() string {
+	password := ""
+	if c.Password != "" {
+		password = redacted
+	}
+
+	return fmt.Sprintf(
+		"driver=%s dsn=%q host=%s port=%s user=%s password=%s database=%s sslmode=%s path=%s tls_ca_file=%s max_open_conns=%d max_idle_conns=%d conn_max_lifetime=%s conn_max_idle_time=%s connect_timeout=%s read_timeout=%s write_timeout=%s",
+		c.Driver, RedactDSN(c.DSN), c.Host, c.Port, c.User, password, c.Database, c.SSLMode, c.Path, c.TLSCAFile,
+		c.MaxOpenConns, c.MaxIdleConns, c.ConnMaxLifetime, c.ConnMaxIdleTime, c.ConnectTimeout, c.ReadTimeout, c.WriteTimeout,
+	)
+}
+
+// RedactDSN returns the DSN with its password redacted
+func RedactDSN(dsn string) string {
+	if parsed, err := url.Parse(dsn); err == nil && parsed.User != nil {
+		return parsed.Redacted()
+	}
+
+	dsn = mysqlDSNPasswordPattern.ReplaceAllString(dsn, "${1}:"+redacted+"@")
+	return postgresDSNPasswordPattern.ReplaceAllString(dsn, "${1}"+redacted)
+}
+
+// tlsConfig returns the TLS configuration verifying the server certificate against TLSCAFile
+func (c Config) tlsConfig(serverName string) (*tls.Config, error) {
+	pem, err := os.ReadFile(c.TLSCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DB_TLS_CA_FILE: %w", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("DB_TLS_CA_FILE %s holds no PEM certificate", c.TLSCAFile)
+	}
+
+	return &tls.Config{RootCAs: roots, ServerName: serverName, MinVersion: tls.VersionTLS12}, nil
+}
@@ -1,31 +1,168 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"os"
-
-	_ "github.com/go-sql-driver/mysql"
 )
 
 type EmailServiceDB struct {
-	Db *sql.DB
+	Db *DB
+}
+
+// DB is a connection pool that rewrites the placeholders of the queries for its dialect,
+// so the queries are written once with ? placeholders. The pool is not embedded, so no query
+// can reach the database without its placeholders being rewritten.
+type DB struct {
+	db      *sql.DB
+	Dialect Dialect
+}
+
+// Tx is a transaction that rewrites the placeholders of the queries for its dialect
+type Tx struct {
+	tx      *sql.Tx
+	Dialect Dialect
+}
+
+// NewEmailServiceDB connects to the database of a config returned by LoadConfig
+func NewEmailServiceDB(config Config) (*EmailServiceDB, error) {
+	dialect, found := dialects[config.Driver]
+	if !found {
+		return nil, fmt.Errorf("unsupported DB_DRIVER %q, expected mysql, postgres or sqlite", config.Driver)
+	}
+
+	db, err := dialect.Open(config)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+
+	return &EmailServiceDB{Db: &DB{db: db, Dialect: dialect}}, nil
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.db.Exec(db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return db.db.ExecContext(ctx, db.Dialect.Rebind(query), args...)
 }
 
-func NewEmailServiceDB() (*EmailServiceDB, error) {
-	// read the environment variables
-	user := os.Getenv("MYSQL_USER")
-	pass := os.Getenv("MYSQL_PASSWORD")
-	host := os.Getenv("MYSQL_HOST")
-	port := os.Getenv("MYSQL_PORT")
-	name := os.Getenv("MYSQL_DATABASE")
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.db.Query(db.Dialect.Rebind(query), args...)
+}
 
-	db, err := sql.Open(
-		"mysql",
-		fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", user, pass, host, port, name),
-	)
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return db.db.QueryContext(ctx, db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	return db.db.QueryRow(db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return db.db.QueryRowContext(ctx, db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	return db.BeginTx(context.Background(), nil)
+}
+
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := db.db.BeginTx(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
-	return &EmailServiceDB{Db: db}, nil
+
+	return &Tx{tx: tx, Dialect: db.Dialect}, nil
+}
+
+func (db *DB) Ping() error {
+	return db.db.Ping()
+}
+
+func (db *DB) PingContext(ctx context.Context) error {
+	return db.db.PingContext(ctx)
+}
+
+func (db *DB) Close() error {
+	return db.db.Close()
+}
+
+// InsertID runs an INSERT into a table with an id column generated by the database and returns the id of the row
+func (db *DB) InsertID(ctx context.Context, query string, args ...any) (int64, error) {
+	return insertID(ctx, db.Dialect, db.db, query, args...)
+}
+
+// Repository returns the repository of the database running its queries on the pool
+func (db *DB) Repository() Repository {
+	return db.Dialect.Repository(db)
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.tx.Exec(tx.Dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return tx.tx.ExecContext(ctx, tx.Dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.tx.Query(tx.Dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return tx.tx.QueryContext(ctx, tx.Dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.tx.QueryRow(tx.Dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return tx.tx.QueryRowContext(ctx, tx.Dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) Commit() error {
+	return tx.tx.Commit()
+}
+
+func (tx *Tx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+// InsertID runs an INSERT into a table with an id column generated by the database and returns the id of the row
+func (tx *Tx) InsertID(ctx context.Context, query string, args ...any) (int64, error) {
+	return insertID(ctx, tx.Dialect, tx.tx, query, args...)
+}
+
+// Repository returns the repository of the database running its queries in the transaction
+func (tx *Tx) Repository() Repository {
+	return tx.Dialect.Repository(tx)
+}
+
+type queryExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func insertID(ctx context.Context, dialect Dialect, db queryExecer, query string, args ...any) (int64, error) {
+	query = dialect.Rebind(query)
+
+	if dialect.Returning() {
+		var id int64
+		err := db.QueryRowContext(ctx, query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
 }
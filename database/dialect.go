@@ -0,0 +1,50 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Dialect holds what differs between the databases the service can store its data in
+type Dialect interface {
+	// Name is the value of DB_DRIVER selecting the dialect, and the directory of its migrations
+	Name() string
+	// Open connects to the database of the config
+	Open(config Config) (*sql.DB, error)
+	// Rebind rewrites the ? placeholders of a query into the ones the database expects
+	Rebind(query string) string
+	// Upsert returns an INSERT of the columns that updates the update columns when the key columns conflict
+	Upsert(table string, columns []string, keys []string, update []string) string
+	// InsertIgnore returns an INSERT of the columns that does nothing when the row already exists
+	InsertIgnore(table string, columns []string) string
+	// Returning reports whether an INSERT returns the generated ID with RETURNING id rather than through LastInsertId
+	Returning() bool
+	// Repository returns the implementation of the repository for the database, running its queries on q
+	Repository(q queryer) Repository
+	// LockMigrations keeps the other replicas from migrating until UnlockMigrations is called on the same connection
+	LockMigrations(ctx context.Context, conn *sql.Conn) error
+	UnlockMigrations(ctx context.Context, conn *sql.Conn) error
+}
+
+var dialects = map[string]Dialect{
+	"mysql":    mysqlDialect{},
+	"postgres": postgresDialect{},
+	"sqlite":   sqliteDialect{},
+}
+
+// insertValues returns the column list and the placeholders of an INSERT
+func insertValues(table string, columns []string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "))
+}
+
+// upsertOnConflict is the upsert of the dialects supporting ON CONFLICT
+func upsertOnConflict(table string, columns []string, keys []string, update []string) string {
+	assignments := []string{}
+	for _, column := range update {
+		assignments = append(assignments, column+" = excluded."+column)
+	}
+
+	return insertValues(table, columns) + " ON CONFLICT (" + strings.Join(keys, ", ") + ") DO UPDATE SET " + strings.Join(assignments, ", ")
+}
@@ -0,0 +1,268 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds a directory of migrations per dialect, as the DDL differs between the databases
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// migrationFilePattern matches the migration files, named <version>_<name>.up.sql and <version>_<name>.down.sql
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrations returns the embedded migrations of a dialect ordered by version
+func Migrations(dialect Dialect) ([]Migration, error) {
+	dir := path.Join("migrations", dialect.Name())
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := map[int64]*Migration{}
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, found := migrations[version]
+		if !found {
+			migration = &Migration{Version: version, Name: match[2]}
+			migrations[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, migration.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	ordered := []Migration{}
+	for _, migration := range migrations {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		ordered = append(ordered, *migration)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].Version < ordered[j].Version })
+
+	return ordered, nil
+}
+
+// MigrateUp applies the migrations that are not applied yet and returns them
+func (db *EmailServiceDB) MigrateUp(ctx context.Context) ([]Migration, error) {
+	migrations, err := Migrations(db.Db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []Migration{}
+	err = db.withMigrationsLock(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			if _, found := versions[migration.Version]; found {
+				continue
+			}
+
+			// MySQL commits every DDL statement on its own, so a migration is only recorded once all of it ran
+			if err := execStatements(ctx, conn, migration.Up); err != nil {
+				return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+
+			if _, err := conn.ExecContext(ctx, db.Db.Dialect.Rebind("INSERT INTO schema_migrations (version, name) VALUES (?, ?)"), migration.Version, migration.Name); err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// MigrateDown reverts the last steps applied migrations and returns them
+func (db *EmailServiceDB) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	migrations, err := Migrations(db.Db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	reverted := []Migration{}
+	err = db.withMigrationsLock(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := migrations[i]
+			if _, found := versions[migration.Version]; !found {
+				continue
+			}
+
+			if err := execStatements(ctx, conn, migration.Down); err != nil {
+				return fmt.Errorf("reverting migration %d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+
+			if _, err := conn.ExecContext(ctx, db.Db.Dialect.Rebind("DELETE FROM schema_migrations WHERE version = ?"), migration.Version); err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+// MigrationStatus returns every embedded migration and whether it is applied
+func (db *EmailServiceDB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := Migrations(db.Db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	err = db.withMigrationsLock(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			appliedAt, applied := versions[migration.Version]
+			statuses = append(statuses, MigrationStatus{Migration: migration, Applied: applied, AppliedAt: appliedAt})
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// SeedSettings creates the missing settings rows with a NULL value, so the admin RPCs always have a row to update
+func (db *EmailServiceDB) SeedSettings(ctx context.Context, names []string) error {
+	for _, name := range names {
+		if _, err := db.Db.ExecContext(ctx, db.Db.Dialect.InsertIgnore("settings", []string{"name"}), name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// withMigrationsLock runs f on a single connection holding the migrations lock, with the schema_migrations table created
+func (db *EmailServiceDB) withMigrationsLock(ctx context.Context, f func(conn *sql.Conn) error) error {
+	conn, err := db.Db.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// replicas starting together migrate one at a time
+	if err := db.Db.Dialect.LockMigrations(ctx, conn); err != nil {
+		return err
+	}
+	defer db.Db.Dialect.UnlockMigrations(context.Background(), conn)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT NOT NULL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+
+	return f(conn)
+}
+
+// appliedMigrations returns the versions of the applied migrations with the time they were applied
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := map[int64]time.Time{}
+	for rows.Next() {
+		var version int64
+		var appliedAt sql.NullTime
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		versions[version] = appliedAt.Time
+	}
+
+	return versions, rows.Err()
+}
+
+// execStatements runs the statements of a migration file one by one, every statement ending with a
+// semicolon at the end of a line
+func execStatements(ctx context.Context, conn *sql.Conn, script string) error {
+	statement := ""
+	for _, line := range strings.Split(script, "\n") {
+		statement += line + "\n"
+		if !strings.HasSuffix(strings.TrimSpace(line), ";") {
+			continue
+		}
+
+		if _, err := conn.ExecContext(ctx, strings.TrimSuffix(strings.TrimSpace(statement), ";")); err != nil {
+			return err
+		}
+		statement = ""
+	}
+
+	if strings.TrimSpace(statement) != "" {
+		_, err := conn.ExecContext(ctx, strings.TrimSpace(statement))
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDB returns an unmigrated SQLite database that is removed when the test ends
+func newTestDB(t *testing.T) *EmailServiceDB {
+	t.Helper()
+
+	db, err := NewEmailServiceDB(Config{Driver: "sqlite", Path: filepath.Join(t.TempDir(), "email-service.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Db.Close() })
+
+	return db
+}
+
+// tableExists reports whether the SQLite database has a table
+func tableExists(t *testing.T, db *EmailServiceDB, table string) bool {
+	t.Helper()
+
+	var count int
+	if err := db.Db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	return count > 0
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	migrations, err := Migrations(db.Db.Dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := db.MigrateUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("applied %d migrations, expected %d", len(applied), len(migrations))
+	}
+
+	// the settings version row is seeded along with its table
+	var version int64
+	if err := db.Db.QueryRow("SELECT version FROM settings_version WHERE id = 1").Scan(&version); err != nil {
+		t.Fatalf("the settings version row is missing: %s", err)
+	}
+
+	statuses, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied || status.AppliedAt.IsZero() {
+			t.Errorf("migration %d_%s is not reported as applied", status.Version, status.Name)
+		}
+	}
+
+	if applied, err := db.MigrateUp(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("migrating up again applied %d migrations with error %v, expected none", len(applied), err)
+	}
+
+	reverted, err := db.MigrateDown(ctx, len(migrations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(migrations) {
+		t.Fatalf("reverted %d migrations, expected %d", len(reverted), len(migrations))
+	}
+	for _, table := range []string{"settings", "settings_version", "email_queue", "webhook_endpoints"} {
+		if tableExists(t, db, table) {
+			t.Errorf("table %s still exists after every migration was reverted", table)
+		}
+	}
+
+	statuses, err = db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.Applied {
+			t.Errorf("migration %d_%s is still reported as applied", status.Version, status.Name)
+		}
+	}
+
+	// the down migrations leave a schema the up migrations apply to again
+	if applied, err := db.MigrateUp(ctx); err != nil || len(applied) != len(migrations) {
+		t.Errorf("migrating up again applied %d migrations with error %v, expected %d", len(applied), err, len(migrations))
+	}
+}
+
+func TestMigrationsOfEveryDialect(t *testing.T) {
+	for name, dialect := range dialects {
+		migrations, err := Migrations(dialect)
+		if err != nil {
+			t.Errorf("the %s migrations are invalid: %s", name, err)
+			continue
+		}
+		if len(migrations) == 0 {
+			t.Errorf("there are no %s migrations", name)
+		}
+	}
+}
+
+func TestPostgresRebind(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT * FROM settings WHERE name = ?", "SELECT * FROM settings WHERE name = $1"},
+		{"UPDATE settings SET value = ? WHERE name = ?", "UPDATE settings SET value = $1 WHERE name = $2"},
+		{"SELECT * FROM settings WHERE value = '?' AND name = ?", "SELECT * FROM settings WHERE value = '?' AND name = $1"},
+	}
+
+	for _, test := range tests {
+		if rebound := (postgresDialect{}).Rebind(test.query); rebound != test.expected {
+			t.Errorf("Rebind(%q) = %q, expected %q", test.query, rebound, test.expected)
+		}
+	}
+}
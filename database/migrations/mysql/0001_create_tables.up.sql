@@ -0,0 +1,160 @@
+CREATE TABLE IF NOT EXISTS delivery_events (
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	message_id VARCHAR(64) NOT NULL,
+	event_type VARCHAR(32) NOT NULL,
+	email_type VARCHAR(64) NOT NULL,
+	recipient VARCHAR(320) NOT NULL,
+	detail TEXT NULL,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	INDEX idx_delivery_events_message_id (message_id)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	url VARCHAR(2048) NOT NULL,
+	event_types VARCHAR(255) NOT NULL,
+	secret TEXT NOT NULL,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	endpoint_id BIGINT UNSIGNED NOT NULL,
+	event_id BIGINT UNSIGNED NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'pending',
+	attempts INT NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	locked_until TIMESTAMP(6) NULL,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	INDEX idx_webhook_deliveries_status (status, next_attempt_at),
+	FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	delivery_id BIGINT UNSIGNED NOT NULL,
+	endpoint_id BIGINT UNSIGNED NOT NULL,
+	event_id BIGINT UNSIGNED NOT NULL,
+	attempt INT NOT NULL,
+	status_code INT NULL,
+	error TEXT NULL,
+	succeeded BOOLEAN NOT NULL,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	INDEX idx_webhook_attempts_endpoint_id (endpoint_id, id),
+	FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS campaigns (
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	email_type VARCHAR(64) NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'ingesting',
+	accepted INT NOT NULL DEFAULT 0,
+	rejected INT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE IF NOT EXISTS email_queue (
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	message_id VARCHAR(64) NOT NULL UNIQUE,
+	campaign_id BIGINT UNSIGNED NULL,
+	email_type VARCHAR(64) NOT NULL,
+	recipient VARCHAR(320) NOT NULL,
+	recipient_name VARCHAR(255) NULL,
+	subject TEXT NOT NULL,
+	body MEDIUMTEXT NOT NULL,
+	text_body MEDIUMTEXT NULL,
+	encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+	send_at TIMESTAMP(6) NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'pending',
+	attempts INT NOT NULL DEFAULT 0,
+	locked_until TIMESTAMP(6) NULL,
+	last_error TEXT NULL,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	INDEX idx_email_queue_status (status, send_at),
+	INDEX idx_email_queue_campaign_id (campaign_id),
+	FOREIGN KEY (campaign_id) REFERENCES campaigns (id)
+);
+
+CREATE TABLE IF NOT EXISTS email_queue_attachments (
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	message_id VARCHAR(64) NOT NULL,
+	filename VARCHAR(255) NOT NULL,
+	content_type VARCHAR(255) NOT NULL,
+	content_id VARCHAR(255) NULL,
+	content MEDIUMBLOB NOT NULL,
+	FOREIGN KEY (message_id) REFERENCES email_queue (message_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS assets (
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	name VARCHAR(255) NOT NULL UNIQUE,
+	filename VARCHAR(255) NOT NULL,
+	content_type VARCHAR(255) NOT NULL,
+	content MEDIUMBLOB NOT NULL,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE IF NOT EXISTS template_assets (
+	email_type VARCHAR(64) NOT NULL,
+	content_id VARCHAR(255) NOT NULL,
+	filename VARCHAR(255) NOT NULL,
+	content_type VARCHAR(255) NOT NULL,
+	content MEDIUMBLOB NOT NULL,
+	PRIMARY KEY (email_type, content_id)
+);
+
+CREATE TABLE IF NOT EXISTS template_partials (
+	name VARCHAR(255) NOT NULL PRIMARY KEY,
+	kind VARCHAR(16) NOT NULL,
+	body MEDIUMTEXT NOT NULL,
+	updated_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE IF NOT EXISTS mfa_codes (
+	message_id VARCHAR(64) NOT NULL PRIMARY KEY,
+	recipient VARCHAR(320) NOT NULL,
+	code_hash VARBINARY(64) NOT NULL,
+	salt VARBINARY(16) NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	expires_at TIMESTAMP(6) NOT NULL,
+	consumed_at TIMESTAMP(6) NULL,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE IF NOT EXISTS magic_links (
+	token_hash VARBINARY(32) NOT NULL PRIMARY KEY,
+	message_id VARCHAR(64) NOT NULL,
+	recipient VARCHAR(320) NOT NULL,
+	expires_at TIMESTAMP(6) NOT NULL,
+	consumed_at TIMESTAMP(6) NULL,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE IF NOT EXISTS disposable_domains (
+	domain VARCHAR(255) NOT NULL PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS redirect_origins (
+	origin VARCHAR(255) NOT NULL PRIMARY KEY,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE IF NOT EXISTS settings_version (
+	id TINYINT UNSIGNED NOT NULL PRIMARY KEY,
+	version BIGINT UNSIGNED NOT NULL
+);
+
+INSERT IGNORE INTO settings_version (id, version) VALUES (1, 0);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	actor VARCHAR(255) NOT NULL,
+	rpc VARCHAR(128) NOT NULL,
+	target VARCHAR(255) NOT NULL,
+	before_values MEDIUMTEXT NOT NULL,
+	after_values MEDIUMTEXT NOT NULL,
+	caller_ip VARCHAR(64) NOT NULL,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	INDEX idx_audit_events_created_at (created_at)
+);
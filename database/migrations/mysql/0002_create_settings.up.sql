@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS settings (
+	name VARCHAR(64) NOT NULL PRIMARY KEY,
+	value MEDIUMTEXT NULL
+);
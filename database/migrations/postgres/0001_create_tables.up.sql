@@ -0,0 +1,160 @@
+CREATE TABLE IF NOT EXISTS delivery_events (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	message_id VARCHAR(64) NOT NULL,
+	event_type VARCHAR(32) NOT NULL,
+	email_type VARCHAR(64) NOT NULL,
+	recipient VARCHAR(320) NOT NULL,
+	detail TEXT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_delivery_events_message_id ON delivery_events (message_id);
+
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	url VARCHAR(2048) NOT NULL,
+	event_types VARCHAR(255) NOT NULL,
+	secret TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	endpoint_id BIGINT NOT NULL,
+	event_id BIGINT NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'pending',
+	attempts INT NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	locked_until TIMESTAMPTZ NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_status ON webhook_deliveries (status, next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	delivery_id BIGINT NOT NULL,
+	endpoint_id BIGINT NOT NULL,
+	event_id BIGINT NOT NULL,
+	attempt INT NOT NULL,
+	status_code INT NULL,
+	error TEXT NULL,
+	succeeded BOOLEAN NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_attempts_endpoint_id ON webhook_attempts (endpoint_id, id);
+
+CREATE TABLE IF NOT EXISTS campaigns (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	email_type VARCHAR(64) NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'ingesting',
+	accepted INT NOT NULL DEFAULT 0,
+	rejected INT NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS email_queue (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	message_id VARCHAR(64) NOT NULL UNIQUE,
+	campaign_id BIGINT NULL,
+	email_type VARCHAR(64) NOT NULL,
+	recipient VARCHAR(320) NOT NULL,
+	recipient_name VARCHAR(255) NULL,
+	subject TEXT NOT NULL,
+	body TEXT NOT NULL,
+	text_body TEXT NULL,
+	encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+	send_at TIMESTAMPTZ NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'pending',
+	attempts INT NOT NULL DEFAULT 0,
+	locked_until TIMESTAMPTZ NULL,
+	last_error TEXT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (campaign_id) REFERENCES campaigns (id)
+);
+CREATE INDEX IF NOT EXISTS idx_email_queue_status ON email_queue (status, send_at);
+CREATE INDEX IF NOT EXISTS idx_email_queue_campaign_id ON email_queue (campaign_id);
+
+CREATE TABLE IF NOT EXISTS email_queue_attachments (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	message_id VARCHAR(64) NOT NULL,
+	filename VARCHAR(255) NOT NULL,
+	content_type VARCHAR(255) NOT NULL,
+	content_id VARCHAR(255) NULL,
+	content BYTEA NOT NULL,
+	FOREIGN KEY (message_id) REFERENCES email_queue (message_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS assets (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	name VARCHAR(255) NOT NULL UNIQUE,
+	filename VARCHAR(255) NOT NULL,
+	content_type VARCHAR(255) NOT NULL,
+	content BYTEA NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS template_assets (
+	email_type VARCHAR(64) NOT NULL,
+	content_id VARCHAR(255) NOT NULL,
+	filename VARCHAR(255) NOT NULL,
+	content_type VARCHAR(255) NOT NULL,
+	content BYTEA NOT NULL,
+	PRIMARY KEY (email_type, content_id)
+);
+
+CREATE TABLE IF NOT EXISTS template_partials (
+	name VARCHAR(255) NOT NULL PRIMARY KEY,
+	kind VARCHAR(16) NOT NULL,
+	body TEXT NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS mfa_codes (
+	message_id VARCHAR(64) NOT NULL PRIMARY KEY,
+	recipient VARCHAR(320) NOT NULL,
+	code_hash BYTEA NOT NULL,
+	salt BYTEA NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	expires_at TIMESTAMPTZ NOT NULL,
+	consumed_at TIMESTAMPTZ NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS magic_links (
+	token_hash BYTEA NOT NULL PRIMARY KEY,
+	message_id VARCHAR(64) NOT NULL,
+	recipient VARCHAR(320) NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	consumed_at TIMESTAMPTZ NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS disposable_domains (
+	domain VARCHAR(255) NOT NULL PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS redirect_origins (
+	origin VARCHAR(255) NOT NULL PRIMARY KEY,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS settings_version (
+	id SMALLINT NOT NULL PRIMARY KEY,
+	version BIGINT NOT NULL
+);
+
+INSERT INTO settings_version (id, version) VALUES (1, 0) ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS audit_events (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	actor VARCHAR(255) NOT NULL,
+	rpc VARCHAR(128) NOT NULL,
+	target VARCHAR(255) NOT NULL,
+	before_values TEXT NOT NULL,
+	after_values TEXT NOT NULL,
+	caller_ip VARCHAR(64) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events (created_at);
@@ -0,0 +1,16 @@
+DROP TABLE IF EXISTS audit_events;
+DROP TABLE IF EXISTS settings_version;
+DROP TABLE IF EXISTS redirect_origins;
+DROP TABLE IF EXISTS disposable_domains;
+DROP TABLE IF EXISTS magic_links;
+DROP TABLE IF EXISTS mfa_codes;
+DROP TABLE IF EXISTS template_partials;
+DROP TABLE IF EXISTS template_assets;
+DROP TABLE IF EXISTS assets;
+DROP TABLE IF EXISTS email_queue_attachments;
+DROP TABLE IF EXISTS email_queue;
+DROP TABLE IF EXISTS campaigns;
+DROP TABLE IF EXISTS webhook_attempts;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_endpoints;
+DROP TABLE IF EXISTS delivery_events;
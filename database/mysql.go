@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlMigrationsLock is the name of the lock held while migrating
+const mysqlMigrationsLock = "email_service_migrations"
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string {
+	return "mysql"
+}
+
+// Open connects with DSN when it is set, the timeouts and TLS settings it leaves out being taken from the config
+func (mysqlDialect) Open(config Config) (*sql.DB, error) {
+	mysqlConfig := mysql.NewConfig()
+	if config.DSN != "" {
+		var err error
+		mysqlConfig, err = mysql.ParseDSN(config.DSN)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		port := config.Port
+		if port == "" {
+			port = "3306"
+		}
+
+		mysqlConfig.User = config.User
+		mysqlConfig.Passwd = config.Password
+		mysqlConfig.Net = "tcp"
+		mysqlConfig.Addr = net.JoinHostPort(config.Host, port)
+		mysqlConfig.DBName = config.Database
+		mysqlConfig.ParseTime = true
+		mysqlConfig.Params = map[string]string{"time_zone": "'+00:00'"}
+	}
+
+	if mysqlConfig.Timeout == 0 {
+		mysqlConfig.Timeout = config.ConnectTimeout
+	}
+	if mysqlConfig.ReadTimeout == 0 {
+		mysqlConfig.ReadTimeout = config.ReadTimeout
+	}
+	if mysqlConfig.WriteTimeout == 0 {
+		mysqlConfig.WriteTimeout = config.WriteTimeout
+	}
+
+	if config.TLSCAFile != "" && mysqlConfig.TLS == nil {
+		host, _, err := net.SplitHostPort(mysqlConfig.Addr)
+		if err != nil {
+			return nil, err
+		}
+
+		mysqlConfig.TLS, err = config.tlsConfig(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	connector, err := mysql.NewConnector(mysqlConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return sql.OpenDB(connector), nil
+}
+
+func (mysqlDialect) Rebind(query string) string {
+	return query
+}
+
+func (mysqlDialect) Upsert(table string, columns []string, keys []string, update []string) string {
+	assignments := []string{}
+	for _, column := range update {
+		assignments = append(assignments, column+" = VALUES("+column+")")
+	}
+
+	return insertValues(table, columns) + " ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", ")
+}
+
+func (mysqlDialect) InsertIgnore(table string, columns []string) string {
+	return strings.Replace(insertValues(table, columns), "INSERT", "INSERT IGNORE", 1)
+}
+
+func (mysqlDialect) Returning() bool {
+	return false
+}
+
+func (d mysqlDialect) Repository(q queryer) Repository {
+	return mysqlRepository{sqlRepository{q: q, dialect: d}}
+}
+
+func (mysqlDialect) LockMigrations(ctx context.Context, conn *sql.Conn) error {
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 60)", mysqlMigrationsLock).Scan(&locked); err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		return errors.New("timed out waiting for another replica to finish migrating")
+	}
+
+	return nil
+}
+
+func (mysqlDialect) UnlockMigrations(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", mysqlMigrationsLock)
+	return err
+}
+
+// mysqlRepository implements the statements MySQL writes differently from the other databases
+type mysqlRepository struct {
+	sqlRepository
+}
+
+// ClaimQueuedEmail locks the email then reads it, since MySQL has no RETURNING. The lock keeps the other
+// replicas from claiming the email in between.
+func (r mysqlRepository) ClaimQueuedEmail(ctx context.Context, id int64, now time.Time, lockedUntil time.Time) (QueuedEmail, bool, error) {
+	result, err := r.q.ExecContext(ctx, claimQueuedEmailQuery, lockedUntil.UTC(), id, now.UTC(), now.UTC())
+	if err != nil {
+		return QueuedEmail{}, false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return QueuedEmail{}, false, err
+	}
+
+	email, err := scanQueuedEmail(r.q.QueryRowContext(ctx, "SELECT "+queuedEmailColumns+" FROM email_queue WHERE id = ?", id), id)
+	if err != nil {
+		return QueuedEmail{}, false, err
+	}
+
+	email.Attachments, err = r.getQueuedEmailAttachments(ctx, email.MessageID)
+	if err != nil {
+		return QueuedEmail{}, false, err
+	}
+
+	return email, true, nil
+}
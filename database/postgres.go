@@ -0,0 +1,167 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresMigrationsLock is the key of the advisory lock held while migrating
+const postgresMigrationsLock = 7367237632
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+// Open connects with DSN when it is set, which then sets TLS through its sslmode and sslrootcert.
+// The read and write timeouts are enforced by the dialer since lib/pq has no setting for them.
+func (postgresDialect) Open(config Config) (*sql.DB, error) {
+	dsn := config.DSN
+	if dsn == "" {
+		port := config.Port
+		if port == "" {
+			port = "5432"
+		}
+
+		dsnURL := url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(config.User, config.Password),
+			Host:   net.JoinHostPort(config.Host, port),
+			Path:   "/" + config.Database,
+		}
+
+		query := url.Values{"timezone": {"UTC"}, "sslmode": {"disable"}}
+		if config.TLSCAFile != "" {
+			query.Set("sslmode", "verify-full")
+			query.Set("sslrootcert", config.TLSCAFile)
+		}
+		if config.SSLMode != "" {
+			query.Set("sslmode", config.SSLMode)
+		}
+		dsnURL.RawQuery = query.Encode()
+		dsn = dsnURL.String()
+	}
+
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	connector.Dialer(timeoutDialer{
+		dialer:       net.Dialer{Timeout: config.ConnectTimeout},
+		readTimeout:  config.ReadTimeout,
+		writeTimeout: config.WriteTimeout,
+	})
+
+	return sql.OpenDB(connector), nil
+}
+
+// timeoutDialer opens connections that fail the reads and writes taking longer than the timeouts
+type timeoutDialer struct {
+	dialer       net.Dialer
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (d timeoutDialer) Dial(network string, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialTimeout is used when the DSN sets connect_timeout, which takes precedence over DB_CONNECT_TIMEOUT
+func (d timeoutDialer) DialTimeout(network string, address string, timeout time.Duration) (net.Conn, error) {
+	d.dialer.Timeout = timeout
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d timeoutDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &timeoutConn{Conn: conn, readTimeout: d.readTimeout, writeTimeout: d.writeTimeout}, nil
+}
+
+type timeoutConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if c.readTimeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.Conn.Write(b)
+}
+
+// Rebind numbers the placeholders, leaving the question marks inside string literals alone
+func (postgresDialect) Rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+
+	var rebound strings.Builder
+	inString := false
+	n := 0
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			inString = !inString
+		case c == '?' && !inString:
+			n++
+			rebound.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		rebound.WriteRune(c)
+	}
+
+	return rebound.String()
+}
+
+func (postgresDialect) Upsert(table string, columns []string, keys []string, update []string) string {
+	return upsertOnConflict(table, columns, keys, update)
+}
+
+func (postgresDialect) InsertIgnore(table string, columns []string) string {
+	return insertValues(table, columns) + " ON CONFLICT DO NOTHING"
+}
+
+func (postgresDialect) Returning() bool {
+	return true
+}
+
+// Repository returns the shared implementation, since the database supports RETURNING
+func (d postgresDialect) Repository(q queryer) Repository {
+	return sqlRepository{q: q, dialect: d}
+}
+
+func (postgresDialect) LockMigrations(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", postgresMigrationsLock)
+	return err
+}
+
+func (postgresDialect) UnlockMigrations(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", postgresMigrationsLock)
+	return err
+}
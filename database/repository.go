@@ -0,0 +1,471 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Repository stores the settings, the email templates and the messages of the service. Every backend has its own
+// implementation, returned by DB.Repository and Tx.Repository to run the queries on the pool or in the transaction.
+type Repository interface {
+	SettingsRepository
+	TemplateRepository
+	MessageRepository
+}
+
+// SettingsRepository stores the settings rows and the version the caches of every replica are checked against
+type SettingsRepository interface {
+	// GetSettings returns the values of the named settings rows, the rows that do not exist being left out
+	GetSettings(ctx context.Context, names []string) (map[string]sql.NullString, error)
+	// UpsertSettings writes the settings rows, creating the missing ones
+	UpsertSettings(ctx context.Context, settings map[string]string) error
+	// GetSettingsVersion returns the number of changes made to the settings
+	GetSettingsVersion(ctx context.Context) (int64, error)
+	// IncrementSettingsVersion tells the caches of every replica that the settings changed
+	IncrementSettingsVersion(ctx context.Context) error
+}
+
+// TemplateRepository stores the layouts and partials shared by the email templates and the inline assets of the templates
+type TemplateRepository interface {
+	// GetTemplatePartials returns every layout and partial ordered by name
+	GetTemplatePartials(ctx context.Context) ([]TemplatePartial, error)
+	// UpsertTemplatePartial creates a layout or partial, or replaces the one with the same name
+	UpsertTemplatePartial(ctx context.Context, partial TemplatePartial) error
+	// DeleteTemplatePartial removes a layout or partial and reports whether it existed
+	DeleteTemplatePartial(ctx context.Context, name string) (bool, error)
+	// GetTemplateAssets returns the inline assets declared by the template of an email type
+	GetTemplateAssets(ctx context.Context, emailType string) ([]Attachment, error)
+	// ReplaceTemplateAssets replaces the inline assets declared by the template of an email type
+	ReplaceTemplateAssets(ctx context.Context, emailType string, assets []Attachment) error
+}
+
+// MessageRepository stores the rendered emails waiting in the queue
+type MessageRepository interface {
+	// EnqueueEmails stores the emails and their attachments, which should be done in a transaction
+	EnqueueEmails(ctx context.Context, emails []QueuedEmail) error
+	// GetDueEmailIDs returns the IDs of up to limit emails due at now, including the ones whose lock expired
+	GetDueEmailIDs(ctx context.Context, now time.Time, limit int) ([]int64, error)
+	// ClaimQueuedEmail locks a due email until lockedUntil and returns it, reporting false when it is not due
+	// or was claimed by another replica
+	ClaimQueuedEmail(ctx context.Context, id int64, now time.Time, lockedUntil time.Time) (QueuedEmail, bool, error)
+	// MarkQueuedEmailSent records that a claimed email was accepted by the SMTP server
+	MarkQueuedEmailSent(ctx context.Context, id int64) error
+	// RetryQueuedEmail releases a claimed email after a failed attempt, to be sent again at sendAt
+	RetryQueuedEmail(ctx context.Context, id int64, attempts int, lastError string, sendAt time.Time) error
+	// FailQueuedEmail gives up on a claimed email after its last failed attempt
+	FailQueuedEmail(ctx context.Context, id int64, attempts int, lastError string) error
+	// CancelQueuedEmail cancels an email that has not been claimed yet and reports whether it exists
+	// and whether it was cancelled
+	CancelQueuedEmail(ctx context.Context, messageID string) (bool, bool, error)
+}
+
+// TemplatePartial is a named layout or partial shared by the email templates
+type TemplatePartial struct {
+	Name      string
+	Kind      string
+	Body      string
+	UpdatedAt time.Time
+}
+
+// Attachment is a file attached to an email, or embedded in it when it has a content ID
+type Attachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Content     []byte
+}
+
+// QueuedEmail is a rendered email waiting in the queue to be sent
+type QueuedEmail struct {
+	ID         int64
+	MessageID  string
+	CampaignID int64
+	EmailType  string
+	Recipient  string
+	// RecipientName is the display name of the recipient, empty when it has none
+	RecipientName string
+	Subject       string
+	Body          string
+	// TextBody is the plain text alternative of the body, empty when the email is HTML only
+	TextBody string
+	// Encrypted reports whether the body and text body are ciphertexts of the cryptography service,
+	// as they are for the emails carrying a code generated by the service
+	Encrypted bool
+	SendAt    time.Time
+	Attempts  int
+	// Attachments holds the files sent with this email only, the inline assets of the template are loaded when sending
+	Attachments []Attachment
+}
+
+// queryer is implemented by *DB and *Tx, so a repository runs its queries on either
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqlRepository implements the repository with the statements the backends share, the upserts being written
+// by the dialect. The backends whose SQL differs for other statements embed it and implement those.
+type sqlRepository struct {
+	q       queryer
+	dialect Dialect
+}
+
+// queuedEmailColumns are the columns of email_queue scanned by scanQueuedEmail
+const queuedEmailColumns = "message_id, email_type, recipient, recipient_name, subject, body, text_body, encrypted, send_at, attempts"
+
+func (r sqlRepository) GetSettings(ctx context.Context, names []string) (map[string]sql.NullString, error) {
+	settings := map[string]sql.NullString{}
+	if len(names) == 0 {
+		return settings, nil
+	}
+
+	args := []any{}
+	for _, name := range names {
+		args = append(args, name)
+	}
+
+	rows, err := r.q.QueryContext(ctx, "SELECT name, value FROM settings WHERE name IN ("+placeholders(len(names))+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var value sql.NullString
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		settings[name] = value
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// UpsertSettings writes the rows in the order of their names so concurrent writers lock the rows in the same order
+func (r sqlRepository) UpsertSettings(ctx context.Context, settings map[string]string) error {
+	names := []string{}
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	query := r.dialect.Upsert("settings", []string{"name", "value"}, []string{"name"}, []string{"value"})
+	for _, name := range names {
+		if _, err := r.q.ExecContext(ctx, query, name, settings[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r sqlRepository) GetSettingsVersion(ctx context.Context) (int64, error) {
+	var version int64
+	err := r.q.QueryRowContext(ctx, "SELECT version FROM settings_version WHERE id = 1").Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+
+	return version, err
+}
+
+// IncrementSettingsVersion runs in the transaction of the change so the caches cannot miss it.
+// The row is created by the migrations.
+func (r sqlRepository) IncrementSettingsVersion(ctx context.Context) error {
+	_, err := r.q.ExecContext(ctx, "UPDATE settings_version SET version = version + 1 WHERE id = 1")
+	return err
+}
+
+func (r sqlRepository) GetTemplatePartials(ctx context.Context) ([]TemplatePartial, error) {
+	rows, err := r.q.QueryContext(ctx, "SELECT name, kind, body, updated_at FROM template_partials ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partials := []TemplatePartial{}
+	for rows.Next() {
+		var partial TemplatePartial
+		if err := rows.Scan(&partial.Name, &partial.Kind, &partial.Body, &partial.UpdatedAt); err != nil {
+			return nil, err
+		}
+		partials = append(partials, partial)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return partials, nil
+}
+
+func (r sqlRepository) UpsertTemplatePartial(ctx context.Context, partial TemplatePartial) error {
+	_, err := r.q.ExecContext(
+		ctx,
+		r.dialect.Upsert("template_partials", []string{"name", "kind", "body", "updated_at"}, []string{"name"}, []string{"kind", "body", "updated_at"}),
+		partial.Name,
+		partial.Kind,
+		partial.Body,
+		time.Now().UTC(),
+	)
+
+	return err
+}
+
+func (r sqlRepository) DeleteTemplatePartial(ctx context.Context, name string) (bool, error) {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM template_partials WHERE name = ?", name)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+func (r sqlRepository) GetTemplateAssets(ctx context.Context, emailType string) ([]Attachment, error) {
+	return r.getAttachments(ctx, "SELECT filename, content_type, content_id, content FROM template_assets WHERE email_type = ? ORDER BY content_id", emailType)
+}
+
+func (r sqlRepository) ReplaceTemplateAssets(ctx context.Context, emailType string, assets []Attachment) error {
+	if _, err := r.q.ExecContext(ctx, "DELETE FROM template_assets WHERE email_type = ?", emailType); err != nil {
+		return err
+	}
+
+	for _, asset := range assets {
+		_, err := r.q.ExecContext(
+			ctx,
+			"INSERT INTO template_assets (email_type, content_id, filename, content_type, content) VALUES (?, ?, ?, ?, ?)",
+			emailType,
+			asset.ContentID,
+			asset.Filename,
+			asset.ContentType,
+			asset.Content,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r sqlRepository) EnqueueEmails(ctx context.Context, emails []QueuedEmail) error {
+	if len(emails) == 0 {
+		return nil
+	}
+
+	query := "INSERT INTO email_queue (message_id, campaign_id, email_type, recipient, recipient_name, subject, body, text_body, encrypted, send_at) VALUES "
+	args := []any{}
+	for i, email := range emails {
+		if i > 0 {
+			query += ", "
+		}
+		query += "(" + placeholders(10) + ")"
+		args = append(
+			args,
+			email.MessageID,
+			sql.NullInt64{Int64: email.CampaignID, Valid: email.CampaignID != 0},
+			email.EmailType,
+			email.Recipient,
+			sql.NullString{String: email.RecipientName, Valid: email.RecipientName != ""},
+			email.Subject,
+			email.Body,
+			sql.NullString{String: email.TextBody, Valid: email.TextBody != ""},
+			email.Encrypted,
+			email.SendAt.UTC(),
+		)
+	}
+
+	if _, err := r.q.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		for _, attachment := range email.Attachments {
+			_, err := r.q.ExecContext(
+				ctx,
+				"INSERT INTO email_queue_attachments (message_id, filename, content_type, content_id, content) VALUES (?, ?, ?, ?, ?)",
+				email.MessageID,
+				attachment.Filename,
+				attachment.ContentType,
+				sql.NullString{String: attachment.ContentID, Valid: attachment.ContentID != ""},
+				attachment.Content,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r sqlRepository) GetDueEmailIDs(ctx context.Context, now time.Time, limit int) ([]int64, error) {
+	rows, err := r.q.QueryContext(
+		ctx,
+		"SELECT id FROM email_queue WHERE (status = 'pending' AND send_at <= ?) OR (status = 'sending' AND locked_until < ?) ORDER BY send_at LIMIT ?",
+		now.UTC(),
+		now.UTC(),
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// claimQueuedEmailQuery locks a due email, its first argument being the end of the lock, then its ID and twice the current time
+const claimQueuedEmailQuery = "UPDATE email_queue SET status = 'sending', locked_until = ? WHERE id = ? AND ((status = 'pending' AND send_at <= ?) OR (status = 'sending' AND locked_until < ?))"
+
+// ClaimQueuedEmail locks the email and reads it back in a single statement with RETURNING
+func (r sqlRepository) ClaimQueuedEmail(ctx context.Context, id int64, now time.Time, lockedUntil time.Time) (QueuedEmail, bool, error) {
+	row := r.q.QueryRowContext(ctx, claimQueuedEmailQuery+" RETURNING "+queuedEmailColumns, lockedUntil.UTC(), id, now.UTC(), now.UTC())
+	email, err := scanQueuedEmail(row, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return QueuedEmail{}, false, nil
+	}
+	if err != nil {
+		return QueuedEmail{}, false, err
+	}
+
+	email.Attachments, err = r.getQueuedEmailAttachments(ctx, email.MessageID)
+	if err != nil {
+		return QueuedEmail{}, false, err
+	}
+
+	return email, true, nil
+}
+
+func (r sqlRepository) MarkQueuedEmailSent(ctx context.Context, id int64) error {
+	_, err := r.q.ExecContext(ctx, "UPDATE email_queue SET status = 'sent', attempts = attempts + 1, locked_until = NULL WHERE id = ?", id)
+
+	return err
+}
+
+func (r sqlRepository) RetryQueuedEmail(ctx context.Context, id int64, attempts int, lastError string, sendAt time.Time) error {
+	_, err := r.q.ExecContext(
+		ctx,
+		"UPDATE email_queue SET status = 'pending', attempts = ?, last_error = ?, locked_until = NULL, send_at = ? WHERE id = ?",
+		attempts,
+		lastError,
+		sendAt.UTC(),
+		id,
+	)
+
+	return err
+}
+
+func (r sqlRepository) FailQueuedEmail(ctx context.Context, id int64, attempts int, lastError string) error {
+	_, err := r.q.ExecContext(
+		ctx,
+		"UPDATE email_queue SET status = 'failed', attempts = ?, last_error = ?, locked_until = NULL WHERE id = ?",
+		attempts,
+		lastError,
+		id,
+	)
+
+	return err
+}
+
+func (r sqlRepository) CancelQueuedEmail(ctx context.Context, messageID string) (bool, bool, error) {
+	result, err := r.q.ExecContext(ctx, "UPDATE email_queue SET status = 'cancelled' WHERE message_id = ? AND status = 'pending'", messageID)
+	if err != nil {
+		return false, false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, false, err
+	}
+
+	if rowsAffected > 0 {
+		return true, true, nil
+	}
+
+	var exists bool
+	err = r.q.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM email_queue WHERE message_id = ?)", messageID).Scan(&exists)
+	if err != nil {
+		return false, false, err
+	}
+
+	return exists, false, nil
+}
+
+// getQueuedEmailAttachments loads the attachments stored along with a queued email
+func (r sqlRepository) getQueuedEmailAttachments(ctx context.Context, messageID string) ([]Attachment, error) {
+	return r.getAttachments(ctx, "SELECT filename, content_type, content_id, content FROM email_queue_attachments WHERE message_id = ? ORDER BY id", messageID)
+}
+
+// getAttachments runs a query selecting the filename, content type, content ID and content of files
+func (r sqlRepository) getAttachments(ctx context.Context, query string, args ...any) ([]Attachment, error) {
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		var attachment Attachment
+		var contentID sql.NullString
+		if err := rows.Scan(&attachment.Filename, &attachment.ContentType, &contentID, &attachment.Content); err != nil {
+			return nil, err
+		}
+		attachment.ContentID = contentID.String
+		attachments = append(attachments, attachment)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attachments, nil
+}
+
+// scanQueuedEmail scans the queuedEmailColumns of the email with the given ID
+func scanQueuedEmail(row *sql.Row, id int64) (QueuedEmail, error) {
+	email := QueuedEmail{ID: id}
+	var recipientName, textBody sql.NullString
+	err := row.Scan(&email.MessageID, &email.EmailType, &email.Recipient, &recipientName, &email.Subject, &email.Body, &textBody, &email.Encrypted, &email.SendAt, &email.Attempts)
+	if err != nil {
+		return QueuedEmail{}, err
+	}
+	email.RecipientName = recipientName.String
+	email.TextBody = textBody.String
+
+	return email, nil
+}
+
+// placeholders returns n comma separated query placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
@@ -0,0 +1,338 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newMigratedTestDB returns a migrated SQLite database that is removed when the test ends
+func newMigratedTestDB(t *testing.T) *DB {
+	t.Helper()
+
+	db := newTestDB(t)
+	if _, err := db.MigrateUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return db.Db
+}
+
+func TestSQLiteRepository(t *testing.T) {
+	testRepository(t, newMigratedTestDB(t))
+}
+
+// testRepository checks the repository of a migrated database, and is run against every backend
+// by the integration tests
+func testRepository(t *testing.T, db *DB) {
+	t.Run("settings", func(t *testing.T) { testSettingsRepository(t, db) })
+	t.Run("template partials", func(t *testing.T) { testTemplatePartials(t, db) })
+	t.Run("template assets", func(t *testing.T) { testTemplateAssets(t, db) })
+	t.Run("queue", func(t *testing.T) { testMessageRepository(t, db) })
+	t.Run("cancel", func(t *testing.T) { testCancelQueuedEmail(t, db) })
+	t.Run("transaction", func(t *testing.T) { testRepositoryInTransaction(t, db) })
+}
+
+func testSettingsRepository(t *testing.T, db *DB) {
+	ctx := context.Background()
+	repository := db.Repository()
+
+	if err := repository.UpsertSettings(ctx, map[string]string{"TEST_SETTING_A": "a", "TEST_SETTING_B": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.UpsertSettings(ctx, map[string]string{"TEST_SETTING_A": "changed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := repository.GetSettings(ctx, []string{"TEST_SETTING_A", "TEST_SETTING_B", "TEST_SETTING_MISSING"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]sql.NullString{
+		"TEST_SETTING_A": {String: "changed", Valid: true},
+		"TEST_SETTING_B": {String: "b", Valid: true},
+	}
+	if !reflect.DeepEqual(settings, expected) {
+		t.Errorf("GetSettings() = %v, expected %v", settings, expected)
+	}
+
+	if settings, err := repository.GetSettings(ctx, nil); err != nil || len(settings) != 0 {
+		t.Errorf("GetSettings(nil) = %v, %v, expected no settings", settings, err)
+	}
+
+	version, err := repository.GetSettingsVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.IncrementSettingsVersion(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if incremented, err := repository.GetSettingsVersion(ctx); err != nil || incremented != version+1 {
+		t.Errorf("GetSettingsVersion() = %d, %v, expected %d", incremented, err, version+1)
+	}
+}
+
+func testTemplatePartials(t *testing.T, db *DB) {
+	ctx := context.Background()
+	repository := db.Repository()
+
+	for _, partial := range []TemplatePartial{
+		{Name: "test-layout", Kind: "layout", Body: `<html>{{template "content" .}}</html>`},
+		{Name: "test-button", Kind: "partial", Body: "<a>Continue</a>"},
+		{Name: "test-button", Kind: "partial", Body: "<a>Sign in</a>"},
+	} {
+		if err := repository.UpsertTemplatePartial(ctx, partial); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	partials, err := repository.GetTemplatePartials(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := map[string]TemplatePartial{}
+	names := []string{}
+	for _, partial := range partials {
+		stored[partial.Name] = partial
+		names = append(names, partial.Name)
+	}
+	if button := stored["test-button"]; button.Body != "<a>Sign in</a>" || button.UpdatedAt.IsZero() {
+		t.Errorf("the replaced partial is %+v, expected its last body and an update time", button)
+	}
+	if layout := stored["test-layout"]; layout.Kind != "layout" {
+		t.Errorf("the layout is %+v, expected the layout kind", layout)
+	}
+	for i := 1; i < len(names); i++ {
+		if names[i-1] > names[i] {
+			t.Errorf("GetTemplatePartials() returned %v, expected them ordered by name", names)
+		}
+	}
+
+	if deleted, err := repository.DeleteTemplatePartial(ctx, "test-button"); err != nil || !deleted {
+		t.Errorf("DeleteTemplatePartial() = %t, %v, expected the partial to be deleted", deleted, err)
+	}
+	if deleted, err := repository.DeleteTemplatePartial(ctx, "test-button"); err != nil || deleted {
+		t.Errorf("DeleteTemplatePartial() = %t, %v, expected the deleted partial not to exist", deleted, err)
+	}
+}
+
+func testTemplateAssets(t *testing.T, db *DB) {
+	ctx := context.Background()
+	repository := db.Repository()
+
+	assets := []Attachment{
+		{Filename: "logo.png", ContentType: "image/png", ContentID: "logo", Content: []byte("png")},
+		{Filename: "banner.png", ContentType: "image/png", ContentID: "banner", Content: []byte("banner")},
+	}
+	if err := repository.ReplaceTemplateAssets(ctx, "TEST", assets); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := repository.GetTemplateAssets(ctx, "TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the assets are ordered by content ID
+	expected := []Attachment{assets[1], assets[0]}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("GetTemplateAssets() = %+v, expected %+v", stored, expected)
+	}
+
+	if err := repository.ReplaceTemplateAssets(ctx, "TEST", assets[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := repository.GetTemplateAssets(ctx, "TEST"); err != nil || !reflect.DeepEqual(stored, assets[1:]) {
+		t.Errorf("GetTemplateAssets() = %+v, %v, expected only the assets of the last replacement %+v", stored, err, assets[1:])
+	}
+}
+
+// dueEmailID returns the ID of the due email with the given message ID, failing the test when it is not due
+func dueEmailID(t *testing.T, db *DB, now time.Time, messageID string) int64 {
+	t.Helper()
+
+	ctx := context.Background()
+	ids, err := db.Repository().GetDueEmailIDs(ctx, now, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var id int64
+	if err := db.QueryRowContext(ctx, "SELECT id FROM email_queue WHERE message_id = ?", messageID).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	for _, due := range ids {
+		if due == id {
+			return id
+		}
+	}
+
+	t.Fatalf("GetDueEmailIDs() = %v, expected it to contain the email %s", ids, messageID)
+	return 0
+}
+
+func testMessageRepository(t *testing.T, db *DB) {
+	ctx := context.Background()
+	repository := db.Repository()
+	// the times are whole seconds, which every backend stores exactly
+	now := time.Now().UTC().Truncate(time.Second)
+
+	email := QueuedEmail{
+		MessageID:     "test-queue-due",
+		EmailType:     "MFA",
+		Recipient:     "user@example.com",
+		RecipientName: "User",
+		Subject:       "Subject",
+		Body:          "<p>Body</p>",
+		TextBody:      "Body",
+		Encrypted:     true,
+		SendAt:        now.Add(-time.Minute),
+		Attachments: []Attachment{
+			{Filename: "invoice.pdf", ContentType: "application/pdf", Content: []byte("%PDF-1.7")},
+			{Filename: "logo.png", ContentType: "image/png", ContentID: "logo", Content: []byte("png")},
+		},
+	}
+	later := QueuedEmail{MessageID: "test-queue-later", EmailType: "MFA", Recipient: "user@example.com", Subject: "Subject", Body: "Body", SendAt: now.Add(time.Hour)}
+	if err := repository.EnqueueEmails(ctx, []QueuedEmail{email, later}); err != nil {
+		t.Fatal(err)
+	}
+
+	id := dueEmailID(t, db, now, email.MessageID)
+	ids, err := repository.GetDueEmailIDs(ctx, now, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, due := range ids {
+		var messageID string
+		if err := db.QueryRowContext(ctx, "SELECT message_id FROM email_queue WHERE id = ?", due).Scan(&messageID); err != nil {
+			t.Fatal(err)
+		}
+		if messageID == later.MessageID {
+			t.Errorf("GetDueEmailIDs() returned the email scheduled in an hour")
+		}
+	}
+
+	claimed, found, err := repository.ClaimQueuedEmail(ctx, id, now, now.Add(time.Minute))
+	if err != nil || !found {
+		t.Fatalf("ClaimQueuedEmail() = %t, %v, expected the due email to be claimed", found, err)
+	}
+	expected := email
+	expected.ID = id
+	if !claimed.SendAt.Equal(expected.SendAt) {
+		t.Errorf("the claimed email is sent at %s, expected %s", claimed.SendAt, expected.SendAt)
+	}
+	claimed.SendAt = expected.SendAt
+	if !reflect.DeepEqual(claimed, expected) {
+		t.Errorf("ClaimQueuedEmail() = %+v, expected %+v", claimed, expected)
+	}
+
+	// the claimed email is locked until its lock expires
+	if _, found, err := repository.ClaimQueuedEmail(ctx, id, now, now.Add(time.Minute)); err != nil || found {
+		t.Errorf("ClaimQueuedEmail() = %t, %v, expected the locked email not to be claimed again", found, err)
+	}
+	if _, found, err := repository.ClaimQueuedEmail(ctx, id, now.Add(2*time.Minute), now.Add(3*time.Minute)); err != nil || !found {
+		t.Errorf("ClaimQueuedEmail() = %t, %v, expected the email whose lock expired to be claimed", found, err)
+	}
+
+	if err := repository.RetryQueuedEmail(ctx, id, 1, "connection refused", now.Add(5*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := repository.ClaimQueuedEmail(ctx, id, now.Add(4*time.Minute), now.Add(5*time.Minute)); err != nil || found {
+		t.Errorf("ClaimQueuedEmail() = %t, %v, expected the email not to be claimed before its retry", found, err)
+	}
+	retried, found, err := repository.ClaimQueuedEmail(ctx, id, now.Add(5*time.Minute), now.Add(6*time.Minute))
+	if err != nil || !found {
+		t.Fatalf("ClaimQueuedEmail() = %t, %v, expected the email to be claimed at its retry", found, err)
+	}
+	if retried.Attempts != 1 {
+		t.Errorf("the retried email has %d attempts, expected 1", retried.Attempts)
+	}
+
+	if err := repository.MarkQueuedEmailSent(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	var attempts int
+	if err := db.QueryRowContext(ctx, "SELECT status, attempts FROM email_queue WHERE id = ?", id).Scan(&status, &attempts); err != nil {
+		t.Fatal(err)
+	}
+	if status != "sent" || attempts != 2 {
+		t.Errorf("the sent email has the status %q and %d attempts, expected sent and 2", status, attempts)
+	}
+	if _, found, err := repository.ClaimQueuedEmail(ctx, id, now.Add(time.Hour), now.Add(2*time.Hour)); err != nil || found {
+		t.Errorf("ClaimQueuedEmail() = %t, %v, expected the sent email not to be claimed", found, err)
+	}
+
+	laterID := dueEmailID(t, db, now.Add(time.Hour), later.MessageID)
+	if _, found, err := repository.ClaimQueuedEmail(ctx, laterID, now.Add(time.Hour), now.Add(2*time.Hour)); err != nil || !found {
+		t.Fatalf("ClaimQueuedEmail() = %t, %v, expected the later email to be claimed", found, err)
+	}
+	if err := repository.FailQueuedEmail(ctx, laterID, 5, "mailbox unavailable"); err != nil {
+		t.Fatal(err)
+	}
+	var lastError string
+	if err := db.QueryRowContext(ctx, "SELECT status, attempts, last_error FROM email_queue WHERE id = ?", laterID).Scan(&status, &attempts, &lastError); err != nil {
+		t.Fatal(err)
+	}
+	if status != "failed" || attempts != 5 || lastError != "mailbox unavailable" {
+		t.Errorf("the failed email has the status %q, %d attempts and the error %q, expected failed, 5 and its error", status, attempts, lastError)
+	}
+}
+
+func testCancelQueuedEmail(t *testing.T, db *DB) {
+	ctx := context.Background()
+	repository := db.Repository()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	emails := []QueuedEmail{
+		{MessageID: "test-cancel-pending", EmailType: "MFA", Recipient: "user@example.com", Subject: "Subject", Body: "Body", SendAt: now.Add(time.Hour)},
+		{MessageID: "test-cancel-claimed", EmailType: "MFA", Recipient: "user@example.com", Subject: "Subject", Body: "Body", SendAt: now.Add(-time.Minute)},
+	}
+	if err := repository.EnqueueEmails(ctx, emails); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := repository.ClaimQueuedEmail(ctx, dueEmailID(t, db, now, "test-cancel-claimed"), now, now.Add(time.Minute)); err != nil || !found {
+		t.Fatalf("ClaimQueuedEmail() = %t, %v, expected the due email to be claimed", found, err)
+	}
+
+	tests := []struct {
+		messageID string
+		exists    bool
+		cancelled bool
+	}{
+		{"test-cancel-pending", true, true},
+		{"test-cancel-pending", true, false},
+		{"test-cancel-claimed", true, false},
+		{"test-cancel-unknown", false, false},
+	}
+
+	for _, test := range tests {
+		exists, cancelled, err := repository.CancelQueuedEmail(ctx, test.messageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != test.exists || cancelled != test.cancelled {
+			t.Errorf("CancelQueuedEmail(%q) = %t, %t, expected %t, %t", test.messageID, exists, cancelled, test.exists, test.cancelled)
+		}
+	}
+}
+
+func testRepositoryInTransaction(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Repository().UpsertSettings(ctx, map[string]string{"TEST_SETTING_ROLLED_BACK": "value"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if settings, err := db.Repository().GetSettings(ctx, []string{"TEST_SETTING_ROLLED_BACK"}); err != nil || len(settings) != 0 {
+		t.Errorf("GetSettings() = %v, %v, expected the rolled back setting not to be stored", settings, err)
+	}
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+
+	_ "modernc.org/sqlite"
+)
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+// Open opens the database file in Path unless DSN is set. The times are stored as text that sorts
+// in time order, the writes wait for each other instead of failing and the foreign keys are enforced.
+func (sqliteDialect) Open(config Config) (*sql.DB, error) {
+	if config.DSN != "" {
+		return sql.Open("sqlite", config.DSN)
+	}
+
+	query := url.Values{
+		"_time_format": {"sqlite"},
+		"_txlock":      {"immediate"},
+		"_pragma":      {"foreign_keys(1)", "busy_timeout(10000)", "journal_mode(WAL)"},
+	}
+
+	return sql.Open("sqlite", "file:"+config.Path+"?"+query.Encode())
+}
+
+func (sqliteDialect) Rebind(query string) string {
+	return query
+}
+
+func (sqliteDialect) Upsert(table string, columns []string, keys []string, update []string) string {
+	return upsertOnConflict(table, columns, keys, update)
+}
+
+func (sqliteDialect) InsertIgnore(table string, columns []string) string {
+	return insertValues(table, columns) + " ON CONFLICT DO NOTHING"
+}
+
+func (sqliteDialect) Returning() bool {
+	return true
+}
+
+// Repository returns the shared implementation, since the database supports RETURNING
+func (d sqliteDialect) Repository(q queryer) Repository {
+	return sqlRepository{q: q, dialect: d}
+}
+
+// LockMigrations does nothing since a SQLite database belongs to a single process
+func (sqliteDialect) LockMigrations(ctx context.Context, conn *sql.Conn) error {
+	return nil
+}
+
+func (sqliteDialect) UnlockMigrations(ctx context.Context, conn *sql.Conn) error {
+	return nil
+}
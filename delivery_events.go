@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+const (
+	// deliveryEventsBatchSize is the number of events read from the log per query
+	deliveryEventsBatchSize = 100
+	// deliveryEventsPollInterval bounds how long a stream waits before checking the log again,
+	// which picks up the events recorded by other replicas
+	deliveryEventsPollInterval = 2 * time.Second
+	// deliveryEventsRescanWindow and deliveryEventsRescanPeriod bound the events below the cursor that are read again,
+	// as an event can commit after events with a higher ID recorded by other replicas or goroutines. The period is
+	// counted back from the creation time of the newest event sent, so both times come from the database clock.
+	deliveryEventsRescanWindow = 1000
+	deliveryEventsRescanPeriod = time.Minute
+)
+
+// deliveryEventTypes are the event types the service records
+var deliveryEventTypes = map[pb.DeliveryEventType]string{
+	pb.DeliveryEventType_QUEUED:     utils.DeliveryEventQueued,
+	pb.DeliveryEventType_SENT:       utils.DeliveryEventSent,
+	pb.DeliveryEventType_DEFERRED:   utils.DeliveryEventDeferred,
+	pb.DeliveryEventType_BOUNCED:    utils.DeliveryEventBounced,
+	pb.DeliveryEventType_COMPLAINED: utils.DeliveryEventComplained,
+	pb.DeliveryEventType_FAILED:     utils.DeliveryEventFailed,
+}
+
+// StreamDeliveryEvents streams the delivery events matching the request filters, starting after the given cursor.
+// The ID of every event is the cursor a reconnecting consumer should resume from.
+//
+// An event can commit after events with a higher ID, so the events among the 1000 IDs below the cursor and created
+// at most a minute before the cursor event are read again, after a reconnect as well as while streaming. Consumers
+// deduplicate the events by ID, as these events can be sent again after a reconnect. An event committing more than
+// a minute after it was recorded, or after 1000 events with a higher ID, can be missed.
+func (s *EmailManagerService) StreamDeliveryEvents(in *pb.StreamDeliveryEventsRequest, stream pb.EmailManager_StreamDeliveryEventsServer) error {
+	filter := utils.DeliveryEventFilter{
+		Recipient: in.Recipient,
+		MessageID: in.MessageId,
+	}
+
+	for _, eventType := range in.EventTypes {
+		name, found := deliveryEventTypes[eventType]
+		if !found {
+			return status.Errorf(codes.InvalidArgument, "invalid delivery event type %d", eventType)
+		}
+		filter.EventTypes = append(filter.EventTypes, name)
+	}
+
+	for _, emailType := range in.EmailTypes {
+		if _, found := pb.EmailType_name[int32(emailType)]; !found {
+			return status.Errorf(codes.InvalidArgument, "invalid email type %d", emailType)
+		}
+		filter.EmailTypes = append(filter.EmailTypes, emailType.String())
+	}
+
+	cursor := in.Cursor
+	// newest is the creation time of the cursor event the rescan period is counted back from,
+	// the whole rescan window being read again when the cursor event is not in the log
+	var newest time.Time
+	if cursor > 0 {
+		cursorEvent, _, err := utils.GetDeliveryEvent(s.emailServiceDB.Db, cursor)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		newest = cursorEvent.CreatedAt
+	}
+
+	// sent holds the IDs sent within the rescan window below the cursor
+	sent := map[int64]bool{}
+	for {
+		// wait on the notifier before reading the log so events recorded in between are not missed
+		notified := s.deliveryEvents.Wait()
+
+		since := time.Time{}
+		if !newest.IsZero() {
+			since = newest.Add(-deliveryEventsRescanPeriod)
+		}
+		late, err := utils.GetRecentDeliveryEventsBefore(s.emailServiceDB.Db, cursor-deliveryEventsRescanWindow, cursor, since, filter)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		events, err := utils.GetDeliveryEventsAfter(s.emailServiceDB.Db, cursor, filter, deliveryEventsBatchSize)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		for _, event := range append(late, events...) {
+			if sent[event.ID] {
+				continue
+			}
+
+			if err := stream.Send(toPBDeliveryEvent(event)); err != nil {
+				return err
+			}
+			sent[event.ID] = true
+			if event.ID > cursor {
+				cursor = event.ID
+				newest = event.CreatedAt
+			}
+		}
+
+		for id := range sent {
+			if id <= cursor-deliveryEventsRescanWindow {
+				delete(sent, id)
+			}
+		}
+
+		// keep reading while the log has a backlog
+		if len(events) == deliveryEventsBatchSize {
+			continue
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-notified:
+		case <-time.After(deliveryEventsPollInterval):
+		}
+	}
+}
+
+// ReportDeliveryFeedback records a bounce or a complaint about an email sent by the service in the delivery event log.
+// The bounces and complaints are not read from the mail server, so the systems receiving them report them this way.
+func (s *EmailManagerService) ReportDeliveryFeedback(ctx context.Context, in *pb.ReportDeliveryFeedbackRequest) (*pb.ReportDeliveryFeedbackResponse, error) {
+	if in.EventType != pb.DeliveryEventType_BOUNCED && in.EventType != pb.DeliveryEventType_COMPLAINED {
+		return nil, status.Error(codes.InvalidArgument, "only bounces and complaints can be reported")
+	}
+
+	// the bounce or complaint is about the email type and recipient of the original message
+	event, found, err := utils.GetFirstDeliveryEvent(s.emailServiceDB.Db, in.MessageId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "message %s not found", in.MessageId)
+	}
+
+	if err := s.appendDeliveryEvent(event, deliveryEventTypes[in.EventType], in.Detail); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.ReportDeliveryFeedbackResponse{Message: "Delivery feedback recorded successfully!"}, nil
+}
+
+func toPBDeliveryEvent(event utils.DeliveryEvent) *pb.DeliveryEvent {
+	pbEvent := &pb.DeliveryEvent{
+		Id:        event.ID,
+		MessageId: event.MessageID,
+		EmailType: pb.EmailType(pb.EmailType_value[event.EmailType]),
+		Recipient: event.Recipient,
+		Detail:    event.Detail,
+		CreatedAt: timestamppb.New(event.CreatedAt),
+	}
+
+	pbEvent.EventType, _ = deliveryEventTypeFromName(event.EventType)
+
+	return pbEvent
+}
+
+// deliveryEventTypeFromName maps an event type stored in the delivery log back to its protobuf value
+func deliveryEventTypeFromName(name string) (pb.DeliveryEventType, bool) {
+	for eventType, eventName := range deliveryEventTypes {
+		if eventName == name {
+			return eventType, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// fakeDeliveryEventStream collects the streamed events and ends the stream once it got the expected number of them
+type fakeDeliveryEventStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	cancel   context.CancelFunc
+	expected int
+	events   []*pb.DeliveryEvent
+}
+
+func newFakeDeliveryEventStream(expected int) *fakeDeliveryEventStream {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	return &fakeDeliveryEventStream{ctx: ctx, cancel: cancel, expected: expected}
+}
+
+func (f *fakeDeliveryEventStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeDeliveryEventStream) Send(event *pb.DeliveryEvent) error {
+	f.events = append(f.events, event)
+	if len(f.events) >= f.expected {
+		f.cancel()
+	}
+	return nil
+}
+
+func (f *fakeDeliveryEventStream) ids() []int64 {
+	ids := []int64{}
+	for _, event := range f.events {
+		ids = append(ids, event.Id)
+	}
+	return ids
+}
+
+// insertDeliveryEvent stores an event with the given ID and creation time, as if it committed at that moment
+func insertDeliveryEvent(t *testing.T, s *EmailManagerService, id int64, eventType string, createdAt time.Time) {
+	t.Helper()
+
+	_, err := s.emailServiceDB.Db.Exec(
+		"INSERT INTO delivery_events (id, message_id, event_type, email_type, recipient, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id,
+		"message",
+		eventType,
+		pb.EmailType_EMAIL_VERIFICATION.String(),
+		"user@example.com",
+		createdAt.UTC(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamDeliveryEventsResumesWithLateEvents(t *testing.T) {
+	// the consumer got the events 1 and 3 and disconnected an hour ago, the event 2 committing after that
+	recordedAt := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name     string
+		cursor   int64
+		expected []int64
+	}{
+		{"known cursor", 3, []int64{2}},
+		{"cursor missing from the log", 10, []int64{1, 2, 3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestService(t)
+			insertDeliveryEvent(t, s, 1, utils.DeliveryEventQueued, recordedAt.Add(-10*time.Minute))
+			insertDeliveryEvent(t, s, 2, utils.DeliveryEventQueued, recordedAt)
+			insertDeliveryEvent(t, s, 3, utils.DeliveryEventSent, recordedAt)
+
+			stream := newFakeDeliveryEventStream(len(test.expected))
+			if err := s.StreamDeliveryEvents(&pb.StreamDeliveryEventsRequest{Cursor: test.cursor}, stream); err != nil {
+				t.Fatal(err)
+			}
+
+			if ids := stream.ids(); !reflect.DeepEqual(ids, test.expected) {
+				t.Errorf("streamed the events %v, expected %v", ids, test.expected)
+			}
+		})
+	}
+}
+
+func TestStreamDeliveryEventsSendsLateEventsOnce(t *testing.T) {
+	s := newTestService(t)
+	insertDeliveryEvent(t, s, 1, utils.DeliveryEventQueued, time.Now())
+	insertDeliveryEvent(t, s, 3, utils.DeliveryEventQueued, time.Now())
+
+	stream := newFakeDeliveryEventStream(4)
+	done := make(chan error)
+	go func() {
+		done <- s.StreamDeliveryEvents(&pb.StreamDeliveryEventsRequest{}, stream)
+	}()
+
+	// the event 2 commits once the stream moved past it, then a new event wakes up the stream
+	time.Sleep(100 * time.Millisecond)
+	insertDeliveryEvent(t, s, 2, utils.DeliveryEventQueued, time.Now())
+	s.recordDeliveryEvent(utils.DeliveryEvent{MessageID: "message", EmailType: pb.EmailType_EMAIL_VERIFICATION.String(), Recipient: "user@example.com"}, utils.DeliveryEventSent, "")
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if ids := stream.ids(); !reflect.DeepEqual(ids, []int64{1, 3, 2, 4}) {
+		t.Errorf("streamed the events %v, expected [1 3 2 4]", ids)
+	}
+}
+
+func TestStreamDeliveryEventsFilters(t *testing.T) {
+	s := newTestService(t)
+	insertDeliveryEvent(t, s, 1, utils.DeliveryEventQueued, time.Now())
+	insertDeliveryEvent(t, s, 2, utils.DeliveryEventBounced, time.Now())
+	insertDeliveryEvent(t, s, 3, utils.DeliveryEventComplained, time.Now())
+
+	stream := newFakeDeliveryEventStream(2)
+	request := &pb.StreamDeliveryEventsRequest{EventTypes: []pb.DeliveryEventType{pb.DeliveryEventType_BOUNCED, pb.DeliveryEventType_COMPLAINED}}
+	if err := s.StreamDeliveryEvents(request, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stream.events) != 2 || stream.events[0].EventType != pb.DeliveryEventType_BOUNCED || stream.events[1].EventType != pb.DeliveryEventType_COMPLAINED {
+		t.Errorf("streamed %v, expected the bounce and the complaint", stream.events)
+	}
+
+	err := s.StreamDeliveryEvents(&pb.StreamDeliveryEventsRequest{EventTypes: []pb.DeliveryEventType{42}}, newFakeDeliveryEventStream(1))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("StreamDeliveryEvents() with an unknown event type = %v, expected InvalidArgument", err)
+	}
+}
+
+func TestReportDeliveryFeedback(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t)
+	s.recordDeliveryEvent(utils.DeliveryEvent{MessageID: "message", EmailType: pb.EmailType_PASSWORD_RESET.String(), Recipient: "user@example.com"}, utils.DeliveryEventSent, "")
+
+	tests := []struct {
+		name     string
+		request  *pb.ReportDeliveryFeedbackRequest
+		expected codes.Code
+	}{
+		{"bounce", &pb.ReportDeliveryFeedbackRequest{MessageId: "message", EventType: pb.DeliveryEventType_BOUNCED, Detail: "550 mailbox unavailable"}, codes.OK},
+		{"complaint", &pb.ReportDeliveryFeedbackRequest{MessageId: "message", EventType: pb.DeliveryEventType_COMPLAINED}, codes.OK},
+		{"other event type", &pb.ReportDeliveryFeedbackRequest{MessageId: "message", EventType: pb.DeliveryEventType_SENT}, codes.InvalidArgument},
+		{"unknown message", &pb.ReportDeliveryFeedbackRequest{MessageId: "unknown", EventType: pb.DeliveryEventType_BOUNCED}, codes.NotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := s.ReportDeliveryFeedback(ctx, test.request); status.Code(err) != test.expected {
+				t.Errorf("ReportDeliveryFeedback() = %v, expected %s", err, test.expected)
+			}
+		})
+	}
+
+	// the feedback is recorded for the email type and recipient of the message
+	events, err := utils.GetDeliveryEventsAfter(s.emailServiceDB.Db, 1, utils.DeliveryEventFilter{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("recorded %d events, expected the bounce and the complaint", len(events))
+	}
+	bounce := events[0]
+	if bounce.EventType != utils.DeliveryEventBounced || bounce.EmailType != pb.EmailType_PASSWORD_RESET.String() || bounce.Recipient != "user@example.com" || bounce.Detail != "550 mailbox unavailable" {
+		t.Errorf("recorded the bounce %+v, expected it to be about the password reset email of user@example.com", bounce)
+	}
+	if events[1].EventType != utils.DeliveryEventComplained {
+		t.Errorf("recorded the event %s, expected a complaint", events[1].EventType)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// ConsumeMagicLink burns the token of a magic link and returns the address it was sent to.
+// A token can only be consumed once and before it expires.
+func (s *EmailManagerService) ConsumeMagicLink(ctx context.Context, in *pb.ConsumeMagicLinkRequest) (*pb.ConsumeMagicLinkResponse, error) {
+	if in.Token == "" {
+		return nil, status.Error(codes.InvalidArgument, "token is required")
+	}
+
+	recipient, messageID, err := utils.ConsumeMagicLink(s.emailServiceDB.Db, in.Token)
+	if errors.Is(err, utils.ErrMagicLinkNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if errors.Is(err, utils.ErrMagicLinkUnavailable) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.ConsumeMagicLinkResponse{Email: recipient, MessageId: messageID}, nil
+}
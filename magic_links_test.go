@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// insertMagicLink stores a magic link sent to user@example.com in the given message, valid for ttl
+func insertMagicLink(t *testing.T, s *EmailManagerService, messageID string, ttl time.Duration) string {
+	t.Helper()
+
+	token, err := utils.NewMagicLinkToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.InsertMagicLink(s.emailServiceDB.Db, messageID, "user@example.com", token, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestConsumeMagicLink(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	token := insertMagicLink(t, s, "magic-link", time.Minute)
+
+	response, err := s.ConsumeMagicLink(ctx, &pb.ConsumeMagicLinkRequest{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Email != "user@example.com" || response.MessageId != "magic-link" {
+		t.Errorf("ConsumeMagicLink() = %+v, expected the recipient and message of the link", response)
+	}
+
+	// the token is burned by the first consumption
+	if _, err := s.ConsumeMagicLink(ctx, &pb.ConsumeMagicLinkRequest{Token: token}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("consuming the token again returned %v, expected FailedPrecondition", err)
+	}
+}
+
+func TestConsumeMagicLinkBurnsOnce(t *testing.T) {
+	s := newTestService(t)
+	token := insertMagicLink(t, s, "magic-link", time.Minute)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	results := map[codes.Code]int{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.ConsumeMagicLink(context.Background(), &pb.ConsumeMagicLinkRequest{Token: token})
+
+			mu.Lock()
+			results[status.Code(err)]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if results[codes.OK] != 1 || results[codes.FailedPrecondition] != 9 {
+		t.Errorf("the concurrent consumptions returned %v, expected a single one to succeed", results)
+	}
+}
+
+func TestConsumeMagicLinkErrors(t *testing.T) {
+	s := newTestService(t)
+	expired := insertMagicLink(t, s, "expired", -time.Second)
+	unknown, err := utils.NewMagicLinkToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		expected codes.Code
+	}{
+		{"missing token", "", codes.InvalidArgument},
+		{"unknown token", unknown, codes.NotFound},
+		{"expired token", expired, codes.FailedPrecondition},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := s.ConsumeMagicLink(context.Background(), &pb.ConsumeMagicLinkRequest{Token: test.token})
+			if status.Code(err) != test.expected {
+				t.Errorf("ConsumeMagicLink() = %v, expected %s", err, test.expected)
+			}
+		})
+	}
+
+	// the expired link was not burned by the attempt
+	var consumed bool
+	if err := s.emailServiceDB.Db.QueryRow("SELECT consumed_at IS NOT NULL FROM magic_links WHERE message_id = ?", "expired").Scan(&consumed); err != nil {
+		t.Fatal(err)
+	}
+	if consumed {
+		t.Error("the expired magic link was marked as consumed")
+	}
+}
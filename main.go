@@ -3,16 +3,20 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/mail"
+	"os"
+	"strconv"
 
-	"github.com/joho/godotenv"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
-	"gopkg.in/gomail.v2"
 
 	"github.com/isaacwassou/email-service/database"
 	pbCrypto "github.com/isaacwassou/email-service/protobufs/cryptography_service"
@@ -24,200 +28,45 @@ type EmailManagerService struct {
 	pb.UnimplementedEmailManagerServer
 	cryptoServiceClient pbCrypto.CryptographyManagerClient
 	emailServiceDB      *database.EmailServiceDB
+	deliveryEvents      *utils.DeliveryEventNotifier
+	mxResolver          utils.MXResolver
+	settingsCache       *utils.SettingsCache
+	config              utils.Config
 }
 
 func (s *EmailManagerService) SendVerifyEmailEmail(ctx context.Context, in *pb.SendEmailRequest) (*pb.SendEmailResponse, error) {
-	// get the SMTP configuration from the database
-	smtpConfig, err := utils.GetSMTPConfig(s.emailServiceDB.Db)
+	response, err := s.sendTemplatedEmail(ctx, in, pb.EmailType_EMAIL_VERIFICATION)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// check if the SMTP configuration is valid
-	if !utils.CheckSMTPConfig(smtpConfig) {
-		return nil, status.Error(codes.FailedPrecondition, "SMTP configuration is not set!")
-	}
-
-	// decrypt the SMTP Password
-	decryptedPassword, err := s.cryptoServiceClient.Decrypt(ctx, &pbCrypto.DecryptRequest{Ciphertext: smtpConfig.Password})
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// get the email template details from the database
-	emailTemplate, err := utils.GetVerifyEmailDetails(s.emailServiceDB.Db)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// add the verification token to the redirect URL
-	emailTemplate.RedirectURL = fmt.Sprintf("%s?code=%s", emailTemplate.RedirectURL, in.Token)
-
-	// parse the email template body
-	emailBody, err := utils.ParseBodyTemplate(emailTemplate, "verify-email")
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// create new message
-	m := gomail.NewMessage()
-	// set the email message headers
-	m.SetHeader("From", smtpConfig.Sender)
-	m.SetHeader("To", in.To)
-	m.SetHeader("Subject", emailTemplate.Subject)
-	m.SetBody("text/html", emailBody)
-
-	// create a new dialer
-	dialer := gomail.NewDialer(
-		smtpConfig.Host,
-		smtpConfig.Port,
-		smtpConfig.User,
-		decryptedPassword.Plaintext,
-	)
-
-	// open a connection to the SMTP server and send the email
-	if err := dialer.DialAndSend(m); err != nil {
-		log.Printf("Failed to send an email to %s with error %s", in.To, err)
-		return &pb.SendEmailResponse{Message: "Failed to send email!"}, nil
+		var deliveryErr *deliveryError
+		if errors.As(err, &deliveryErr) {
+			log.Printf("Failed to send an email to %s with error %s", in.To, deliveryErr)
+			return &pb.SendEmailResponse{Message: "Failed to send email!", MessageId: deliveryErr.messageID}, nil
+		}
+		return nil, err
 	}
 
-	return &pb.SendEmailResponse{Message: "Sent an email successfully!"}, nil
+	return response, nil
 }
 
 func (s *EmailManagerService) SendPasswordResetEmail(ctx context.Context, in *pb.SendEmailRequest) (*pb.SendEmailResponse, error) {
-	// get the SMTP configuration from the database
-	smtpConfig, err := utils.GetSMTPConfig(s.emailServiceDB.Db)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// check if the SMTP configuration is valid
-	if !utils.CheckSMTPConfig(smtpConfig) {
-		return nil, status.Error(codes.FailedPrecondition, "SMTP configuration is not set!")
-	}
-
-	// decrypt the SMTP Password
-	decryptedPassword, err := s.cryptoServiceClient.Decrypt(ctx, &pbCrypto.DecryptRequest{Ciphertext: smtpConfig.Password})
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// get the email template details from the database
-	emailTemplate, err := utils.GetPasswordResetEmailDetails(s.emailServiceDB.Db)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// add the password reset token to the redirect URL
-	emailTemplate.RedirectURL = fmt.Sprintf("%s?code=%s", emailTemplate.RedirectURL, in.Token)
-
-	// parse the email template body
-	emailBody, err := utils.ParseBodyTemplate(emailTemplate, "password-reset")
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// create new message
-	m := gomail.NewMessage()
-	// set the email message headers
-	m.SetHeader("From", smtpConfig.Sender)
-	m.SetHeader("To", in.To)
-	m.SetHeader("Subject", emailTemplate.Subject)
-	m.SetBody("text/html", emailBody)
-
-	// create a new dialer
-	dialer := gomail.NewDialer(
-		smtpConfig.Host,
-		smtpConfig.Port,
-		smtpConfig.User,
-		decryptedPassword.Plaintext,
-	)
-
-	// open a connection to the SMTP server and send the email
-	if err := dialer.DialAndSend(m); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	return &pb.SendEmailResponse{Message: "Sent an email successfully!"}, nil
+	return s.sendTemplatedEmail(ctx, in, pb.EmailType_PASSWORD_RESET)
 }
 
 func (s *EmailManagerService) SendMFAEmail(ctx context.Context, in *pb.SendEmailRequest) (*pb.SendEmailResponse, error) {
-	// get the SMTP configuration from the database
-	smtpConfig, err := utils.GetSMTPConfig(s.emailServiceDB.Db)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// check if the SMTP configuration is valid
-	if !utils.CheckSMTPConfig(smtpConfig) {
-		return nil, status.Error(codes.FailedPrecondition, "SMTP configuration is not set!")
-	}
-
-	// decrypt the SMTP Password
-	decryptedPassword, err := s.cryptoServiceClient.Decrypt(ctx, &pbCrypto.DecryptRequest{Ciphertext: smtpConfig.Password})
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// get the email template details from the database
-	emailTemplate, err := utils.GetMFAEmailDetails(s.emailServiceDB.Db)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// add the password reset token to the redirect URL
-	emailTemplate.RedirectURL = fmt.Sprintf("%s?code=%s", emailTemplate.RedirectURL, in.Token)
-
-	// parse the email template body
-	emailBody, err := utils.ParseBodyTemplate(emailTemplate, "password-reset")
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// create new message
-	m := gomail.NewMessage()
-	// set the email message headers
-	m.SetHeader("From", smtpConfig.Sender)
-	m.SetHeader("To", in.To)
-	m.SetHeader("Subject", emailTemplate.Subject)
-	m.SetBody("text/html", emailBody)
-
-	// create a new dialer
-	dialer := gomail.NewDialer(
-		smtpConfig.Host,
-		smtpConfig.Port,
-		smtpConfig.User,
-		decryptedPassword.Plaintext,
-	)
-
-	// open a connection to the SMTP server and send the email
-	if err := dialer.DialAndSend(m); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
+	return s.sendTemplatedEmail(ctx, in, pb.EmailType_MFA)
+}
 
-	return &pb.SendEmailResponse{Message: "Sent an email successfully!"}, nil
+// SendMagicLinkEmail sends a sign-in link carrying a single-use token generated by the service,
+// the token given in the request being ignored
+func (s *EmailManagerService) SendMagicLinkEmail(ctx context.Context, in *pb.SendEmailRequest) (*pb.SendEmailResponse, error) {
+	return s.sendTemplatedEmail(ctx, in, pb.EmailType_MAGIC_LINK)
 }
 
 // SetSMTPCredentials sets the SMTP credentials in the database
 func (s *EmailManagerService) SetSMTPCredentials(ctx context.Context, in *pb.SetSMTPCredentialsRequest) (*pb.SetSMTPCredentialsResponse, error) {
-	tx, err := s.emailServiceDB.Db.Begin()
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	_, err = tx.Exec("UPDATE settings SET value = ? WHERE name = 'SMTP_HOST'", in.Host)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	_, err = tx.Exec("UPDATE settings SET value = ? WHERE name = 'SMTP_PORT'", in.Port)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	_, err = tx.Exec("UPDATE settings SET value = ? WHERE name = 'SMTP_USER'", in.Username)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	// the sender is used as the From header, optionally with a display name
+	if _, err := mail.ParseAddress(in.Sender); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid sender %q: %s", in.Sender, err)
 	}
 
 	// Encrypt the password before storing it in the database
@@ -225,17 +74,16 @@ func (s *EmailManagerService) SetSMTPCredentials(ctx context.Context, in *pb.Set
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	_, err = tx.Exec("UPDATE settings SET value = ? WHERE name = 'SMTP_PASSWORD'", encryptedPassword.Ciphertext)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
 
-	_, err = tx.Exec("UPDATE settings SET value = ? WHERE name = 'SMTP_SENDER'", in.Sender)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	settings := map[string]string{
+		"SMTP_HOST":     in.Host,
+		"SMTP_PORT":     strconv.Itoa(int(in.Port)),
+		"SMTP_USER":     in.Username,
+		"SMTP_PASSWORD": encryptedPassword.Ciphertext,
+		"SMTP_SENDER":   in.Sender,
 	}
 
-	err = tx.Commit()
+	err = s.saveSettings(ctx, "SetSMTPCredentials", "SMTP", settings, nil)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -244,27 +92,44 @@ func (s *EmailManagerService) SetSMTPCredentials(ctx context.Context, in *pb.Set
 }
 
 func (s *EmailManagerService) SetEmailVerificationTemplate(ctx context.Context, in *pb.SetEmailTemplateRequest) (*pb.SetEmailTemplateResponse, error) {
-	tx, err := s.emailServiceDB.Db.Begin()
+	inlineAssets, err := inlineAssetsFromPB(in.InlineAssets)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
+	}
+
+	format, found := templateFormats[in.Format]
+	if !found {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid template format %d", in.Format)
 	}
 
-	_, err = tx.Exec("UPDATE settings SET value = ? WHERE name = 'EMAIL_VERIFICATION_SUBJECT'", in.Subject)
+	// check the redirect URL can carry the token
+	err = s.validateTemplateLink(in)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
 
-	_, err = tx.Exec("UPDATE settings SET value = ? WHERE name = 'EMAIL_VERIFICATION_BODY'", in.Body)
+	// check the redirect URL points to an allowed origin
+	err = s.checkRedirectOrigin(in.RedirectUrl)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
 
-	_, err = tx.Exec("UPDATE settings SET value = ? WHERE name = 'EMAIL_VERIFICATION_REDIRECT_URL'", in.RedirectUrl)
+	// check the body renders with its layout and the shared partials
+	err = s.validateTemplateBody(ctx, pb.EmailType_EMAIL_VERIFICATION, in.Body, in.Layout, format)
+	if err != nil {
+		return nil, err
+	}
+
+	emailTemplateFields, err := utils.GetEmailTemplateDBFields(pb.EmailType_EMAIL_VERIFICATION)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	settings := templateSettings(emailTemplateFields, in, format)
 
-	err = tx.Commit()
+	// store the template with its inline assets
+	err = s.saveSettings(ctx, "SetEmailVerificationTemplate", pb.EmailType_EMAIL_VERIFICATION.String(), settings, func(tx *database.Tx) error {
+		return tx.Repository().ReplaceTemplateAssets(ctx, pb.EmailType_EMAIL_VERIFICATION.String(), inlineAssets)
+	})
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -310,30 +175,46 @@ func (s *EmailManagerService) SetEmailTemplate(ctx context.Context, in *pb.SetEm
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	tx, err := s.emailServiceDB.Db.Begin()
+	inlineAssets, err := inlineAssetsFromPB(in.InlineAssets)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
 
-	updateSubjectQuery := fmt.Sprintf("UPDATE settings SET value = ? WHERE name = '%s'", emailTemplateFields.Subject)
-	_, err = tx.Exec(updateSubjectQuery, in.Subject)
+	format, found := templateFormats[in.Format]
+	if !found {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid template format %d", in.Format)
+	}
+
+	// check the redirect URL can carry the token
+	err = s.validateTemplateLink(in)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
 
-	updateBodyQuery := fmt.Sprintf("UPDATE settings SET value = ? WHERE name = '%s'", emailTemplateFields.Body)
-	_, err = tx.Exec(updateBodyQuery, in.Body)
+	// check the redirect URL points to an allowed origin
+	err = s.checkRedirectOrigin(in.RedirectUrl)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
 
-	updateRedirectURLQuery := fmt.Sprintf("UPDATE settings SET value = ? WHERE name = '%s'", emailTemplateFields.RedirectURL)
-	_, err = tx.Exec(updateRedirectURLQuery, in.RedirectUrl)
+	// check the generated secret settings, which only the MFA and magic link templates have
+	err = validateTemplateCode(in, emailTemplateFields)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
 
-	err = tx.Commit()
+	// check the body renders with its layout and the shared partials
+	err = s.validateTemplateBody(ctx, in.EmailType, in.Body, in.Layout, format)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := templateSettings(emailTemplateFields, in, format)
+
+	// store the template with its inline assets
+	err = s.saveSettings(ctx, "SetEmailTemplate", in.EmailType.String(), settings, func(tx *database.Tx) error {
+		return tx.Repository().ReplaceTemplateAssets(ctx, in.EmailType.String(), inlineAssets)
+	})
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -347,7 +228,7 @@ func (s *EmailManagerService) GetEmailTemplate(ctx context.Context, in *pb.GetEm
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	var subject, body, redirectURL sql.NullString
+	var subject, body, redirectURL, layout, inlineCSS, format, tokenParam, linkTTL, codeLength, codeTTL sql.NullString
 
 	err = s.emailServiceDB.Db.QueryRow("SELECT value FROM settings WHERE name = ?", emailTemplateFields.Subject).Scan(&subject)
 	if err != nil {
@@ -364,33 +245,101 @@ func (s *EmailManagerService) GetEmailTemplate(ctx context.Context, in *pb.GetEm
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	// the layout is optional
+	err = s.emailServiceDB.Db.QueryRow("SELECT value FROM settings WHERE name = ?", emailTemplateFields.Layout).Scan(&layout)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// CSS inlining is optional
+	err = s.emailServiceDB.Db.QueryRow("SELECT value FROM settings WHERE name = ?", emailTemplateFields.InlineCSS).Scan(&inlineCSS)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// the format is optional, the templates being HTML by default
+	err = s.emailServiceDB.Db.QueryRow("SELECT value FROM settings WHERE name = ?", emailTemplateFields.Format).Scan(&format)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// the token parameter and the link TTL are optional
+	err = s.emailServiceDB.Db.QueryRow("SELECT value FROM settings WHERE name = ?", emailTemplateFields.TokenParam).Scan(&tokenParam)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	err = s.emailServiceDB.Db.QueryRow("SELECT value FROM settings WHERE name = ?", emailTemplateFields.LinkTTL).Scan(&linkTTL)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	linkTTLSeconds, _ := strconv.ParseInt(linkTTL.String, 10, 64)
+
+	// only the templates with generated secrets have a code length or TTL
+	if emailTemplateFields.CodeLength != "" {
+		err = s.emailServiceDB.Db.QueryRow("SELECT value FROM settings WHERE name = ?", emailTemplateFields.CodeLength).Scan(&codeLength)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if emailTemplateFields.CodeTTL != "" {
+		err = s.emailServiceDB.Db.QueryRow("SELECT value FROM settings WHERE name = ?", emailTemplateFields.CodeTTL).Scan(&codeTTL)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	codeLengthValue, _ := strconv.Atoi(codeLength.String)
+	codeTTLSeconds, _ := strconv.ParseInt(codeTTL.String, 10, 64)
+
 	return &pb.GetEmailTemaplateResponse{
-		Subject:     subject.String,
-		Body:        body.String,
-		RedirectUrl: redirectURL.String,
+		Subject:        subject.String,
+		Body:           body.String,
+		RedirectUrl:    redirectURL.String,
+		Layout:         layout.String,
+		InlineCss:      inlineCSS.String == "true",
+		Format:         templateFormatFromName(format.String),
+		TokenParam:     tokenParam.String,
+		LinkTtlSeconds: linkTTLSeconds,
+		CodeLength:     int32(codeLengthValue),
+		CodeTtlSeconds: codeTTLSeconds,
 	}, nil
 }
 
 func main() {
-	// Get the environment i.e. development or production
-	environment := utils.GetGoEnv()
+	// load the configuration from the flags, the environment and the configuration file
+	config, err := utils.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if config.PrintConfig {
+		fmt.Print(config)
+	}
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	if config.PrintConfig {
+		return
+	}
 
-	// Load the .env file if the environment is development
-	if environment == "development" {
-		err := godotenv.Load()
-		if err != nil {
-			log.Fatal("Failed to load the .env file: ", err)
+	// run the migrate subcommand instead of the server
+	if len(config.Args) > 0 && config.Args[0] == "migrate" {
+		if err := runMigrateCommand(config.Database, config.Args[1:]); err != nil {
+			log.Fatalf("migrate: %v", err)
 		}
+		return
 	}
 
 	// Create a new cryptoServiceClient
-	cryptoServiceClient, err := utils.NewCryptoServiceClient()
+	cryptoServiceClient, err := utils.NewCryptoServiceClient(config.CryptoService)
 	if err != nil {
 		log.Fatalf("failed to create a new CryptoServiceClient: %v", err)
 	}
 
+	log.Printf("Database configuration: %s", config.Database)
+
 	// Create a new schemaManagementServiceDB
-	emailServiceDB, err := database.NewEmailServiceDB()
+	emailServiceDB, err := database.NewEmailServiceDB(config.Database)
 	if err != nil {
 		log.Fatalf("failed to create a new SchemaManagementServiceDB: %v", err)
 	}
@@ -399,9 +348,16 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to ping the database: %v", err)
 	}
+	// apply the pending migrations and create the missing settings rows
+	if config.MigrateOnStartup {
+		err = migrateUp(context.Background(), emailServiceDB)
+		if err != nil {
+			log.Fatalf("failed to migrate the database: %v", err)
+		}
+	}
 
-	// create a listener on TCP port 8080
-	ls, err := net.Listen("tcp", ":8080")
+	// create a listener on the configured address
+	ls, err := net.Listen("tcp", config.ListenAddress)
 	if err != nil {
 		log.Fatal("Failed to listen: ", err)
 	}
@@ -409,10 +365,57 @@ func main() {
 	// Close the listener when the application exits
 	defer ls.Close()
 
-	fmt.Println("Server started on port 8080")
+	fmt.Println("Server started on " + config.ListenAddress)
+
+	deliveryEvents := utils.NewDeliveryEventNotifier()
+
+	// start posting the delivery events to the webhook endpoints
+	webhookDispatcher := utils.NewWebhookDispatcher(emailServiceDB.Db, cryptoServiceClient, deliveryEvents)
+	go webhookDispatcher.Run(context.Background())
+
+	emailManagerService := &EmailManagerService{
+		emailServiceDB:      emailServiceDB,
+		cryptoServiceClient: cryptoServiceClient,
+		deliveryEvents:      deliveryEvents,
+		mxResolver:          net.DefaultResolver,
+		settingsCache:       utils.NewSettingsCache(emailServiceDB.Db, config.SettingsCacheTTL),
+		config:              config,
+	}
+
+	// start sending the scheduled emails once they are due
+	go emailManagerService.runScheduler(context.Background())
+
+	// authenticate the callers and check their role for every RPC
+	authenticator, err := utils.NewAuthenticator(config.Auth)
+	if err != nil {
+		log.Fatalf("failed to configure the authentication: %v", err)
+	}
+
+	serverOptions := []grpc.ServerOption{grpc.MaxRecvMsgSize(utils.MaxRequestSize)}
+
+	// serve over TLS when it is configured
+	tlsConfig, err := utils.NewServerTLSConfig(config.TLS)
+	if err != nil {
+		log.Fatalf("failed to configure TLS: %v", err)
+	}
+	if tlsConfig != nil {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else {
+		log.Println("TLS is not configured, serving plain text gRPC")
+	}
+
+	if authenticator != nil {
+		serverOptions = append(
+			serverOptions,
+			grpc.ChainUnaryInterceptor(authenticator.UnaryServerInterceptor(methodRole)),
+			grpc.ChainStreamInterceptor(authenticator.StreamServerInterceptor(methodRole)),
+		)
+	} else {
+		log.Println("Authentication is disabled, every caller can call every RPC")
+	}
 
-	s := grpc.NewServer()
-	pb.RegisterEmailManagerServer(s, &EmailManagerService{emailServiceDB: emailServiceDB, cryptoServiceClient: cryptoServiceClient})
+	s := grpc.NewServer(serverOptions...)
+	pb.RegisterEmailManagerServer(s, emailManagerService)
 
 	if err := s.Serve(ls); err != nil {
 		log.Fatal("Failed to serve the gRPC server: ", err)
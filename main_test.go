@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/isaacwassou/email-service/database"
+	"github.com/isaacwassou/email-service/testutil"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// newTestService returns a service storing its data in a migrated SQLite database that is removed when the test ends
+func newTestService(t *testing.T) *EmailManagerService {
+	t.Helper()
+
+	return newTestServiceWithConfig(t, database.Config{})
+}
+
+// newTestServiceWithConfig returns a service using a migrated SQLite database with the pool settings of config
+func newTestServiceWithConfig(t *testing.T, config database.Config) *EmailManagerService {
+	t.Helper()
+
+	emailServiceDB := testutil.NewDB(t, config)
+	if err := emailServiceDB.SeedSettings(context.Background(), utils.RequiredSettings()); err != nil {
+		t.Fatal(err)
+	}
+
+	return &EmailManagerService{
+		config:              utils.Config{MFACodeKey: []byte("mfa-code-key")},
+		emailServiceDB:      emailServiceDB,
+		cryptoServiceClient: testutil.CryptoServiceClient{},
+		deliveryEvents:      utils.NewDeliveryEventNotifier(),
+		settingsCache:       utils.NewSettingsCache(emailServiceDB.Db, 0),
+	}
+}
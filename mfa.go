@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// VerifyMFACode checks the code generated for the MFA email with the given message ID.
+// A code can be verified successfully once, and it can no longer be verified after it expires
+// or after utils.MFACodeMaxAttempts wrong codes.
+func (s *EmailManagerService) VerifyMFACode(ctx context.Context, in *pb.VerifyMFACodeRequest) (*pb.VerifyMFACodeResponse, error) {
+	if in.MessageId == "" || in.Code == "" {
+		return nil, status.Error(codes.InvalidArgument, "message ID and code are required")
+	}
+
+	valid, remainingAttempts, err := utils.VerifyMFACode(s.emailServiceDB.Db, s.config.MFACodeKey, in.MessageId, in.Code)
+	if errors.Is(err, utils.ErrMFACodeNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if errors.Is(err, utils.ErrMFACodeUnavailable) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.VerifyMFACodeResponse{Valid: valid, RemainingAttempts: int32(remainingAttempts)}, nil
+}
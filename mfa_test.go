@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// mfaCodePattern matches the code rendered by the MFA template of setMFATemplate
+var mfaCodePattern = regexp.MustCompile(`Your code is (\d+)`)
+
+func setMFATemplate(t *testing.T, s *EmailManagerService) {
+	t.Helper()
+
+	ctx := context.Background()
+	if _, err := s.AddRedirectOrigin(ctx, &pb.AddRedirectOriginRequest{Origin: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.SetEmailTemplate(ctx, &pb.SetEmailTemplateRequest{
+		EmailType:   pb.EmailType_MFA,
+		Subject:     "Your code",
+		Body:        "<p>Your code is {{.Code}}</p>",
+		RedirectUrl: "https://example.com/mfa",
+		CodeLength:  8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queuedMFACode returns the code rendered in the queued email with the given message ID
+func queuedMFACode(t *testing.T, s *EmailManagerService, messageID string) string {
+	t.Helper()
+
+	email := utils.QueuedEmail{MessageID: messageID}
+	err := s.emailServiceDB.Db.QueryRow("SELECT body, encrypted FROM email_queue WHERE message_id = ?", messageID).Scan(&email.Body, &email.Encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the code is not stored in plaintext in the queue
+	if !email.Encrypted || !strings.HasPrefix(email.Body, "encrypted:") {
+		t.Fatalf("the email %s is queued unencrypted: %s", messageID, email.Body)
+	}
+	if err := s.decryptEmailBody(context.Background(), &email); err != nil {
+		t.Fatal(err)
+	}
+
+	match := mfaCodePattern.FindStringSubmatch(email.Body)
+	if match == nil {
+		t.Fatalf("the email %s has no code: %s", messageID, email.Body)
+	}
+
+	return match[1]
+}
+
+// verifyQueuedMFACode checks that the code rendered in a queued email is the one VerifyMFACode accepts
+func verifyQueuedMFACode(t *testing.T, s *EmailManagerService, messageID string) {
+	t.Helper()
+
+	code := queuedMFACode(t, s, messageID)
+	if len(code) != 8 {
+		t.Errorf("code %q has %d digits, expected 8", code, len(code))
+	}
+
+	response, err := s.VerifyMFACode(context.Background(), &pb.VerifyMFACodeRequest{MessageId: messageID, Code: code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Valid {
+		t.Errorf("the code of %s is not valid", messageID)
+	}
+}
+
+func TestBatchSendGeneratesMFACodes(t *testing.T) {
+	s := newTestService(t)
+	setMFATemplate(t, s)
+
+	response, err := s.BatchSend(context.Background(), &pb.BatchSendRequest{
+		EmailType:  pb.EmailType_MFA,
+		Recipients: []*pb.BatchRecipient{{To: "first@example.com"}, {To: "second@example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Accepted != 2 {
+		t.Fatalf("accepted %d recipients, expected 2: %v", response.Accepted, response.Results)
+	}
+
+	generated := map[string]bool{}
+	for _, result := range response.Results {
+		verifyQueuedMFACode(t, s, result.MessageId)
+		generated[queuedMFACode(t, s, result.MessageId)] = true
+	}
+	if len(generated) != 2 {
+		t.Error("the recipients got the same code")
+	}
+}
+
+func TestBatchSendRejectsScheduledMFACodes(t *testing.T) {
+	s := newTestService(t)
+	setMFATemplate(t, s)
+
+	response, err := s.BatchSend(context.Background(), &pb.BatchSendRequest{
+		EmailType:  pb.EmailType_MFA,
+		Recipients: []*pb.BatchRecipient{{To: "first@example.com"}, {To: "second@example.com", Token: "caller-token"}},
+		SendAt:     timestamppb.New(time.Now().Add(time.Hour)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Results[0].Error == "" {
+		t.Error("the scheduled recipient without a token was accepted")
+	}
+	if response.Results[1].Error != "" {
+		t.Errorf("the scheduled recipient with a token was rejected: %s", response.Results[1].Error)
+	}
+}
+
+// fakeIngestCampaignStream streams the requests to IngestCampaign and keeps its response. Once the requests
+// run out, the stream ends with err, or with io.EOF when err is nil.
+type fakeIngestCampaignStream struct {
+	grpc.ServerStream
+	requests []*pb.IngestCampaignRequest
+	err      error
+	// beforeRecv is called with the number of requests left before each of them is received
+	beforeRecv func(remaining int)
+	response   *pb.IngestCampaignResponse
+}
+
+func (f *fakeIngestCampaignStream) Context() context.Context {
+	return context.Background()
+}
+
+func (f *fakeIngestCampaignStream) Recv() (*pb.IngestCampaignRequest, error) {
+	if f.beforeRecv != nil {
+		f.beforeRecv(len(f.requests))
+	}
+
+	if len(f.requests) == 0 {
+		if f.err != nil {
+			return nil, f.err
+		}
+		return nil, io.EOF
+	}
+
+	request := f.requests[0]
+	f.requests = f.requests[1:]
+
+	return request, nil
+}
+
+func (f *fakeIngestCampaignStream) SendAndClose(response *pb.IngestCampaignResponse) error {
+	f.response = response
+	return nil
+}
+
+func TestIngestCampaignGeneratesMFACodes(t *testing.T) {
+	s := newTestService(t)
+	setMFATemplate(t, s)
+
+	stream := &fakeIngestCampaignStream{requests: []*pb.IngestCampaignRequest{
+		{CampaignName: "codes", EmailType: pb.EmailType_MFA, Recipient: &pb.BatchRecipient{To: "first@example.com"}},
+		{Recipient: &pb.BatchRecipient{To: "second@example.com"}},
+	}}
+	if err := s.IngestCampaign(stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.response.Accepted != 2 {
+		t.Fatalf("accepted %d recipients, expected 2: %v", stream.response.Accepted, stream.response.Rejections)
+	}
+
+	rows, err := s.emailServiceDB.Db.Query("SELECT message_id FROM email_queue WHERE campaign_id = ?", stream.response.CampaignId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageIDs := []string{}
+	for rows.Next() {
+		var messageID string
+		if err := rows.Scan(&messageID); err != nil {
+			t.Fatal(err)
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+	rows.Close()
+
+	if len(messageIDs) != 2 {
+		t.Fatalf("queued %d emails, expected 2", len(messageIDs))
+	}
+	for _, messageID := range messageIDs {
+		verifyQueuedMFACode(t, s, messageID)
+	}
+}
+
+// queueMFAEmail queues an MFA email with a generated code and returns its message ID and code
+func queueMFAEmail(t *testing.T, s *EmailManagerService) (string, string) {
+	t.Helper()
+
+	response, err := s.BatchSend(context.Background(), &pb.BatchSendRequest{
+		EmailType:  pb.EmailType_MFA,
+		Recipients: []*pb.BatchRecipient{{To: "user@example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Accepted != 1 {
+		t.Fatalf("the recipient was rejected: %s", response.Results[0].Error)
+	}
+
+	messageID := response.Results[0].MessageId
+	return messageID, queuedMFACode(t, s, messageID)
+}
+
+func TestVerifyMFACodeAttempts(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t)
+	setMFATemplate(t, s)
+	messageID, code := queueMFAEmail(t, s)
+
+	// every wrong code uses up one attempt
+	for expected := utils.MFACodeMaxAttempts - 1; expected >= 0; expected-- {
+		response, err := s.VerifyMFACode(ctx, &pb.VerifyMFACodeRequest{MessageId: messageID, Code: "00000000"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Valid || response.RemainingAttempts != int32(expected) {
+			t.Fatalf("VerifyMFACode() = %v with %d remaining attempts, expected an invalid code with %d", response.Valid, response.RemainingAttempts, expected)
+		}
+	}
+
+	// the right code is refused once the attempts ran out
+	_, err := s.VerifyMFACode(ctx, &pb.VerifyMFACodeRequest{MessageId: messageID, Code: code})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("VerifyMFACode() after the last attempt = %v, expected FailedPrecondition", err)
+	}
+}
+
+func TestVerifyMFACodeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		prepare  func(t *testing.T, s *EmailManagerService, messageID string, code string)
+		expected codes.Code
+	}{
+		{"used", func(t *testing.T, s *EmailManagerService, messageID string, code string) {
+			response, err := s.VerifyMFACode(context.Background(), &pb.VerifyMFACodeRequest{MessageId: messageID, Code: code})
+			if err != nil || !response.Valid {
+				t.Fatalf("VerifyMFACode() = %v, %v, expected the code to be valid the first time", response, err)
+			}
+		}, codes.FailedPrecondition},
+		{"expired", func(t *testing.T, s *EmailManagerService, messageID string, code string) {
+			_, err := s.emailServiceDB.Db.Exec("UPDATE mfa_codes SET expires_at = ? WHERE message_id = ?", time.Now().Add(-time.Second).UTC(), messageID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, codes.FailedPrecondition},
+		{"unknown message", func(t *testing.T, s *EmailManagerService, messageID string, code string) {
+			if _, err := s.emailServiceDB.Db.Exec("DELETE FROM mfa_codes WHERE message_id = ?", messageID); err != nil {
+				t.Fatal(err)
+			}
+		}, codes.NotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestService(t)
+			setMFATemplate(t, s)
+			messageID, code := queueMFAEmail(t, s)
+			test.prepare(t, s, messageID, code)
+
+			_, err := s.VerifyMFACode(context.Background(), &pb.VerifyMFACodeRequest{MessageId: messageID, Code: code})
+			if status.Code(err) != test.expected {
+				t.Errorf("VerifyMFACode() = %v, expected %s", err, test.expected)
+			}
+		})
+	}
+}
+
+func TestVerifyMFACodeRequiresTheKey(t *testing.T) {
+	s := newTestService(t)
+	setMFATemplate(t, s)
+	messageID, code := queueMFAEmail(t, s)
+
+	// the stored hash cannot be matched without the key it was computed with
+	s.config.MFACodeKey = []byte("another-key")
+	response, err := s.VerifyMFACode(context.Background(), &pb.VerifyMFACodeRequest{MessageId: messageID, Code: code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Valid {
+		t.Error("the code was verified with another key")
+	}
+}
+
+func TestGeneratedMFACodesRequireKey(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t)
+	setMFATemplate(t, s)
+	s.config.MFACodeKey = nil
+
+	_, err := s.SendMFAEmail(ctx, &pb.SendEmailRequest{To: "user@example.com"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("SendMFAEmail() = %v, expected FailedPrecondition", err)
+	}
+
+	response, err := s.BatchSend(ctx, &pb.BatchSendRequest{
+		EmailType:  pb.EmailType_MFA,
+		Recipients: []*pb.BatchRecipient{{To: "user@example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Accepted != 0 || countRows(t, s, "mfa_codes") != 0 {
+		t.Error("BatchSend() generated a code without the MFA_CODE_KEY setting")
+	}
+}
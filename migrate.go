@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/isaacwassou/email-service/database"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+const migrateUsage = "usage: migrate up | down [steps] | status"
+
+// runMigrateCommand runs the migrate subcommand: up applies the pending migrations and seeds the settings,
+// down reverts the given number of migrations, one by default, and status lists the migrations
+func runMigrateCommand(dbConfig database.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	emailServiceDB, err := database.NewEmailServiceDB(dbConfig)
+	if err != nil {
+		return err
+	}
+	defer emailServiceDB.Db.Close()
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		return migrateUp(ctx, emailServiceDB)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+
+		reverted, err := emailServiceDB.MigrateDown(ctx, steps)
+		for _, migration := range reverted {
+			fmt.Printf("reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+
+	case "status":
+		statuses, err := emailServiceDB.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.UTC().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+		return nil
+
+	default:
+		return errors.New(migrateUsage)
+	}
+}
+
+// migrateUp applies the pending migrations then creates the missing settings rows
+func migrateUp(ctx context.Context, emailServiceDB *database.EmailServiceDB) error {
+	applied, err := emailServiceDB.MigrateUp(ctx)
+	for _, migration := range applied {
+		log.Printf("Applied migration %04d_%s", migration.Version, migration.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	return emailServiceDB.SeedSettings(ctx, utils.RequiredSettings())
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/isaacwassou/email-service/database"
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+var templatePartialKinds = map[pb.TemplatePartialKind]string{
+	pb.TemplatePartialKind_PARTIAL: utils.TemplatePartialKindPartial,
+	pb.TemplatePartialKind_LAYOUT:  utils.TemplatePartialKindLayout,
+}
+
+// SetTemplatePartial creates or replaces a layout or partial. Every email template is re-validated against
+// the new set of partials, and the change is rejected when it would break any of them.
+func (s *EmailManagerService) SetTemplatePartial(ctx context.Context, in *pb.SetTemplatePartialRequest) (*pb.SetTemplatePartialResponse, error) {
+	if in.Name == "" || in.Name == utils.ContentTemplateName || in.Name == utils.MarkdownTemplateName {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid partial name %q", in.Name)
+	}
+
+	kind, found := templatePartialKinds[in.Kind]
+	if !found {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid partial kind %d", in.Kind)
+	}
+
+	if _, err := template.New(in.Name).Parse(in.Body); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	partial := utils.TemplatePartial{Name: in.Name, Kind: kind, Body: in.Body}
+
+	// the templates are validated in the transaction of the change, so none can be changed meanwhile
+	err := s.savePartials(ctx, func(tx *database.Tx) (utils.AuditEvent, error) {
+		partials, err := tx.Repository().GetTemplatePartials(ctx)
+		if err != nil {
+			return utils.AuditEvent{}, status.Error(codes.Internal, err.Error())
+		}
+
+		// keep the previous version for the audit log
+		before := map[string]string{}
+		for _, previous := range partials {
+			if previous.Name == in.Name {
+				before = map[string]string{"kind": previous.Kind, "body": previous.Body}
+			}
+		}
+
+		if err := s.validateEmailTemplates(ctx, tx.Repository(), replaceTemplatePartial(partials, partial)); err != nil {
+			return utils.AuditEvent{}, err
+		}
+
+		if err := tx.Repository().UpsertTemplatePartial(ctx, partial); err != nil {
+			return utils.AuditEvent{}, status.Error(codes.Internal, err.Error())
+		}
+
+		return utils.NewAuditEvent(ctx, "SetTemplatePartial", in.Name, before, map[string]string{"kind": kind, "body": in.Body}), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.SetTemplatePartialResponse{Message: "Template partial set successfully!"}, nil
+}
+
+func (s *EmailManagerService) GetTemplatePartial(ctx context.Context, in *pb.GetTemplatePartialRequest) (*pb.TemplatePartial, error) {
+	partials, err := s.emailServiceDB.Db.Repository().GetTemplatePartials(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	for _, partial := range partials {
+		if partial.Name == in.Name {
+			return toPBTemplatePartial(partial), nil
+		}
+	}
+
+	return nil, status.Errorf(codes.NotFound, "template partial %s not found", in.Name)
+}
+
+func (s *EmailManagerService) ListTemplatePartials(ctx context.Context, in *emptypb.Empty) (*pb.ListTemplatePartialsResponse, error) {
+	partials, err := s.emailServiceDB.Db.Repository().GetTemplatePartials(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.ListTemplatePartialsResponse{}
+	for _, partial := range partials {
+		response.Partials = append(response.Partials, toPBTemplatePartial(partial))
+	}
+
+	return response, nil
+}
+
+// DeleteTemplatePartial removes a layout or partial unless an email template still depends on it
+func (s *EmailManagerService) DeleteTemplatePartial(ctx context.Context, in *pb.DeleteTemplatePartialRequest) (*pb.DeleteTemplatePartialResponse, error) {
+	err := s.savePartials(ctx, func(tx *database.Tx) (utils.AuditEvent, error) {
+		partials, err := tx.Repository().GetTemplatePartials(ctx)
+		if err != nil {
+			return utils.AuditEvent{}, status.Error(codes.Internal, err.Error())
+		}
+
+		remaining := []utils.TemplatePartial{}
+		before := map[string]string{}
+		for _, partial := range partials {
+			if partial.Name != in.Name {
+				remaining = append(remaining, partial)
+			} else {
+				before = map[string]string{"kind": partial.Kind, "body": partial.Body}
+			}
+		}
+
+		if len(remaining) == len(partials) {
+			return utils.AuditEvent{}, status.Errorf(codes.NotFound, "template partial %s not found", in.Name)
+		}
+
+		if err := s.validateEmailTemplates(ctx, tx.Repository(), remaining); err != nil {
+			return utils.AuditEvent{}, err
+		}
+
+		if _, err := tx.Repository().DeleteTemplatePartial(ctx, in.Name); err != nil {
+			return utils.AuditEvent{}, status.Error(codes.Internal, err.Error())
+		}
+
+		return utils.NewAuditEvent(ctx, "DeleteTemplatePartial", in.Name, before, nil), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteTemplatePartialResponse{Message: "Template partial deleted successfully!"}, nil
+}
+
+// validateEmailTemplates renders every configured email template with the given layouts and partials
+// and returns a FailedPrecondition error listing the templates that fail
+func (s *EmailManagerService) validateEmailTemplates(ctx context.Context, repository database.Repository, partials []utils.TemplatePartial) error {
+	emailTypes := []pb.EmailType{}
+	for emailType := range templateNames {
+		emailTypes = append(emailTypes, emailType)
+	}
+	sort.Slice(emailTypes, func(i, j int) bool { return emailTypes[i] < emailTypes[j] })
+
+	failures := []string{}
+	for _, emailType := range emailTypes {
+		fields, err := utils.GetEmailTemplateDBFields(emailType)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// templates that are not configured yet have nothing to break
+		body, err := repository.GetSettings(ctx, []string{fields.Body})
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if body[fields.Body].String == "" {
+			continue
+		}
+
+		details, err := utils.GetEmailTemplateDetails(repository, emailType)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		details.Partials = partials
+		if err := utils.ValidateBodyTemplate(details, templateNames[emailType]); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", emailType, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "the change breaks the email templates: %s", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// validateTemplateBody checks that a template body being saved renders with its layout and the stored partials
+func (s *EmailManagerService) validateTemplateBody(ctx context.Context, emailType pb.EmailType, body string, layout string, format string) error {
+	partials, err := s.emailServiceDB.Db.Repository().GetTemplatePartials(ctx)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	details := utils.EmailTemplateDetails{
+		BodyTemplate: body,
+		Layout:       layout,
+		Format:       format,
+		Partials:     partials,
+	}
+	if err := utils.ValidateBodyTemplate(details, templateNames[emailType]); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return nil
+}
+
+// savePartials runs a change to the partials in a transaction that also records its audit event and drops the
+// cached templates of every replica. The errors of the change are returned as they are, the others as Internal.
+func (s *EmailManagerService) savePartials(ctx context.Context, change func(tx *database.Tx) (utils.AuditEvent, error)) error {
+	err := utils.WithTx(ctx, s.emailServiceDB.Db, func(tx *database.Tx) error {
+		event, err := change(tx)
+		if err != nil {
+			return err
+		}
+
+		if err := utils.InsertAuditEvent(tx, event); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if err := tx.Repository().IncrementSettingsVersion(ctx); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		return nil
+	})
+	if err != nil {
+		// the commit may fail as well
+		if _, isStatus := status.FromError(err); !isStatus {
+			return status.Error(codes.Internal, err.Error())
+		}
+		return err
+	}
+
+	s.settingsCache.Clear()
+
+	return nil
+}
+
+// replaceTemplatePartial returns the partials with the one of the same name replaced, or the new one added
+func replaceTemplatePartial(partials []utils.TemplatePartial, partial utils.TemplatePartial) []utils.TemplatePartial {
+	for i := range partials {
+		if partials[i].Name == partial.Name {
+			partials[i] = partial
+			return partials
+		}
+	}
+
+	return append(partials, partial)
+}
+
+func toPBTemplatePartial(partial utils.TemplatePartial) *pb.TemplatePartial {
+	pbPartial := &pb.TemplatePartial{
+		Name:      partial.Name,
+		Body:      partial.Body,
+		UpdatedAt: timestamppb.New(partial.UpdatedAt),
+	}
+
+	for kind, name := range templatePartialKinds {
+		if name == partial.Kind {
+			pbPartial.Kind = kind
+		}
+	}
+
+	return pbPartial
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/isaacwassou/email-service/database"
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+)
+
+func TestTemplatePartials(t *testing.T) {
+	// a single connection shows the templates are validated in the transaction of the change
+	s := newTestServiceWithConfig(t, database.Config{MaxOpenConns: 1})
+	ctx := context.Background()
+
+	setPartial := func(body string) error {
+		_, err := s.SetTemplatePartial(ctx, &pb.SetTemplatePartialRequest{Name: "footer", Kind: pb.TemplatePartialKind_PARTIAL, Body: body})
+		return err
+	}
+
+	if err := setPartial("<p>Footer</p>"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddRedirectOrigin(ctx, &pb.AddRedirectOriginRequest{Origin: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.SetEmailTemplate(ctx, &pb.SetEmailTemplateRequest{
+		EmailType:   pb.EmailType_MFA,
+		Subject:     "Your code",
+		Body:        `<p>Your code is {{.Code}}</p>{{template "footer" .}}`,
+		RedirectUrl: "https://example.com/mfa",
+		CodeLength:  8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := s.emailServiceDB.Db.Repository().GetSettingsVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := countRows(t, s, "audit_events")
+
+	// changes breaking the template are rejected without storing anything
+	if err := setPartial(`{{template "missing" .}}`); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("SetTemplatePartial() = %v, expected FailedPrecondition", err)
+	}
+	if _, err := s.DeleteTemplatePartial(ctx, &pb.DeleteTemplatePartialRequest{Name: "footer"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("DeleteTemplatePartial() = %v, expected FailedPrecondition", err)
+	}
+	if _, err := s.DeleteTemplatePartial(ctx, &pb.DeleteTemplatePartialRequest{Name: "unknown"}); status.Code(err) != codes.NotFound {
+		t.Errorf("DeleteTemplatePartial() of an unknown partial = %v, expected NotFound", err)
+	}
+
+	partial, err := s.GetTemplatePartial(ctx, &pb.GetTemplatePartialRequest{Name: "footer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial.Body != "<p>Footer</p>" {
+		t.Errorf("the partial is %q, expected the body before the rejected change", partial.Body)
+	}
+	if current, err := s.emailServiceDB.Db.Repository().GetSettingsVersion(ctx); err != nil || current != version {
+		t.Errorf("GetSettingsVersion() = %d, %v, expected the version %d to be kept", current, err, version)
+	}
+	if count := countRows(t, s, "audit_events"); count != events {
+		t.Errorf("recorded %d audit events, expected %d", count, events)
+	}
+
+	// a valid change is stored with its audit event and a new settings version
+	if err := setPartial("<p>New footer</p>"); err != nil {
+		t.Fatal(err)
+	}
+	if current, err := s.emailServiceDB.Db.Repository().GetSettingsVersion(ctx); err != nil || current != version+1 {
+		t.Errorf("GetSettingsVersion() = %d, %v, expected %d", current, err, version+1)
+	}
+	response, err := s.ListAuditEvents(ctx, &pb.ListAuditEventsRequest{Rpc: "SetTemplatePartial", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Events) != 1 || response.Events[0].After["body"] != "<p>New footer</p>" || response.Events[0].Before["body"] != "<p>Footer</p>" {
+		t.Errorf("ListAuditEvents() = %v, expected the change of the footer", response.Events)
+	}
+
+	// a partial no template uses anymore can be deleted
+	_, err = s.SetEmailTemplate(ctx, &pb.SetEmailTemplateRequest{
+		EmailType:   pb.EmailType_MFA,
+		Subject:     "Your code",
+		Body:        "<p>Your code is {{.Code}}</p>",
+		RedirectUrl: "https://example.com/mfa",
+		CodeLength:  8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DeleteTemplatePartial(ctx, &pb.DeleteTemplatePartialRequest{Name: "footer"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetTemplatePartial(ctx, &pb.GetTemplatePartialRequest{Name: "footer"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetTemplatePartial() of the deleted partial = %v, expected NotFound", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// AddRedirectOrigin allows the templates to redirect to the given origin
+func (s *EmailManagerService) AddRedirectOrigin(ctx context.Context, in *pb.AddRedirectOriginRequest) (*pb.AddRedirectOriginResponse, error) {
+	origin, err := utils.NormalizeOrigin(in.Origin)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	added, err := utils.InsertRedirectOrigin(s.emailServiceDB.Db, origin)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if added {
+		s.recordAuditEvent(ctx, "AddRedirectOrigin", origin, nil, map[string]string{"origin": origin})
+	}
+
+	return &pb.AddRedirectOriginResponse{Message: "Redirect origin added successfully!"}, nil
+}
+
+func (s *EmailManagerService) ListRedirectOrigins(ctx context.Context, in *emptypb.Empty) (*pb.ListRedirectOriginsResponse, error) {
+	origins, err := utils.GetRedirectOrigins(s.emailServiceDB.Db)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.ListRedirectOriginsResponse{}
+	for _, origin := range origins {
+		response.Origins = append(response.Origins, &pb.RedirectOrigin{
+			Origin:    origin.Origin,
+			CreatedAt: timestamppb.New(origin.CreatedAt),
+		})
+	}
+
+	return response, nil
+}
+
+// RemoveRedirectOrigin removes an origin from the allowlist unless a template still redirects to it
+func (s *EmailManagerService) RemoveRedirectOrigin(ctx context.Context, in *pb.RemoveRedirectOriginRequest) (*pb.RemoveRedirectOriginResponse, error) {
+	origin, err := utils.NormalizeOrigin(in.Origin)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	redirectURLs, err := utils.GetRedirectURLSettings(s.emailServiceDB.Db)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	inUse := []string{}
+	for name, redirectURL := range redirectURLs {
+		if redirectOrigin, err := utils.NormalizeOrigin(redirectURL); err == nil && redirectOrigin == origin {
+			inUse = append(inUse, name)
+		}
+	}
+	if len(inUse) > 0 {
+		sort.Strings(inUse)
+		return nil, status.Errorf(codes.FailedPrecondition, "origin %s is used by %s", origin, strings.Join(inUse, ", "))
+	}
+
+	removed, err := utils.DeleteRedirectOrigin(s.emailServiceDB.Db, origin)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !removed {
+		return nil, status.Errorf(codes.NotFound, "redirect origin %s not found", origin)
+	}
+
+	s.recordAuditEvent(ctx, "RemoveRedirectOrigin", origin, map[string]string{"origin": origin}, nil)
+
+	return &pb.RemoveRedirectOriginResponse{Message: "Redirect origin removed successfully!"}, nil
+}
+
+// checkRedirectOrigin rejects the redirect URLs whose origin is not in the allowlist
+func (s *EmailManagerService) checkRedirectOrigin(redirectURL string) error {
+	allowed, err := utils.IsRedirectOriginAllowed(s.emailServiceDB.Db, redirectURL)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if !allowed {
+		return status.Errorf(codes.PermissionDenied, "the origin of %s is not in the redirect origin allowlist", redirectURL)
+	}
+
+	return nil
+}
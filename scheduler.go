@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/gomail.v2"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+const (
+	// schedulerPollInterval is how often the queue is checked for due emails
+	schedulerPollInterval = 5 * time.Second
+	// schedulerBatchSize is the number of due emails claimed per poll
+	schedulerBatchSize = 50
+)
+
+// CancelScheduledEmail removes a scheduled email from the queue as long as it has not been sent yet
+func (s *EmailManagerService) CancelScheduledEmail(ctx context.Context, in *pb.CancelScheduledEmailRequest) (*pb.CancelScheduledEmailResponse, error) {
+	exists, cancelled, err := s.emailServiceDB.Db.Repository().CancelQueuedEmail(ctx, in.MessageId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "scheduled email %s not found", in.MessageId)
+	}
+
+	if !cancelled {
+		return nil, status.Errorf(codes.FailedPrecondition, "scheduled email %s is already being sent or was sent", in.MessageId)
+	}
+
+	return &pb.CancelScheduledEmailResponse{Message: "Scheduled email cancelled successfully!"}, nil
+}
+
+// schedulerSMTPPool keeps the SMTP pool of the scheduler across the batches, so their emails reuse the connections
+// and SMTPSendRate throttles all of them rather than every batch on its own. It is only used by the scheduler
+// goroutine.
+type schedulerSMTPPool struct {
+	pool *utils.SMTPPool
+	// config is the SMTP configuration the pool connects with
+	config utils.SMTPConfig
+}
+
+// get returns the pool connecting with the SMTP configuration, replacing the pool of a previous configuration
+// once its settings changed
+func (p *schedulerSMTPPool) get(smtpConfig utils.SMTPConfig, size int, rate float64) *utils.SMTPPool {
+	if p.pool != nil && p.config == smtpConfig {
+		return p.pool
+	}
+
+	p.Close()
+	p.pool = utils.NewSMTPPool(newSMTPDialer(smtpConfig), size, rate)
+	p.config = smtpConfig
+
+	return p.pool
+}
+
+// Close closes the connections of the pool
+func (p *schedulerSMTPPool) Close() {
+	if p.pool != nil {
+		p.pool.Close()
+		p.pool = nil
+	}
+}
+
+// runScheduler sends the queued emails once they are due until the context is cancelled.
+// Every email is claimed before it is sent so several replicas can run the scheduler at the same time,
+// the emails being delivered at least once as described by utils.ClaimQueuedEmail.
+func (s *EmailManagerService) runScheduler(ctx context.Context) {
+	ticker := time.NewTicker(schedulerPollInterval)
+	defer ticker.Stop()
+
+	pool := &schedulerSMTPPool{}
+	defer pool.Close()
+
+	for {
+		// keep sending while the queue has a backlog of due emails
+		for {
+			sent, err := s.sendDueEmails(ctx, pool)
+			if err != nil {
+				log.Printf("Failed to send the due emails: %s", err)
+			}
+			if err != nil || sent < schedulerBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendDueEmails claims a batch of due emails and sends them over the throttled pool of SMTP connections of the
+// scheduler. It returns the number of emails it found due.
+func (s *EmailManagerService) sendDueEmails(ctx context.Context, smtpPool *schedulerSMTPPool) (int, error) {
+	ids, err := s.emailServiceDB.Db.Repository().GetDueEmailIDs(ctx, time.Now(), schedulerBatchSize)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	// get the SMTP configuration once for the whole batch
+	smtpConfig, err := s.smtpConfig(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	pool := smtpPool.get(smtpConfig, s.config.SMTPPoolSize, s.config.SMTPSendRate)
+	sender := smtpConfig.Sender
+
+	// inline assets of the templates, loaded once per email type for the whole batch
+	inlineAssets := map[string][]utils.Attachment{}
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		email, claimed, err := utils.ClaimQueuedEmail(ctx, s.emailServiceDB.Db, id)
+		if err != nil {
+			wg.Wait()
+			return 0, err
+		}
+
+		// another replica got to the email first or it was cancelled
+		if !claimed {
+			continue
+		}
+
+		if email.Encrypted {
+			if err := s.decryptEmailBody(ctx, &email); err != nil {
+				s.failQueuedEmail(ctx, email, err)
+				continue
+			}
+		}
+
+		if _, found := inlineAssets[email.EmailType]; !found {
+			assets, err := s.emailServiceDB.Db.Repository().GetTemplateAssets(ctx, email.EmailType)
+			if err != nil {
+				wg.Wait()
+				return 0, err
+			}
+			inlineAssets[email.EmailType] = assets
+		}
+
+		m := newMessage(sender, email, inlineAssets[email.EmailType])
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.sendQueuedEmail(ctx, pool, m, email)
+		}()
+	}
+	wg.Wait()
+
+	return len(ids), nil
+}
+
+// sendQueuedEmail sends a claimed email and records the outcome in the queue and the delivery event log
+func (s *EmailManagerService) sendQueuedEmail(ctx context.Context, pool *utils.SMTPPool, m *gomail.Message, email utils.QueuedEmail) {
+	event := utils.DeliveryEvent{
+		MessageID: email.MessageID,
+		EmailType: email.EmailType,
+		Recipient: email.Recipient,
+	}
+
+	sendErr := pool.Send(ctx, m)
+	if sendErr == nil {
+		if err := utils.MarkQueuedEmailSent(ctx, s.emailServiceDB.Db, email.ID); err != nil {
+			log.Printf("Failed to mark the email %s as sent, it will be sent again once its lock expires: %s", email.MessageID, err)
+		}
+		s.recordDeliveryEvent(event, utils.DeliveryEventSent, "")
+		return
+	}
+
+	s.failQueuedEmail(ctx, email, sendErr)
+}
+
+// failQueuedEmail records a failed attempt of a claimed email, which is retried later until it runs out of attempts
+func (s *EmailManagerService) failQueuedEmail(ctx context.Context, email utils.QueuedEmail, sendErr error) {
+	event := utils.DeliveryEvent{
+		MessageID: email.MessageID,
+		EmailType: email.EmailType,
+		Recipient: email.Recipient,
+	}
+
+	failed, err := utils.MarkQueuedEmailFailed(ctx, s.emailServiceDB.Db, email, sendErr)
+	if err != nil {
+		log.Printf("Failed to record the failed attempt of the email %s: %s", email.MessageID, err)
+		return
+	}
+
+	if failed {
+		s.recordDeliveryEvent(event, utils.DeliveryEventFailed, sendErr.Error())
+	} else {
+		s.recordDeliveryEvent(event, utils.DeliveryEventDeferred, sendErr.Error())
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/testutil"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// setSMTPServer stores the SMTP credentials of a fake SMTP server
+func setSMTPServer(t *testing.T, s *EmailManagerService, server *testutil.SMTPServer) {
+	t.Helper()
+
+	_, err := s.SetSMTPCredentials(context.Background(), &pb.SetSMTPCredentialsRequest{
+		Host:     server.Host,
+		Port:     int32(server.Port),
+		Username: "user",
+		Password: "password",
+		Sender:   "Sender <sender@example.com>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queueDueEmails stores emails in the queue that are due now, returning their message IDs
+func queueDueEmails(t *testing.T, s *EmailManagerService, recipients ...string) []string {
+	t.Helper()
+
+	emails := []utils.QueuedEmail{}
+	messageIDs := []string{}
+	for _, recipient := range recipients {
+		messageID, err := utils.NewMessageID()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		email := utils.QueuedEmail{
+			MessageID: messageID,
+			EmailType: pb.EmailType_MFA.String(),
+			Recipient: recipient,
+			Subject:   "Subject",
+			Body:      "<p>Body</p>",
+			SendAt:    time.Now().Add(-time.Second),
+		}
+		emails = append(emails, email)
+		messageIDs = append(messageIDs, email.MessageID)
+	}
+
+	if err := s.enqueueEmails(emails...); err != nil {
+		t.Fatal(err)
+	}
+
+	return messageIDs
+}
+
+func TestSendDueEmailsReusesThePool(t *testing.T) {
+	s := newTestService(t)
+	server := testutil.NewSMTPServer(t)
+	setSMTPServer(t, s, server)
+
+	pool := &schedulerSMTPPool{}
+	defer pool.Close()
+
+	for _, recipient := range []string{"first@example.com", "second@example.com"} {
+		queueDueEmails(t, s, recipient)
+		if sent, err := s.sendDueEmails(context.Background(), pool); err != nil || sent != 1 {
+			t.Fatalf("sendDueEmails() = %d, %v, expected the due email to be sent", sent, err)
+		}
+	}
+	if messages := server.Messages(); len(messages) != 2 {
+		t.Fatalf("the server got %d messages, expected 2", len(messages))
+	}
+	if connections := server.Connections(); connections != 1 {
+		t.Errorf("the batches opened %d connections, expected them to share the connection of the pool", connections)
+	}
+
+	// the pool is replaced once the SMTP configuration changes
+	first := pool.pool
+	moved := testutil.NewSMTPServer(t)
+	setSMTPServer(t, s, moved)
+
+	queueDueEmails(t, s, "third@example.com")
+	if sent, err := s.sendDueEmails(context.Background(), pool); err != nil || sent != 1 {
+		t.Fatalf("sendDueEmails() = %d, %v, expected the due email to be sent", sent, err)
+	}
+	if pool.pool == first {
+		t.Error("the pool was not replaced after the SMTP configuration changed")
+	}
+	if messages := moved.Messages(); len(messages) != 1 || messages[0].To[0] != "third@example.com" {
+		t.Errorf("the new server got %+v, expected the email sent after the change", messages)
+	}
+	if messages := server.Messages(); len(messages) != 2 {
+		t.Errorf("the previous server got %d messages, expected no more than 2", len(messages))
+	}
+}
+
+func TestSendDueEmailsFailsUTF8AddressesWithoutSMTPUTF8(t *testing.T) {
+	s := newTestService(t)
+	server := testutil.NewSMTPServer(t, "8BITMIME")
+	setSMTPServer(t, s, server)
+
+	messageIDs := queueDueEmails(t, s, "δοκιμή@example.com")
+
+	pool := &schedulerSMTPPool{}
+	defer pool.Close()
+	if _, err := s.sendDueEmails(context.Background(), pool); err != nil {
+		t.Fatal(err)
+	}
+
+	// the email is given up on at once rather than retried
+	var status string
+	var attempts int
+	err := s.emailServiceDB.Db.QueryRow("SELECT status, attempts FROM email_queue WHERE message_id = ?", messageIDs[0]).Scan(&status, &attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "failed" || attempts != 1 {
+		t.Errorf("the email is %s after %d attempts, expected failed after 1", status, attempts)
+	}
+	if messages := server.Messages(); len(messages) != 0 {
+		t.Errorf("the server got %d messages, expected none", len(messages))
+	}
+}
+
+func TestCancelScheduledEmail(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	messageIDs := queueDueEmails(t, s, "cancelled@example.com", "claimed@example.com")
+
+	if _, err := s.CancelScheduledEmail(ctx, &pb.CancelScheduledEmailRequest{MessageId: messageIDs[0]}); err != nil {
+		t.Fatal(err)
+	}
+
+	// an email being sent cannot be cancelled anymore
+	ids, err := s.emailServiceDB.Db.Repository().GetDueEmailIDs(ctx, time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("%d emails are due, expected the cancelled email not to be", len(ids))
+	}
+	if _, claimed, err := utils.ClaimQueuedEmail(ctx, s.emailServiceDB.Db, ids[0]); err != nil || !claimed {
+		t.Fatalf("ClaimQueuedEmail() = %t, %v, expected the email to be claimed", claimed, err)
+	}
+
+	tests := []struct {
+		name      string
+		messageID string
+		expected  codes.Code
+	}{
+		{"cancelled email", messageIDs[0], codes.FailedPrecondition},
+		{"claimed email", messageIDs[1], codes.FailedPrecondition},
+		{"unknown email", "unknown", codes.NotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := s.CancelScheduledEmail(ctx, &pb.CancelScheduledEmailRequest{MessageId: test.messageID})
+			if status.Code(err) != test.expected {
+				t.Errorf("CancelScheduledEmail() = %v, expected %s", err, test.expected)
+			}
+		})
+	}
+}
+
+func TestRunScheduler(t *testing.T) {
+	s := newTestService(t)
+	server := testutil.NewSMTPServer(t)
+	setSMTPServer(t, s, server)
+
+	// a backlog of more than a batch is sent in full
+	recipients := []string{}
+	for i := 0; i <= schedulerBatchSize; i++ {
+		recipients = append(recipients, fmt.Sprintf("user%d@example.com", i))
+	}
+	queueDueEmails(t, s, recipients...)
+	cancelled := queueDueEmails(t, s, "cancelled@example.com")
+	if _, err := s.CancelScheduledEmail(context.Background(), &pb.CancelScheduledEmailRequest{MessageId: cancelled[0]}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runScheduler(ctx)
+	}()
+
+	deadline := time.Now().Add(3 * schedulerPollInterval)
+	for len(server.Messages()) < len(recipients) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the scheduler stops once its context is cancelled
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the scheduler did not stop after its context was cancelled")
+	}
+
+	if messages := server.Messages(); len(messages) != len(recipients) {
+		t.Errorf("the server got %d messages, expected %d", len(messages), len(recipients))
+	}
+	for _, message := range server.Messages() {
+		if message.To[0] == "cancelled@example.com" {
+			t.Error("the cancelled email was sent")
+		}
+	}
+
+	var sent int
+	if err := s.emailServiceDB.Db.QueryRow("SELECT COUNT(*) FROM email_queue WHERE status = 'sent'").Scan(&sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent != len(recipients) {
+		t.Errorf("%d emails are marked as sent, expected %d", sent, len(recipients))
+	}
+}
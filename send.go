@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/gomail.v2"
+
+	pbCrypto "github.com/isaacwassou/email-service/protobufs/cryptography_service"
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// deliveryError is returned when the email was built but the SMTP server did not accept it
+type deliveryError struct {
+	messageID string
+	err       error
+}
+
+func (e *deliveryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *deliveryError) GRPCStatus() *status.Status {
+	return status.New(codes.Internal, e.err.Error())
+}
+
+// templateNames maps every email type to the name its body template is parsed under
+var templateNames = map[pb.EmailType]string{
+	pb.EmailType_EMAIL_VERIFICATION: "verify-email",
+	pb.EmailType_PASSWORD_RESET:     "password-reset",
+	pb.EmailType_MFA:                "mfa-verification",
+	pb.EmailType_MAGIC_LINK:         "magic-link",
+}
+
+var templateFormats = map[pb.TemplateFormat]string{
+	pb.TemplateFormat_HTML:     utils.TemplateFormatHTML,
+	pb.TemplateFormat_MARKDOWN: utils.TemplateFormatMarkdown,
+}
+
+// validateTemplateLink checks the redirect URL, token parameter and link TTL of a template being saved
+func (s *EmailManagerService) validateTemplateLink(in *pb.SetEmailTemplateRequest) error {
+	if err := utils.ValidateRedirectURL(in.RedirectUrl); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := utils.ValidateTokenParam(in.TokenParam); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if in.LinkTtlSeconds < 0 {
+		return status.Error(codes.InvalidArgument, "link TTL cannot be negative")
+	}
+
+	if in.LinkTtlSeconds > 0 && len(s.config.LinkSigningKey) == 0 {
+		return status.Error(codes.FailedPrecondition, "signed links require the LINK_SIGNING_KEY setting")
+	}
+
+	return nil
+}
+
+// validateTemplateCode checks the code length and TTL of a template being saved, which only the templates
+// with generated codes accept
+func validateTemplateCode(in *pb.SetEmailTemplateRequest, fields utils.EmailTemplateDBFields) error {
+	if fields.CodeLength == "" && in.CodeLength != 0 {
+		return status.Errorf(codes.InvalidArgument, "%s emails do not have generated codes", in.EmailType)
+	}
+
+	if fields.CodeTTL == "" && in.CodeTtlSeconds != 0 {
+		return status.Errorf(codes.InvalidArgument, "%s emails do not have generated secrets", in.EmailType)
+	}
+
+	if in.CodeLength != 0 && (in.CodeLength < utils.MinMFACodeLength || in.CodeLength > utils.MaxMFACodeLength) {
+		return status.Errorf(codes.InvalidArgument, "code length must be between %d and %d", utils.MinMFACodeLength, utils.MaxMFACodeLength)
+	}
+
+	if in.CodeTtlSeconds < 0 {
+		return status.Error(codes.InvalidArgument, "code TTL cannot be negative")
+	}
+
+	return nil
+}
+
+// templateFormatFromName returns the format of a stored template, HTML when it has none
+func templateFormatFromName(name string) pb.TemplateFormat {
+	for format, formatName := range templateFormats {
+		if formatName == name {
+			return format
+		}
+	}
+
+	return pb.TemplateFormat_HTML
+}
+
+// sendTemplatedEmail renders the template of the given email type for the request and sends it,
+// recording every step in the delivery event log. When the request has a send_at time in the future
+// the rendered email is held in the queue until it is due instead.
+func (s *EmailManagerService) sendTemplatedEmail(ctx context.Context, in *pb.SendEmailRequest, emailType pb.EmailType) (*pb.SendEmailResponse, error) {
+	// MFA emails requested without a token carry a code generated by the service,
+	// and magic link emails always carry a token generated by the service
+	generateCode := emailType == pb.EmailType_MFA && in.Token == ""
+	generateMagicLink := emailType == pb.EmailType_MAGIC_LINK
+
+	// check the recipient before any SMTP work
+	to, err := s.normalizeRecipient(ctx, in.To)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if generateCode && len(s.config.MFACodeKey) == 0 {
+		return nil, status.Error(codes.FailedPrecondition, utils.ErrMFACodeKeyNotSet.Error())
+	}
+
+	if in.SendAt != nil && in.SendAt.AsTime().After(time.Now()) {
+		if generateCode || generateMagicLink {
+			return nil, status.Error(codes.InvalidArgument, "emails with a generated code or token cannot be scheduled")
+		}
+		return s.scheduleTemplatedEmail(in, emailType, to)
+	}
+
+	// get the SMTP dialer and sender
+	dialer, sender, err := s.newDialer(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// get the email template details
+	emailTemplate, err := s.settingsCache.GetEmailTemplateDetails(emailType)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// the generated code is also used as the token of the redirect URL
+	token := in.Token
+	if generateCode {
+		emailTemplate.Code, err = utils.GenerateMFACode(emailTemplate.CodeLength)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		token = emailTemplate.Code
+	}
+	if generateMagicLink {
+		token, err = utils.NewMagicLinkToken()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	email, err := s.renderEmail(emailTemplate, emailType, to, token, nil)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	email.Attachments, err = s.resolveAttachments(in.Attachments)
+	if err != nil {
+		return nil, err
+	}
+
+	// store the hash of the generated code to be checked through VerifyMFACode
+	if generateCode {
+		err = utils.InsertMFACode(s.emailServiceDB.Db, s.config.MFACodeKey, email.MessageID, email.Recipient, emailTemplate.Code, emailTemplate.CodeTTL)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// store the hash of the magic link token to be burned through ConsumeMagicLink
+	if generateMagicLink {
+		err = utils.InsertMagicLink(s.emailServiceDB.Db, email.MessageID, email.Recipient, token, emailTemplate.CodeTTL)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// get the inline assets declared by the template
+	inlineAssets, err := s.emailServiceDB.Db.Repository().GetTemplateAssets(ctx, email.EmailType)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	event := utils.DeliveryEvent{
+		MessageID: email.MessageID,
+		EmailType: email.EmailType,
+		Recipient: email.Recipient,
+	}
+	s.recordDeliveryEvent(event, utils.DeliveryEventQueued, "")
+
+	m := newMessage(sender, email, inlineAssets)
+
+	// fail before connecting when the addresses need SMTPUTF8 and the server does not support it
+	if err := utils.CheckSMTPUTF8(dialer, m); err != nil {
+		s.recordDeliveryEvent(event, utils.DeliveryEventFailed, err.Error())
+		if errors.Is(err, utils.ErrSMTPUTF8Unsupported) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, &deliveryError{messageID: email.MessageID, err: err}
+	}
+
+	// open a connection to the SMTP server and send the email
+	if err := dialer.DialAndSend(m); err != nil {
+		s.recordDeliveryEvent(event, utils.DeliveryEventFailed, err.Error())
+		return nil, &deliveryError{messageID: email.MessageID, err: err}
+	}
+
+	s.recordDeliveryEvent(event, utils.DeliveryEventSent, "")
+
+	return &pb.SendEmailResponse{Message: "Sent an email successfully!", MessageId: email.MessageID}, nil
+}
+
+// scheduleTemplatedEmail renders the email now and stores it in the queue until its send_at time, which must come
+// before the signed link of the email expires
+func (s *EmailManagerService) scheduleTemplatedEmail(in *pb.SendEmailRequest, emailType pb.EmailType, to mail.Address) (*pb.SendEmailResponse, error) {
+	// get the email template details
+	emailTemplate, err := s.settingsCache.GetEmailTemplateDetails(emailType)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err := checkLinkTTL(emailTemplate, in.SendAt.AsTime()); err != nil {
+		return nil, err
+	}
+
+	email, err := s.renderEmail(emailTemplate, emailType, to, in.Token, nil)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	email.Attachments, err = s.resolveAttachments(in.Attachments)
+	if err != nil {
+		return nil, err
+	}
+
+	email.SendAt = in.SendAt.AsTime()
+	if err := s.enqueueEmails(email); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.SendEmailResponse{Message: "Scheduled the email successfully!", MessageId: email.MessageID}, nil
+}
+
+// checkLinkTTL rejects a send_at time the signed link of the template would have expired by, as the link is
+// signed when the email is rendered and queued rather than when it is sent
+func checkLinkTTL(emailTemplate utils.EmailTemplateDetails, sendAt time.Time) error {
+	if emailTemplate.LinkTTL > 0 && time.Until(sendAt) >= emailTemplate.LinkTTL {
+		return status.Errorf(codes.InvalidArgument, "send_at is further out than the %s the links of the template are valid for", emailTemplate.LinkTTL)
+	}
+
+	return nil
+}
+
+// enqueueEmails stores rendered emails in the queue and records their queued events
+func (s *EmailManagerService) enqueueEmails(emails ...utils.QueuedEmail) error {
+	if err := utils.EnqueueEmails(s.emailServiceDB.Db, emails); err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		event := utils.DeliveryEvent{
+			MessageID: email.MessageID,
+			EmailType: email.EmailType,
+			Recipient: email.Recipient,
+		}
+		s.recordDeliveryEvent(event, utils.DeliveryEventQueued, fmt.Sprintf("scheduled for %s", email.SendAt.UTC().Format(time.RFC3339)))
+	}
+
+	return nil
+}
+
+// encryptEmailBody encrypts the body and text body of an email through the cryptography service before it is queued,
+// so the codes generated by the service are not stored in plaintext
+func (s *EmailManagerService) encryptEmailBody(ctx context.Context, email *utils.QueuedEmail) error {
+	for _, body := range []*string{&email.Body, &email.TextBody} {
+		if *body == "" {
+			continue
+		}
+
+		encrypted, err := s.cryptoServiceClient.Encrypt(ctx, &pbCrypto.EncryptRequest{Plaintext: *body})
+		if err != nil {
+			return err
+		}
+		*body = encrypted.Ciphertext
+	}
+	email.Encrypted = true
+
+	return nil
+}
+
+// decryptEmailBody decrypts the body and text body of a queued email encrypted by encryptEmailBody
+func (s *EmailManagerService) decryptEmailBody(ctx context.Context, email *utils.QueuedEmail) error {
+	for _, body := range []*string{&email.Body, &email.TextBody} {
+		if *body == "" {
+			continue
+		}
+
+		decrypted, err := s.decrypt(ctx, *body)
+		if err != nil {
+			return err
+		}
+		*body = decrypted
+	}
+	email.Encrypted = false
+
+	return nil
+}
+
+// newDialer loads the SMTP configuration and returns a dialer for it along with the sender address
+func (s *EmailManagerService) newDialer(ctx context.Context) (*gomail.Dialer, string, error) {
+	smtpConfig, err := s.smtpConfig(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return newSMTPDialer(smtpConfig), smtpConfig.Sender, nil
+}
+
+// smtpConfig returns the SMTP configuration with the decrypted password from the cache
+func (s *EmailManagerService) smtpConfig(ctx context.Context) (utils.SMTPConfig, error) {
+	smtpConfig, err := s.settingsCache.GetSMTPConfig(ctx, s.decrypt)
+	if errors.Is(err, utils.ErrSMTPConfigNotSet) {
+		return utils.SMTPConfig{}, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return utils.SMTPConfig{}, status.Error(codes.Internal, err.Error())
+	}
+
+	return smtpConfig, nil
+}
+
+// newSMTPDialer returns a dialer for the SMTP configuration
+func newSMTPDialer(smtpConfig utils.SMTPConfig) *gomail.Dialer {
+	return gomail.NewDialer(
+		smtpConfig.Host,
+		smtpConfig.Port,
+		smtpConfig.User,
+		smtpConfig.Password,
+	)
+}
+
+// decrypt decrypts a secret stored in the database through the cryptography service
+func (s *EmailManagerService) decrypt(ctx context.Context, ciphertext string) (string, error) {
+	decrypted, err := s.cryptoServiceClient.Decrypt(ctx, &pbCrypto.DecryptRequest{Ciphertext: ciphertext})
+	if err != nil {
+		return "", err
+	}
+
+	return decrypted.Plaintext, nil
+}
+
+// renderEmail renders the email template for a recipient and assigns the email an ID
+func (s *EmailManagerService) renderEmail(emailTemplate utils.EmailTemplateDetails, emailType pb.EmailType, to mail.Address, token string, variables map[string]string) (utils.QueuedEmail, error) {
+	// add the token to the redirect URL
+	redirectURL, err := utils.BuildRedirectURL(emailTemplate.RedirectURL, emailTemplate.TokenParam, token, emailTemplate.LinkTTL, s.config.LinkSigningKey)
+	if err != nil {
+		return utils.QueuedEmail{}, err
+	}
+	emailTemplate.RedirectURL = redirectURL
+	emailTemplate.Variables = variables
+
+	// parse the email template body
+	emailBody, textBody, err := utils.ParseBodyTemplate(emailTemplate, templateNames[emailType])
+	if err != nil {
+		return utils.QueuedEmail{}, err
+	}
+
+	messageID, err := utils.NewMessageID()
+	if err != nil {
+		return utils.QueuedEmail{}, err
+	}
+
+	return utils.QueuedEmail{
+		MessageID:     messageID,
+		EmailType:     emailType.String(),
+		Recipient:     to.Address,
+		RecipientName: to.Name,
+		Subject:       emailTemplate.Subject,
+		Body:          emailBody,
+		TextBody:      textBody,
+	}, nil
+}
+
+// resolveAttachments loads the attachments given by storage reference and validates all of them
+func (s *EmailManagerService) resolveAttachments(pbAttachments []*pb.Attachment) ([]utils.Attachment, error) {
+	attachments := []utils.Attachment{}
+	for _, pbAttachment := range pbAttachments {
+		attachment := utils.Attachment{
+			Filename:    pbAttachment.Filename,
+			ContentType: pbAttachment.ContentType,
+			ContentID:   pbAttachment.ContentId,
+			Content:     pbAttachment.Content,
+		}
+
+		if pbAttachment.StorageRef != "" {
+			asset, err := utils.GetAsset(s.emailServiceDB.Db, pbAttachment.StorageRef)
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, status.Errorf(codes.InvalidArgument, "asset %s not found", pbAttachment.StorageRef)
+			}
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+
+			attachment.Content = asset.Content
+			if attachment.Filename == "" {
+				attachment.Filename = asset.Filename
+			}
+			if attachment.ContentType == "" {
+				attachment.ContentType = asset.ContentType
+			}
+		}
+
+		attachments = append(attachments, attachment)
+	}
+
+	if err := utils.ValidateAttachments(attachments); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return attachments, nil
+}
+
+// newMessage builds the message of a rendered email with its attachments and the inline assets of its template
+func newMessage(sender string, email utils.QueuedEmail, inlineAssets []utils.Attachment) *gomail.Message {
+	// create new message
+	m := gomail.NewMessage()
+	// set the email message headers, the display names being encoded as per RFC 2047
+	if from, err := mail.ParseAddress(sender); err == nil {
+		m.SetAddressHeader("From", from.Address, from.Name)
+	} else {
+		m.SetHeader("From", sender)
+	}
+	m.SetAddressHeader("To", email.Recipient, email.RecipientName)
+	m.SetHeader("Subject", email.Subject)
+	m.SetHeader("Message-ID", fmt.Sprintf("<%s@email-service>", email.MessageID))
+	// send the plain text along with the HTML when the template provides it
+	if email.TextBody != "" {
+		m.SetBody("text/plain", email.TextBody)
+		m.AddAlternative("text/html", email.Body)
+	} else {
+		m.SetBody("text/html", email.Body)
+	}
+	utils.AddAttachments(m, inlineAssets)
+	utils.AddAttachments(m, email.Attachments)
+
+	return m
+}
+
+// recordDeliveryEvent appends an event to the delivery log through appendDeliveryEvent.
+// Failing to record an event is logged but does not fail the send.
+func (s *EmailManagerService) recordDeliveryEvent(event utils.DeliveryEvent, eventType string, detail string) {
+	if err := s.appendDeliveryEvent(event, eventType, detail); err != nil {
+		log.Printf("Failed to record the %s event of message %s: %s", eventType, event.MessageID, err)
+	}
+}
+
+// appendDeliveryEvent appends an event to the delivery log, queues its webhook deliveries and wakes up
+// the event streams and the webhook dispatcher
+func (s *EmailManagerService) appendDeliveryEvent(event utils.DeliveryEvent, eventType string, detail string) error {
+	event.EventType = eventType
+	event.Detail = detail
+
+	eventID, err := utils.InsertDeliveryEvent(s.emailServiceDB.Db, event)
+	if err != nil {
+		return err
+	}
+
+	// fan the event out to the subscribed webhook endpoints
+	if err := utils.EnqueueWebhookDeliveries(s.emailServiceDB.Db, eventID, eventType); err != nil {
+		log.Printf("Failed to enqueue the webhook deliveries of event %d: %s", eventID, err)
+	}
+
+	s.deliveryEvents.Notify()
+
+	return nil
+}
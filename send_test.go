@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/mail"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/testutil"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// setSignedPasswordResetTemplate stores a password reset template whose links are valid for an hour
+func setSignedPasswordResetTemplate(t *testing.T, s *EmailManagerService) {
+	t.Helper()
+
+	ctx := context.Background()
+	s.config.LinkSigningKey = []byte("signing-key")
+	if _, err := s.AddRedirectOrigin(ctx, &pb.AddRedirectOriginRequest{Origin: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.SetEmailTemplate(ctx, &pb.SetEmailTemplateRequest{
+		EmailType:      pb.EmailType_PASSWORD_RESET,
+		Subject:        "Reset your password",
+		Body:           `<a href="{{.RedirectURL}}">Reset</a>`,
+		RedirectUrl:    "https://example.com/reset",
+		LinkTtlSeconds: 3600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScheduledEmailsAreSentBeforeTheirLinksExpire(t *testing.T) {
+	s := newTestService(t)
+	setSignedPasswordResetTemplate(t, s)
+	ctx := context.Background()
+
+	tooLate := timestamppb.New(time.Now().Add(2 * time.Hour))
+
+	_, err := s.SendPasswordResetEmail(ctx, &pb.SendEmailRequest{To: "user@example.com", Token: "token", SendAt: tooLate})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("SendPasswordResetEmail() = %v, expected InvalidArgument", err)
+	}
+
+	_, err = s.BatchSend(ctx, &pb.BatchSendRequest{
+		EmailType:  pb.EmailType_PASSWORD_RESET,
+		Recipients: []*pb.BatchRecipient{{To: "user@example.com", Token: "token"}},
+		SendAt:     tooLate,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("BatchSend() = %v, expected InvalidArgument", err)
+	}
+
+	stream := &fakeIngestCampaignStream{requests: []*pb.IngestCampaignRequest{
+		{CampaignName: "late", EmailType: pb.EmailType_PASSWORD_RESET, SendAt: tooLate, Recipient: &pb.BatchRecipient{To: "user@example.com", Token: "token"}},
+	}}
+	if err := s.IngestCampaign(stream); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("IngestCampaign() = %v, expected InvalidArgument", err)
+	}
+
+	if count := countRows(t, s, "email_queue"); count != 0 {
+		t.Errorf("queued %d emails, expected none", count)
+	}
+	if count := countRows(t, s, "campaigns"); count != 0 {
+		t.Errorf("created %d campaigns, expected none", count)
+	}
+
+	// an email sent within the TTL of its link is queued
+	inTime := timestamppb.New(time.Now().Add(30 * time.Minute))
+	if _, err := s.SendPasswordResetEmail(ctx, &pb.SendEmailRequest{To: "user@example.com", Token: "token", SendAt: inTime}); err != nil {
+		t.Fatal(err)
+	}
+	if count := countRows(t, s, "email_queue"); count != 1 {
+		t.Errorf("queued %d emails, expected 1", count)
+	}
+}
+
+func TestNewMessageEncodesDisplayNames(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+	}{
+		{"no display name", "", ""},
+		{"ASCII display names", "Support", `Jane "JD" Doe`},
+		{"UTF-8 display names", "Équipe Support", "Jürgen Müller"},
+		{"UTF-8 display name with specials", "Support", "Müller, Jürgen <external>"},
+		{"non-Latin display name", "サポート", "Δοκιμή"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender := (&mail.Address{Name: test.from, Address: "sender@example.com"}).String()
+			email := utils.QueuedEmail{MessageID: "message", Recipient: "user@example.com", RecipientName: test.to, Subject: "Subject", Body: "<p>Body</p>"}
+
+			var buffer bytes.Buffer
+			if _, err := newMessage(sender, email, nil).WriteTo(&buffer); err != nil {
+				t.Fatal(err)
+			}
+
+			message, err := mail.ReadMessage(&buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, header := range []struct {
+				field    string
+				expected mail.Address
+			}{
+				{"From", mail.Address{Name: test.from, Address: "sender@example.com"}},
+				{"To", mail.Address{Name: test.to, Address: "user@example.com"}},
+			} {
+				value := message.Header.Get(header.field)
+				for i := 0; i < len(value); i++ {
+					if value[i] >= 0x80 {
+						t.Errorf("the %s header %q is not encoded as per RFC 2047", header.field, value)
+						break
+					}
+				}
+
+				address, err := mail.ParseAddress(value)
+				if err != nil {
+					t.Fatalf("the %s header %q cannot be parsed: %s", header.field, value, err)
+				}
+				if *address != header.expected {
+					t.Errorf("the %s header %q is decoded as %+v, expected %+v", header.field, value, *address, header.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestSendRequiresSMTPUTF8ForUTF8Addresses(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []string
+		expected   codes.Code
+		sent       int
+	}{
+		{"without SMTPUTF8", []string{"8BITMIME"}, codes.FailedPrecondition, 0},
+		{"with SMTPUTF8", []string{"8BITMIME", "SMTPUTF8"}, codes.OK, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestService(t)
+			setMFATemplate(t, s)
+			server := testutil.NewSMTPServer(t, test.extensions...)
+			setSMTPServer(t, s, server)
+
+			_, err := s.SendMFAEmail(context.Background(), &pb.SendEmailRequest{To: "δοκιμή@example.com", Token: "token"})
+			if status.Code(err) != test.expected {
+				t.Errorf("SendMFAEmail() = %v, expected %s", err, test.expected)
+			}
+
+			messages := server.Messages()
+			if len(messages) != test.sent {
+				t.Fatalf("the server got %d messages, expected %d", len(messages), test.sent)
+			}
+			if test.sent > 0 && messages[0].To[0] != "δοκιμή@example.com" {
+				t.Errorf("the message was sent to %v, expected the UTF-8 address", messages[0].To)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/isaacwassou/email-service/database"
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// saveSettings writes the settings rows in a single transaction along with the other writes of the RPC,
+// the audit event of the change and the settings version that drops the cached settings of every replica.
+// Nothing is stored when any of the writes fails.
+func (s *EmailManagerService) saveSettings(ctx context.Context, rpc string, target string, settings map[string]string, writes func(tx *database.Tx) error) error {
+	err := utils.WithTx(ctx, s.emailServiceDB.Db, func(tx *database.Tx) error {
+		// keep the previous values for the audit log, NULL values being empty
+		previousValues, err := tx.Repository().GetSettings(ctx, settingNames(settings))
+		if err != nil {
+			return err
+		}
+		previousSettings := map[string]string{}
+		for name, value := range previousValues {
+			previousSettings[name] = value.String
+		}
+
+		if err := tx.Repository().UpsertSettings(ctx, settings); err != nil {
+			return err
+		}
+
+		if writes != nil {
+			if err := writes(tx); err != nil {
+				return err
+			}
+		}
+
+		if err := utils.InsertAuditEvent(tx, utils.NewAuditEvent(ctx, rpc, target, previousSettings, settings)); err != nil {
+			return err
+		}
+
+		return tx.Repository().IncrementSettingsVersion(ctx)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.settingsCache.Clear()
+
+	return nil
+}
+
+// templateSettings returns the settings rows a template request sets, with their new values
+func templateSettings(fields utils.EmailTemplateDBFields, in *pb.SetEmailTemplateRequest, format string) map[string]string {
+	settings := map[string]string{
+		fields.Subject:     in.Subject,
+		fields.Body:        in.Body,
+		fields.RedirectURL: in.RedirectUrl,
+		fields.Layout:      in.Layout,
+		fields.InlineCSS:   strconv.FormatBool(in.InlineCss),
+		fields.Format:      format,
+		fields.TokenParam:  in.TokenParam,
+		fields.LinkTTL:     strconv.FormatInt(in.LinkTtlSeconds, 10),
+	}
+
+	if fields.CodeLength != "" {
+		settings[fields.CodeLength] = strconv.Itoa(int(in.CodeLength))
+	}
+
+	if fields.CodeTTL != "" {
+		settings[fields.CodeTTL] = strconv.FormatInt(in.CodeTtlSeconds, 10)
+	}
+
+	return settings
+}
+
+// settingNames returns the names of the settings rows
+func settingNames(settings map[string]string) []string {
+	names := []string{}
+	for name := range settings {
+		names = append(names, name)
+	}
+
+	return names
+}
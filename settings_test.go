@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+func TestSaveSettingsRollsBackFailedWrites(t *testing.T) {
+	s := newTestServiceWithConfig(t, database.Config{MaxOpenConns: 1})
+	ctx := context.Background()
+
+	version, err := s.emailServiceDB.Db.Repository().GetSettingsVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the settings are written before the failing write of the transaction
+	errWrite := errors.New("write failed")
+	err = s.saveSettings(ctx, "SetSMTPCredentials", "SMTP", map[string]string{"SMTP_HOST": "smtp.example.com"}, func(tx *database.Tx) error {
+		return errWrite
+	})
+	if !errors.Is(err, errWrite) {
+		t.Errorf("saveSettings() = %v, expected the error of the write", err)
+	}
+
+	// the connection was released
+	timeoutCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	settings, err := s.emailServiceDB.Db.Repository().GetSettings(timeoutCtx, []string{"SMTP_HOST"})
+	if err != nil {
+		t.Fatalf("the connection was not released: %s", err)
+	}
+
+	if settings["SMTP_HOST"].String != "" {
+		t.Errorf("the SMTP host %q was stored", settings["SMTP_HOST"].String)
+	}
+	if count := countRows(t, s, "audit_events"); count != 0 {
+		t.Errorf("recorded %d audit events, expected none", count)
+	}
+	if current, err := s.emailServiceDB.Db.Repository().GetSettingsVersion(ctx); err != nil || current != version {
+		t.Errorf("GetSettingsVersion() = %d, %v, expected the version %d to be kept", current, err, version)
+	}
+}
@@ -0,0 +1,193 @@
+package testutil
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/gomail.v2"
+)
+
+// SMTPMessage is a message accepted by an SMTPServer
+type SMTPMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// SMTPServer is an SMTP server on a local port accepting every message, which it records. It advertises
+// the extensions it is created with in its EHLO response, and neither TLS nor authentication.
+type SMTPServer struct {
+	Host string
+	Port int
+
+	listener   net.Listener
+	extensions []string
+
+	mu          sync.Mutex
+	conns       map[net.Conn]bool
+	connections int
+	messages    []SMTPMessage
+}
+
+// NewSMTPServer starts an SMTP server advertising extensions, stopped when the test ends
+func NewSMTPServer(t testing.TB, extensions ...string) *SMTPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &SMTPServer{
+		Host:       "127.0.0.1",
+		Port:       listener.Addr().(*net.TCPAddr).Port,
+		listener:   listener,
+		extensions: extensions,
+		conns:      map[net.Conn]bool{},
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		server.CloseConnections()
+	})
+
+	go server.serve()
+
+	return server
+}
+
+// Dialer returns a dialer connecting to the server
+func (s *SMTPServer) Dialer() *gomail.Dialer {
+	return &gomail.Dialer{Host: s.Host, Port: s.Port}
+}
+
+// Messages returns the messages accepted so far
+func (s *SMTPServer) Messages() []SMTPMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]SMTPMessage{}, s.messages...)
+}
+
+// Connections returns the number of connections accepted so far
+func (s *SMTPServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connections
+}
+
+// CloseConnections closes the open connections, as a server dropping its idle connections does
+func (s *SMTPServer) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = map[net.Conn]bool{}
+}
+
+func (s *SMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.connections++
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+// handle speaks enough of SMTP for net/smtp to send messages over the connection
+func (s *SMTPServer) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	text := textproto.NewConn(conn)
+	reply := func(format string, args ...any) bool {
+		return text.PrintfLine(format, args...) == nil
+	}
+
+	if !reply("220 %s ESMTP", s.Host) {
+		return
+	}
+
+	message := SMTPMessage{}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, argument, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(command) {
+		case "EHLO":
+			lines := append([]string{s.Host}, s.extensions...)
+			for i, extension := range lines {
+				separator := "-"
+				if i == len(lines)-1 {
+					separator = " "
+				}
+				if !reply("250%s%s", separator, extension) {
+					return
+				}
+			}
+		case "HELO", "NOOP":
+			reply("250 OK")
+		case "MAIL":
+			message = SMTPMessage{From: addressArgument(argument)}
+			reply("250 OK")
+		case "RCPT":
+			message.To = append(message.To, addressArgument(argument))
+			reply("250 OK")
+		case "DATA":
+			if !reply("354 Go ahead") {
+				return
+			}
+			data, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			message.Data = string(data)
+
+			s.mu.Lock()
+			s.messages = append(s.messages, message)
+			s.mu.Unlock()
+
+			reply("250 OK")
+		case "RSET":
+			message = SMTPMessage{}
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 command %s not implemented", command)
+		}
+	}
+}
+
+// addressArgument returns the address of a MAIL FROM:<address> or RCPT TO:<address> argument
+func addressArgument(argument string) string {
+	start := strings.Index(argument, "<")
+	end := strings.Index(argument, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+
+	return argument[start+1 : end]
+}
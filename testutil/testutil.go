@@ -0,0 +1,46 @@
+// Package testutil holds the fixtures shared by the tests of the service and of its packages
+package testutil
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	"github.com/isaacwassou/email-service/database"
+	pbCrypto "github.com/isaacwassou/email-service/protobufs/cryptography_service"
+)
+
+// NewDB returns a migrated SQLite database with the pool settings of config, removed when the test ends
+func NewDB(t testing.TB, config database.Config) *database.EmailServiceDB {
+	t.Helper()
+
+	config.Driver = "sqlite"
+	config.Path = filepath.Join(t.TempDir(), "email-service.db")
+	emailServiceDB, err := database.NewEmailServiceDB(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { emailServiceDB.Db.Close() })
+
+	if _, err := emailServiceDB.MigrateUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return emailServiceDB
+}
+
+// CryptoServiceClient encrypts by prefixing the plaintext with "encrypted:"
+type CryptoServiceClient struct {
+	pbCrypto.CryptographyManagerClient
+}
+
+func (CryptoServiceClient) Encrypt(ctx context.Context, in *pbCrypto.EncryptRequest, opts ...grpc.CallOption) (*pbCrypto.EncryptResponse, error) {
+	return &pbCrypto.EncryptResponse{Ciphertext: "encrypted:" + in.Plaintext}, nil
+}
+
+func (CryptoServiceClient) Decrypt(ctx context.Context, in *pbCrypto.DecryptRequest, opts ...grpc.CallOption) (*pbCrypto.DecryptResponse, error) {
+	return &pbCrypto.DecryptResponse{Plaintext: strings.TrimPrefix(in.Ciphertext, "encrypted:")}, nil
+}
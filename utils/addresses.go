@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/idna"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+const (
+	maxLocalPartLength = 64
+	maxAddressLength   = 254
+)
+
+// MXResolver looks up the mail servers of a domain, *net.Resolver being the implementation used outside of tests
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// NormalizeEmailAddress checks the syntax of an address, allowing UTF-8 local parts as per RFC 6531,
+// and returns it with its domain converted to lowercase punycode. A display name is dropped.
+func NormalizeEmailAddress(address string) (string, error) {
+	parsed, err := mail.ParseAddress(strings.TrimSpace(address))
+	if err != nil {
+		return "", fmt.Errorf("invalid email address %q: %s", address, err)
+	}
+
+	at := strings.LastIndex(parsed.Address, "@")
+	localPart, domain := parsed.Address[:at], parsed.Address[at+1:]
+
+	if len(localPart) > maxLocalPartLength {
+		return "", fmt.Errorf("the local part of %s exceeds %d bytes", address, maxLocalPartLength)
+	}
+
+	domain, err = NormalizeDomain(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain in %s: %s", address, err)
+	}
+
+	// quote the local part again when it needs it, as ParseAddress unquotes it
+	normalized := strings.Trim((&mail.Address{Address: localPart + "@" + domain}).String(), "<>")
+	if len(normalized) > maxAddressLength {
+		return "", fmt.Errorf("%s exceeds %d bytes", address, maxAddressLength)
+	}
+
+	return normalized, nil
+}
+
+// ParseRecipient normalizes the address of a recipient as NormalizeEmailAddress does and keeps its display name
+func ParseRecipient(to string) (mail.Address, error) {
+	parsed, err := mail.ParseAddress(strings.TrimSpace(to))
+	if err != nil {
+		return mail.Address{}, fmt.Errorf("invalid email address %q: %s", to, err)
+	}
+
+	address, err := NormalizeEmailAddress(to)
+	if err != nil {
+		return mail.Address{}, err
+	}
+
+	return mail.Address{Name: parsed.Name, Address: address}, nil
+}
+
+// NormalizeDomain converts a domain name to lowercase punycode, rejecting address literals and single labels
+func NormalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if strings.HasPrefix(domain, "[") {
+		return "", errors.New("address literals are not accepted")
+	}
+
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.Contains(ascii, ".") {
+		return "", fmt.Errorf("%s is not a fully qualified domain", domain)
+	}
+
+	return strings.ToLower(ascii), nil
+}
+
+// HasMailServer reports whether a domain accepts email, through its MX records or through its address
+// records when it has none. A null MX record, as per RFC 7505, means the domain does not accept email.
+func HasMailServer(ctx context.Context, resolver MXResolver, domain string) (bool, error) {
+	mxs, err := resolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return false, err
+	}
+
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return false, nil
+	}
+	if len(mxs) > 0 {
+		return true, nil
+	}
+
+	// fall back to the implicit MX of the domain
+	hosts, err := resolver.LookupHost(ctx, domain)
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return len(hosts) > 0, nil
+}
+
+// IsDisposableDomain reports whether the domain, or a domain it is a subdomain of, is in the disposable domains list
+func IsDisposableDomain(db *database.DB, domain string) (bool, error) {
+	candidates := []any{}
+	for labels := strings.Split(domain, "."); len(labels) > 1; labels = labels[1:] {
+		candidates = append(candidates, strings.Join(labels, "."))
+	}
+
+	if len(candidates) == 0 {
+		return false, nil
+	}
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM disposable_domains WHERE domain IN ("+placeholders(len(candidates))+")", candidates...).Scan(&count)
+
+	return count > 0, err
+}
+
+// ReplaceDisposableDomains replaces the disposable domains list
+func ReplaceDisposableDomains(db *database.DB, domains []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM disposable_domains"); err != nil {
+		return err
+	}
+
+	query := tx.Dialect.InsertIgnore("disposable_domains", []string{"domain"})
+	for _, domain := range domains {
+		if _, err := tx.Exec(query, domain); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeEmailAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		expected string
+	}{
+		{"lowercases the domain", "User@Example.COM", "User@example.com"},
+		{"converts an IDN to punycode", "user@bücher.example", "user@xn--bcher-kva.example"},
+		{"keeps a punycode domain", "user@xn--bcher-kva.example", "user@xn--bcher-kva.example"},
+		{"keeps a UTF-8 local part", "josé@Exämple.com", "josé@xn--exmple-cua.com"},
+		{"keeps a UTF-8 address", "用户@例子.广告", "用户@xn--fsqu00a.xn--4rr70v"},
+		{"drops the display name", "Jane Doe <jane@example.com>", "jane@example.com"},
+		{"keeps a quoted local part quoted", `"quoted local"@example.com`, `"quoted local"@example.com`},
+		{"trims spaces", "  user@example.com ", "user@example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			normalized, err := NormalizeEmailAddress(test.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if normalized != test.expected {
+				t.Errorf("NormalizeEmailAddress(%q) = %q, expected %q", test.address, normalized, test.expected)
+			}
+		})
+	}
+}
+
+func TestNormalizeEmailAddressRejectsMalformedAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+	}{
+		{"empty", ""},
+		{"no at sign", "plainaddress"},
+		{"no local part", "@example.com"},
+		{"no domain", "user@"},
+		{"two at signs", "user@@example.com"},
+		{"space in the local part", "us er@example.com"},
+		{"space in the domain", "user@exa mple.com"},
+		{"empty label", "user@example..com"},
+		{"label starting with a hyphen", "user@-example.com"},
+		{"single label domain", "user@localhost"},
+		{"address literal", "user@[127.0.0.1]"},
+		{"local part over 64 bytes", strings.Repeat("a", 65) + "@example.com"},
+		{"address over 254 bytes", strings.Repeat("u", 64) + "@" + strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + "." + strings.Repeat("c", 60) + "." + strings.Repeat("d", 60) + ".com"},
+		{"two addresses", "first@example.com, second@example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if normalized, err := NormalizeEmailAddress(test.address); err == nil {
+				t.Errorf("NormalizeEmailAddress(%q) = %q, expected an error", test.address, normalized)
+			}
+		})
+	}
+}
+
+func TestParseRecipient(t *testing.T) {
+	tests := []struct {
+		to       string
+		expected mail.Address
+	}{
+		{"user@example.com", mail.Address{Address: "user@example.com"}},
+		{"Zoë <zoe@Bücher.example>", mail.Address{Name: "Zoë", Address: "zoe@xn--bcher-kva.example"}},
+		{`"Doe, Jane" <"jane doe"@example.com>`, mail.Address{Name: "Doe, Jane", Address: `"jane doe"@example.com`}},
+	}
+
+	for _, test := range tests {
+		recipient, err := ParseRecipient(test.to)
+		if err != nil {
+			t.Errorf("ParseRecipient(%q) failed: %s", test.to, err)
+			continue
+		}
+		if recipient != test.expected {
+			t.Errorf("ParseRecipient(%q) = %+v, expected %+v", test.to, recipient, test.expected)
+		}
+	}
+}
+
+// stubMXResolver answers the lookups from its maps, a missing domain not being found
+type stubMXResolver struct {
+	mxs   map[string][]*net.MX
+	hosts map[string][]string
+	err   error
+}
+
+func (r stubMXResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	mxs, found := r.mxs[name]
+	if !found {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	return mxs, nil
+}
+
+func (r stubMXResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	hosts, found := r.hosts[host]
+	if !found {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return hosts, nil
+}
+
+func TestHasMailServer(t *testing.T) {
+	resolver := stubMXResolver{
+		mxs: map[string][]*net.MX{
+			"mx.example":      {{Host: "mail.mx.example.", Pref: 10}},
+			"null-mx.example": {{Host: ".", Pref: 0}},
+			"empty.example":   {},
+		},
+		hosts: map[string][]string{
+			"null-mx.example": {"192.0.2.1"},
+			"a-only.example":  {"192.0.2.2"},
+			"empty.example":   {"192.0.2.3"},
+		},
+	}
+
+	tests := []struct {
+		domain   string
+		expected bool
+	}{
+		{"mx.example", true},
+		{"null-mx.example", false},
+		{"a-only.example", true},
+		{"empty.example", true},
+		{"missing.example", false},
+	}
+
+	for _, test := range tests {
+		hasMailServer, err := HasMailServer(context.Background(), resolver, test.domain)
+		if err != nil {
+			t.Errorf("HasMailServer(%s) failed: %s", test.domain, err)
+			continue
+		}
+		if hasMailServer != test.expected {
+			t.Errorf("HasMailServer(%s) = %t, expected %t", test.domain, hasMailServer, test.expected)
+		}
+	}
+}
+
+func TestHasMailServerReportsLookupFailures(t *testing.T) {
+	lookupErr := &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}
+
+	if _, err := HasMailServer(context.Background(), stubMXResolver{err: lookupErr}, "example.com"); !errors.Is(err, lookupErr) {
+		t.Errorf("HasMailServer returned %v, expected the lookup error", err)
+	}
+}
+
+func TestIsDisposableDomain(t *testing.T) {
+	db := newTestDB(t)
+	if err := ReplaceDisposableDomains(db, []string{"mailinator.com", "xn--bcher-kva.example"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain   string
+		expected bool
+	}{
+		{"mailinator.com", true},
+		{"inbox.mailinator.com", true},
+		{"a.b.mailinator.com", true},
+		{"xn--bcher-kva.example", true},
+		{"notmailinator.com", false},
+		{"mailinator.com.example", false},
+		{"example.com", false},
+		{"com", false},
+	}
+
+	for _, test := range tests {
+		disposable, err := IsDisposableDomain(db, test.domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if disposable != test.expected {
+			t.Errorf("IsDisposableDomain(%s) = %t, expected %t", test.domain, disposable, test.expected)
+		}
+	}
+
+	// the list is replaced rather than extended
+	if err := ReplaceDisposableDomains(db, []string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if disposable, err := IsDisposableDomain(db, "mailinator.com"); err != nil || disposable {
+		t.Errorf("IsDisposableDomain(mailinator.com) = %t, %v after the list was replaced, expected false", disposable, err)
+	}
+}
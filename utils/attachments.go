@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/gomail.v2"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+const (
+	// MaxAttachmentSize is the largest attachment, inline asset or uploaded asset accepted
+	MaxAttachmentSize = 10 << 20
+	// MaxTotalAttachmentSize is the largest combined size of the attachments of a single email
+	MaxTotalAttachmentSize = 20 << 20
+	// MaxRequestSize is the largest gRPC request accepted, the attachments at their limit along with
+	// the rest of the request, which gRPC would otherwise reject above 4 MiB
+	MaxRequestSize = MaxTotalAttachmentSize + 4<<20
+)
+
+// allowedContentTypes lists the MIME types that can be attached to or embedded in an email
+var allowedContentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/gif":       true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/webp":      true,
+	"text/calendar":   true,
+	"text/csv":        true,
+	"text/plain":      true,
+}
+
+// Attachment is a file attached to an email, or embedded in it when it has a content ID
+type Attachment = database.Attachment
+
+// ValidateAttachment checks the filename, content type and size of an attachment
+func ValidateAttachment(attachment Attachment) error {
+	if attachment.Filename == "" || attachment.Filename != filepath.Base(attachment.Filename) || strings.ContainsAny(attachment.Filename, "\r\n\"") {
+		return fmt.Errorf("invalid attachment filename %q", attachment.Filename)
+	}
+
+	if strings.ContainsAny(attachment.ContentID, "\r\n<>") {
+		return fmt.Errorf("invalid content ID %q for %s", attachment.ContentID, attachment.Filename)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(attachment.ContentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type %q for %s", attachment.ContentType, attachment.Filename)
+	}
+
+	if !allowedContentTypes[mediaType] {
+		return fmt.Errorf("content type %s of %s is not allowed", mediaType, attachment.Filename)
+	}
+
+	if len(attachment.Content) == 0 {
+		return fmt.Errorf("attachment %s is empty", attachment.Filename)
+	}
+
+	if len(attachment.Content) > MaxAttachmentSize {
+		return fmt.Errorf("attachment %s exceeds the %d bytes limit", attachment.Filename, MaxAttachmentSize)
+	}
+
+	return nil
+}
+
+// ValidateAttachments checks every attachment of an email and their combined size
+func ValidateAttachments(attachments []Attachment) error {
+	total := 0
+	for _, attachment := range attachments {
+		if err := ValidateAttachment(attachment); err != nil {
+			return err
+		}
+		total += len(attachment.Content)
+	}
+
+	if total > MaxTotalAttachmentSize {
+		return fmt.Errorf("attachments exceed the %d bytes limit", MaxTotalAttachmentSize)
+	}
+
+	return nil
+}
+
+// AddAttachments attaches the files to the message, embedding the ones with a content ID
+// so the body can reference them as cid:<content ID>
+func AddAttachments(m *gomail.Message, attachments []Attachment) {
+	for _, attachment := range attachments {
+		content := attachment.Content
+		settings := []gomail.FileSetting{
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := io.Copy(w, bytes.NewReader(content))
+				return err
+			}),
+			gomail.SetHeader(map[string][]string{
+				"Content-Type": {mime.FormatMediaType(attachment.ContentType, map[string]string{"name": attachment.Filename})},
+			}),
+		}
+
+		if attachment.ContentID == "" {
+			m.Attach(attachment.Filename, settings...)
+			continue
+		}
+
+		settings = append(settings, gomail.SetHeader(map[string][]string{"Content-ID": {"<" + attachment.ContentID + ">"}}))
+		m.Embed(attachment.Filename, settings...)
+	}
+}
+
+// InsertAsset stores a file that emails can attach through its name
+func InsertAsset(db *database.DB, name string, attachment Attachment) error {
+	_, err := db.Exec(
+		db.Dialect.Upsert("assets", []string{"name", "filename", "content_type", "content"}, []string{"name"}, []string{"filename", "content_type", "content"}),
+		name,
+		attachment.Filename,
+		attachment.ContentType,
+		attachment.Content,
+	)
+
+	return err
+}
+
+// GetAsset loads a stored file by its name
+func GetAsset(db *database.DB, name string) (Attachment, error) {
+	attachment := Attachment{}
+	err := db.QueryRow(
+		"SELECT filename, content_type, content FROM assets WHERE name = ?",
+		name,
+	).Scan(&attachment.Filename, &attachment.ContentType, &attachment.Content)
+
+	return attachment, err
+}
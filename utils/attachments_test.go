@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/gomail.v2"
+)
+
+func TestValidateAttachment(t *testing.T) {
+	valid := Attachment{Filename: "invoice.pdf", ContentType: "application/pdf", Content: []byte("%PDF-1.7")}
+
+	tests := []struct {
+		name   string
+		change func(attachment *Attachment)
+		valid  bool
+	}{
+		{"valid", func(attachment *Attachment) {}, true},
+		{"content type with parameters", func(attachment *Attachment) {
+			attachment.ContentType = "text/plain; charset=utf-8"
+		}, true},
+		{"inline image", func(attachment *Attachment) {
+			attachment.ContentType, attachment.ContentID = "image/png", "logo"
+		}, true},
+		{"content at the size limit", func(attachment *Attachment) {
+			attachment.Content = make([]byte, MaxAttachmentSize)
+		}, true},
+		{"content over the size limit", func(attachment *Attachment) {
+			attachment.Content = make([]byte, MaxAttachmentSize+1)
+		}, false},
+		{"empty content", func(attachment *Attachment) { attachment.Content = nil }, false},
+		{"HTML", func(attachment *Attachment) { attachment.ContentType = "text/html" }, false},
+		{"executable", func(attachment *Attachment) { attachment.ContentType = "application/x-msdownload" }, false},
+		{"archive", func(attachment *Attachment) { attachment.ContentType = "application/zip" }, false},
+		{"malformed content type", func(attachment *Attachment) { attachment.ContentType = "pdf" }, false},
+		{"missing filename", func(attachment *Attachment) { attachment.Filename = "" }, false},
+		{"filename with a path", func(attachment *Attachment) { attachment.Filename = "../invoice.pdf" }, false},
+		{"filename with a quote", func(attachment *Attachment) { attachment.Filename = `invoice".pdf` }, false},
+		{"filename with a line break", func(attachment *Attachment) { attachment.Filename = "invoice\r\nBcc: user@example.com" }, false},
+		{"content ID with angle brackets", func(attachment *Attachment) { attachment.ContentID = "<logo>" }, false},
+		{"content ID with a line break", func(attachment *Attachment) { attachment.ContentID = "logo\nBcc: user@example.com" }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attachment := valid
+			test.change(&attachment)
+
+			err := ValidateAttachment(attachment)
+			if test.valid && err != nil {
+				t.Errorf("ValidateAttachment() = %v, expected the attachment to be valid", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("ValidateAttachment() succeeded, expected an error")
+			}
+		})
+	}
+}
+
+func TestValidateAttachmentsTotalSize(t *testing.T) {
+	attachment := func(size int) Attachment {
+		return Attachment{Filename: "file.txt", ContentType: "text/plain", Content: make([]byte, size)}
+	}
+
+	if err := ValidateAttachments([]Attachment{attachment(MaxAttachmentSize), attachment(MaxTotalAttachmentSize - MaxAttachmentSize)}); err != nil {
+		t.Errorf("ValidateAttachments() = %v at the total size limit, expected no error", err)
+	}
+	if err := ValidateAttachments([]Attachment{attachment(MaxAttachmentSize), attachment(MaxAttachmentSize), attachment(1)}); err == nil {
+		t.Error("ValidateAttachments() succeeded over the total size limit, expected an error")
+	}
+	if err := ValidateAttachments([]Attachment{attachment(1), {Filename: "page.html", ContentType: "text/html", Content: []byte("<p>")}}); err == nil {
+		t.Error("ValidateAttachments() succeeded with an attachment that is not allowed, expected an error")
+	}
+
+	// gRPC must accept a request carrying the attachments at their limit
+	if MaxRequestSize <= MaxTotalAttachmentSize {
+		t.Errorf("MaxRequestSize is %d, expected it to exceed MaxTotalAttachmentSize %d", MaxRequestSize, MaxTotalAttachmentSize)
+	}
+}
+
+func TestAddAttachmentsEmbedsContentIDs(t *testing.T) {
+	m := gomail.NewMessage()
+	m.SetHeader("From", "sender@example.com")
+	m.SetHeader("To", "user@example.com")
+	m.SetBody("text/html", `<img src="cid:logo">`)
+	AddAttachments(m, []Attachment{
+		{Filename: "logo.png", ContentType: "image/png", ContentID: "logo", Content: []byte("png")},
+		{Filename: "invoice.pdf", ContentType: "application/pdf", Content: []byte("pdf")},
+	})
+
+	var buffer bytes.Buffer
+	if _, err := m.WriteTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	message := buffer.String()
+
+	for _, expected := range []string{
+		"Content-Type: multipart/related",
+		"Content-ID: <logo>",
+		`Content-Disposition: inline; filename="logo.png"`,
+		"Content-Type: image/png; name=logo.png",
+		`Content-Disposition: attachment; filename="invoice.pdf"`,
+		"Content-Type: application/pdf; name=invoice.pdf",
+	} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("the message does not contain %s:\n%s", expected, message)
+		}
+	}
+	if strings.Count(message, "Content-ID:") != 1 {
+		t.Errorf("the message has more than one content ID, expected only the inline asset to have one:\n%s", message)
+	}
+}
+
+func TestAssets(t *testing.T) {
+	db := newTestDB(t)
+
+	logo := Attachment{Filename: "logo.png", ContentType: "image/png", Content: []byte("png")}
+	if err := InsertAsset(db, "logo", logo); err != nil {
+		t.Fatal(err)
+	}
+	// uploading under the same name replaces the asset
+	logo.Content = []byte("new png")
+	if err := InsertAsset(db, "logo", logo); err != nil {
+		t.Fatal(err)
+	}
+	if asset, err := GetAsset(db, "logo"); err != nil || !reflect.DeepEqual(asset, logo) {
+		t.Errorf("GetAsset() = %+v, %v, expected %+v", asset, err, logo)
+	}
+}
@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/peer"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+// RedactedValue replaces the secrets in the values recorded by the audit log
+const RedactedValue = "[redacted]"
+
+// Execer is implemented by *database.DB and *database.Tx, so an audit event can be written in the transaction of the change
+type Execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// AuditEvent is a configuration change made through an RPC. Before and After only hold the values that changed.
+type AuditEvent struct {
+	ID        int64
+	Actor     string
+	RPC       string
+	Target    string
+	Before    map[string]string
+	After     map[string]string
+	CallerIP  string
+	CreatedAt time.Time
+}
+
+type AuditEventFilter struct {
+	Actor  string
+	RPC    string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	// BeforeID only returns the events older than this ID, to page through the log
+	BeforeID int64
+}
+
+// NewAuditEvent describes a change made by the caller of the RPC in ctx. The values that did not change are
+// dropped and the secrets, the values whose name ends with PASSWORD or SECRET, are redacted.
+func NewAuditEvent(ctx context.Context, rpc string, target string, before map[string]string, after map[string]string) AuditEvent {
+	event := AuditEvent{
+		Actor:    "anonymous",
+		RPC:      rpc,
+		Target:   target,
+		Before:   map[string]string{},
+		After:    map[string]string{},
+		CallerIP: "unknown",
+	}
+
+	if principal, found := PrincipalFromContext(ctx); found {
+		event.Actor = principal.Subject
+	}
+
+	if p, found := peer.FromContext(ctx); found {
+		event.CallerIP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(event.CallerIP); err == nil {
+			event.CallerIP = host
+		}
+	}
+
+	for name, value := range before {
+		if afterValue, found := after[name]; !found || afterValue != value {
+			event.Before[name] = redactAuditValue(name, value)
+		}
+	}
+	for name, value := range after {
+		if beforeValue, found := before[name]; !found || beforeValue != value {
+			event.After[name] = redactAuditValue(name, value)
+		}
+	}
+
+	return event
+}
+
+func redactAuditValue(name string, value string) string {
+	name = strings.ToUpper(name)
+	if value != "" && (strings.HasSuffix(name, "PASSWORD") || strings.HasSuffix(name, "SECRET")) {
+		return RedactedValue
+	}
+
+	return value
+}
+
+// InsertAuditEvent appends an event to the audit log. The log is append-only, nothing updates or deletes its rows.
+func InsertAuditEvent(db Execer, event AuditEvent) error {
+	before, err := json.Marshal(event.Before)
+	if err != nil {
+		return err
+	}
+
+	after, err := json.Marshal(event.After)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO audit_events (actor, rpc, target, before_values, after_values, caller_ip) VALUES (?, ?, ?, ?, ?, ?)",
+		event.Actor,
+		event.RPC,
+		event.Target,
+		before,
+		after,
+		event.CallerIP,
+	)
+
+	return err
+}
+
+// GetAuditEvents returns up to limit events matching the filter, newest first
+func GetAuditEvents(db *database.DB, filter AuditEventFilter, limit int) ([]AuditEvent, error) {
+	query := "SELECT id, actor, rpc, target, before_values, after_values, caller_ip, created_at FROM audit_events WHERE 1 = 1"
+	args := []any{}
+
+	if filter.Actor != "" {
+		query += " AND actor = ?"
+		args = append(args, filter.Actor)
+	}
+
+	if filter.RPC != "" {
+		query += " AND rpc = ?"
+		args = append(args, filter.RPC)
+	}
+
+	if filter.Target != "" {
+		query += " AND target = ?"
+		args = append(args, filter.Target)
+	}
+
+	if !filter.Since.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, filter.Since)
+	}
+
+	if !filter.Until.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, filter.Until)
+	}
+
+	if filter.BeforeID > 0 {
+		query += " AND id < ?"
+		args = append(args, filter.BeforeID)
+	}
+
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var event AuditEvent
+		var before, after []byte
+		var createdAt sql.NullTime
+		if err := rows.Scan(&event.ID, &event.Actor, &event.RPC, &event.Target, &before, &after, &event.CallerIP, &createdAt); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(before, &event.Before); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(after, &event.After); err != nil {
+			return nil, err
+		}
+
+		event.CreatedAt = createdAt.Time
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/peer"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+func TestNewAuditEvent(t *testing.T) {
+	tests := []struct {
+		name           string
+		before         map[string]string
+		after          map[string]string
+		expectedBefore map[string]string
+		expectedAfter  map[string]string
+	}{
+		{
+			"unchanged values dropped",
+			map[string]string{"SMTP_HOST": "smtp.example.com", "SMTP_PORT": "25"},
+			map[string]string{"SMTP_HOST": "smtp.example.com", "SMTP_PORT": "587"},
+			map[string]string{"SMTP_PORT": "25"},
+			map[string]string{"SMTP_PORT": "587"},
+		},
+		{
+			"added and removed values",
+			map[string]string{"removed": "value"},
+			map[string]string{"added": "value"},
+			map[string]string{"removed": "value"},
+			map[string]string{"added": "value"},
+		},
+		{
+			"no change",
+			map[string]string{"SMTP_HOST": "smtp.example.com"},
+			map[string]string{"SMTP_HOST": "smtp.example.com"},
+			map[string]string{},
+			map[string]string{},
+		},
+		{
+			"secrets redacted",
+			map[string]string{"SMTP_PASSWORD": "old-password", "webhook_secret": "old-secret"},
+			map[string]string{"SMTP_PASSWORD": "new-password", "webhook_secret": "new-secret"},
+			map[string]string{"SMTP_PASSWORD": RedactedValue, "webhook_secret": RedactedValue},
+			map[string]string{"SMTP_PASSWORD": RedactedValue, "webhook_secret": RedactedValue},
+		},
+		{
+			"unset secret shown as empty",
+			map[string]string{"SMTP_PASSWORD": ""},
+			map[string]string{"SMTP_PASSWORD": "password"},
+			map[string]string{"SMTP_PASSWORD": ""},
+			map[string]string{"SMTP_PASSWORD": RedactedValue},
+		},
+		{
+			"unchanged secret dropped",
+			map[string]string{"SMTP_PASSWORD": "password", "SMTP_USER": "old"},
+			map[string]string{"SMTP_PASSWORD": "password", "SMTP_USER": "new"},
+			map[string]string{"SMTP_USER": "old"},
+			map[string]string{"SMTP_USER": "new"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := NewAuditEvent(context.Background(), "SetSMTPCredentials", "SMTP", test.before, test.after)
+
+			if !reflect.DeepEqual(event.Before, test.expectedBefore) {
+				t.Errorf("Before = %v, expected %v", event.Before, test.expectedBefore)
+			}
+			if !reflect.DeepEqual(event.After, test.expectedAfter) {
+				t.Errorf("After = %v, expected %v", event.After, test.expectedAfter)
+			}
+		})
+	}
+}
+
+func TestNewAuditEventCaller(t *testing.T) {
+	event := NewAuditEvent(context.Background(), "SetSMTPCredentials", "SMTP", nil, nil)
+	if event.Actor != "anonymous" || event.CallerIP != "unknown" {
+		t.Errorf("the caller is %s at %s, expected an anonymous caller at an unknown address", event.Actor, event.CallerIP)
+	}
+
+	ctx := context.WithValue(context.Background(), principalKey{}, Principal{Subject: "admin@example.com"})
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 41000}})
+
+	event = NewAuditEvent(ctx, "SetSMTPCredentials", "SMTP", nil, nil)
+	if event.Actor != "admin@example.com" || event.CallerIP != "192.0.2.10" {
+		t.Errorf("the caller is %s at %s, expected admin@example.com at 192.0.2.10", event.Actor, event.CallerIP)
+	}
+}
+
+// insertAuditEvents stores the events with their creation time, returning their IDs
+func insertAuditEvents(t *testing.T, db *database.DB, events []AuditEvent) []int64 {
+	t.Helper()
+
+	ids := []int64{}
+	for _, event := range events {
+		if err := InsertAuditEvent(db, event); err != nil {
+			t.Fatal(err)
+		}
+
+		var id int64
+		if err := db.QueryRow("SELECT MAX(id) FROM audit_events").Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("UPDATE audit_events SET created_at = ? WHERE id = ?", event.CreatedAt.UTC(), id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func TestGetAuditEvents(t *testing.T) {
+	db := newTestDB(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	ids := insertAuditEvents(t, db, []AuditEvent{
+		{Actor: "alice", RPC: "SetSMTPCredentials", Target: "SMTP", CreatedAt: start},
+		{Actor: "bob", RPC: "SetEmailTemplate", Target: "MFA", CreatedAt: start.Add(time.Hour)},
+		{Actor: "alice", RPC: "SetEmailTemplate", Target: "PASSWORD_RESET", CreatedAt: start.Add(2 * time.Hour)},
+		{Actor: "alice", RPC: "SetEmailTemplate", Target: "MFA", CreatedAt: start.Add(3 * time.Hour)},
+	})
+
+	tests := []struct {
+		name     string
+		filter   AuditEventFilter
+		expected []int64
+	}{
+		{"no filter", AuditEventFilter{}, []int64{ids[3], ids[2], ids[1], ids[0]}},
+		{"actor", AuditEventFilter{Actor: "alice"}, []int64{ids[3], ids[2], ids[0]}},
+		{"RPC", AuditEventFilter{RPC: "SetEmailTemplate"}, []int64{ids[3], ids[2], ids[1]}},
+		{"target", AuditEventFilter{Target: "MFA"}, []int64{ids[3], ids[1]}},
+		{"combined filters", AuditEventFilter{Actor: "alice", RPC: "SetEmailTemplate", Target: "MFA"}, []int64{ids[3]}},
+		{"since", AuditEventFilter{Since: start.Add(time.Hour)}, []int64{ids[3], ids[2], ids[1]}},
+		{"until", AuditEventFilter{Until: start.Add(time.Hour)}, []int64{ids[0]}},
+		{"time range", AuditEventFilter{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, []int64{ids[2], ids[1]}},
+		{"before ID", AuditEventFilter{BeforeID: ids[2]}, []int64{ids[1], ids[0]}},
+		{"no match", AuditEventFilter{Actor: "carol"}, []int64{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, err := GetAuditEvents(db, test.filter, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			found := []int64{}
+			for _, event := range events {
+				found = append(found, event.ID)
+			}
+			if !reflect.DeepEqual(found, test.expected) {
+				t.Errorf("GetAuditEvents() returned the events %v, expected %v", found, test.expected)
+			}
+		})
+	}
+
+	if events, err := GetAuditEvents(db, AuditEventFilter{}, 2); err != nil || len(events) != 2 || events[0].ID != ids[3] {
+		t.Errorf("GetAuditEvents() with a limit of 2 returned %+v, %v, expected the 2 newest events", events, err)
+	}
+}
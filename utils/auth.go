@@ -0,0 +1,268 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// RoleSender is allowed to send emails and to check the codes and links they carry
+	RoleSender = "sender"
+	// RoleAdmin is allowed to call every RPC, including the ones changing the configuration
+	RoleAdmin = "admin"
+)
+
+// Principal is the authenticated caller of an RPC
+type Principal struct {
+	Subject string
+	Roles   []string
+}
+
+// HasRole reports whether the principal has the role, admins having every role
+func (p Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the caller authenticated by the interceptors
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, found := ctx.Value(principalKey{}).(Principal)
+	return principal, found
+}
+
+type apiKey struct {
+	hash      []byte
+	principal Principal
+}
+
+// Authenticator authenticates the callers through a JWT in the authorization metadata, verified
+// against a JWKS, or through an API key in the x-api-key metadata
+type Authenticator struct {
+	apiKeys    []apiKey
+	jwks       *JWKS
+	issuer     string
+	audience   string
+	rolesClaim string
+}
+
+// NewAuthenticator configures the authentication: AUTH_JWKS_URL or AUTH_JWKS_FILE, AUTH_JWT_ISSUER,
+// AUTH_JWT_AUDIENCE and AUTH_JWT_ROLES_CLAIM for JWTs, and AUTH_API_KEYS_FILE for API keys. It returns nil
+// when AUTH_DISABLED is true, and an error when neither JWTs nor API keys are configured.
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	if config.Disabled {
+		return nil, nil
+	}
+
+	authenticator := &Authenticator{
+		issuer:     config.JWTIssuer,
+		audience:   config.JWTAudience,
+		rolesClaim: config.JWTRolesClaim,
+	}
+	if authenticator.rolesClaim == "" {
+		authenticator.rolesClaim = "roles"
+	}
+
+	jwksSource := config.JWKSURL
+	if jwksSource == "" {
+		jwksSource = config.JWKSFile
+	}
+	if jwksSource != "" {
+		jwks, err := NewJWKS(jwksSource)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the JWKS: %w", err)
+		}
+		authenticator.jwks = jwks
+	}
+
+	if path := config.APIKeysFile; path != "" {
+		apiKeys, err := loadAPIKeys(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the API keys: %w", err)
+		}
+		authenticator.apiKeys = apiKeys
+	}
+
+	if authenticator.jwks == nil && len(authenticator.apiKeys) == 0 {
+		return nil, errors.New("no authentication is configured, set AUTH_JWKS_URL, AUTH_JWKS_FILE or AUTH_API_KEYS_FILE, or AUTH_DISABLED=true")
+	}
+
+	return authenticator, nil
+}
+
+// loadAPIKeys reads a file with one "<name> <role>[,<role>] <hex SHA-256 of the key>" line per API key,
+// ignoring the empty lines and the ones starting with #
+func loadAPIKeys(path string) ([]apiKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	apiKeys := []apiKey{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected a name, roles and a key hash", line)
+		}
+
+		hash, err := hex.DecodeString(fields[2])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("line %d: the key hash is not a hex SHA-256", line)
+		}
+
+		apiKeys = append(apiKeys, apiKey{
+			hash:      hash,
+			principal: Principal{Subject: fields[0], Roles: strings.Split(fields[1], ",")},
+		})
+	}
+
+	return apiKeys, scanner.Err()
+}
+
+// Authenticate returns the caller of an RPC from its metadata
+func (a *Authenticator) Authenticate(ctx context.Context) (Principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if values := md.Get("x-api-key"); len(values) > 0 {
+		return a.authenticateAPIKey(values[0])
+	}
+
+	if values := md.Get("authorization"); len(values) > 0 {
+		token, found := strings.CutPrefix(values[0], "Bearer ")
+		if !found {
+			return Principal{}, errors.New("the authorization metadata is not a bearer token")
+		}
+		return a.authenticateJWT(token)
+	}
+
+	return Principal{}, errors.New("missing credentials")
+}
+
+func (a *Authenticator) authenticateAPIKey(key string) (Principal, error) {
+	hash := sha256.Sum256([]byte(key))
+	for _, apiKey := range a.apiKeys {
+		if subtle.ConstantTimeCompare(hash[:], apiKey.hash) == 1 {
+			return apiKey.principal, nil
+		}
+	}
+
+	return Principal{}, errors.New("invalid API key")
+}
+
+func (a *Authenticator) authenticateJWT(token string) (Principal, error) {
+	if a.jwks == nil {
+		return Principal{}, errors.New("JWT authentication is not configured")
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if a.issuer != "" {
+		options = append(options, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		options = append(options, jwt.WithAudience(a.audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return a.jwks.Key(kid)
+	}, options...)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	subject, _ := claims.GetSubject()
+	principal := Principal{Subject: subject}
+
+	// the roles are either a list or a space separated string
+	switch roles := claims[a.rolesClaim].(type) {
+	case string:
+		principal.Roles = strings.Fields(roles)
+	case []any:
+		for _, role := range roles {
+			if name, ok := role.(string); ok {
+				principal.Roles = append(principal.Roles, name)
+			}
+		}
+	}
+
+	return principal, nil
+}
+
+// authorize authenticates the caller and checks it has the role the method requires
+func (a *Authenticator) authorize(ctx context.Context, fullMethod string, requiredRole func(string) string) (context.Context, error) {
+	principal, err := a.Authenticate(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	role := requiredRole(fullMethod)
+	if !principal.HasRole(role) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s requires the %s role", fullMethod, role)
+	}
+
+	return context.WithValue(ctx, principalKey{}, principal), nil
+}
+
+// UnaryServerInterceptor rejects the unary calls of callers without the role requiredRole returns for the method
+func (a *Authenticator) UnaryServerInterceptor(requiredRole func(fullMethod string) string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := a.authorize(ctx, info.FullMethod, requiredRole)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor rejects the streaming calls of callers without the role requiredRole returns for the method
+func (a *Authenticator) StreamServerInterceptor(requiredRole func(fullMethod string) string) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authorize(stream.Context(), info.FullMethod, requiredRole)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// authenticatedStream carries the principal in the context of a streaming call
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// signToken returns a JWT signed with the key
+func signToken(t *testing.T, key *ecdsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+// writeAPIKeysFile writes an API keys file holding the lines and returns its path
+func writeAPIKeysFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "api_keys")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// withMetadata returns a context carrying the incoming metadata of a call
+func withMetadata(pairs ...string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(pairs...))
+}
+
+func TestAuthenticateJWT(t *testing.T) {
+	key, jwk := newTestKey(t, "key")
+	otherKey, _ := newTestKey(t, "key")
+
+	authenticator, err := NewAuthenticator(AuthConfig{
+		JWKSFile:    writeJWKSFile(t, jwk),
+		JWTIssuer:   "https://issuer.example.com",
+		JWTAudience: "email-service",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(change func(claims jwt.MapClaims)) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"sub":   "auth-service",
+			"iss":   "https://issuer.example.com",
+			"aud":   "email-service",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"roles": []string{RoleSender},
+		}
+		change(claims)
+		return claims
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		expected *Principal
+	}{
+		{"valid", signToken(t, key, "key", claims(func(jwt.MapClaims) {})), &Principal{Subject: "auth-service", Roles: []string{RoleSender}}},
+		{"space separated roles", signToken(t, key, "key", claims(func(c jwt.MapClaims) { c["roles"] = "sender admin" })), &Principal{Subject: "auth-service", Roles: []string{RoleSender, RoleAdmin}}},
+		{"no roles", signToken(t, key, "key", claims(func(c jwt.MapClaims) { delete(c, "roles") })), &Principal{Subject: "auth-service"}},
+		{"expired", signToken(t, key, "key", claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() })), nil},
+		{"no expiry", signToken(t, key, "key", claims(func(c jwt.MapClaims) { delete(c, "exp") })), nil},
+		{"wrong audience", signToken(t, key, "key", claims(func(c jwt.MapClaims) { c["aud"] = "other-service" })), nil},
+		{"wrong issuer", signToken(t, key, "key", claims(func(c jwt.MapClaims) { c["iss"] = "https://other.example.com" })), nil},
+		{"unknown key ID", signToken(t, key, "other", claims(func(jwt.MapClaims) {})), nil},
+		{"signed by another key", signToken(t, otherKey, "key", claims(func(jwt.MapClaims) {})), nil},
+		{"HMAC signature", func() string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims(func(jwt.MapClaims) {})).SignedString([]byte("secret"))
+			return signed
+		}(), nil},
+		{"unsigned", func() string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodNone, claims(func(jwt.MapClaims) {})).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return signed
+		}(), nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			principal, err := authenticator.Authenticate(withMetadata("authorization", "Bearer "+test.token))
+			if test.expected == nil {
+				if err == nil {
+					t.Errorf("Authenticate() = %+v, expected an error", principal)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(principal, *test.expected) {
+				t.Errorf("Authenticate() = %+v, expected %+v", principal, *test.expected)
+			}
+		})
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	authenticator, err := NewAuthenticator(AuthConfig{
+		APIKeysFile: writeAPIKeysFile(t, "# name roles hash\n\nauth-service sender "+hashAPIKey("sender-key")+"\noperator sender,admin "+hashAPIKey("admin-key")+"\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key      string
+		expected *Principal
+	}{
+		{"sender-key", &Principal{Subject: "auth-service", Roles: []string{RoleSender}}},
+		{"admin-key", &Principal{Subject: "operator", Roles: []string{RoleSender, RoleAdmin}}},
+		{"other-key", nil},
+		{hashAPIKey("sender-key"), nil},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		principal, err := authenticator.Authenticate(withMetadata("x-api-key", test.key))
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("Authenticate(%q) = %+v, expected an error", test.key, principal)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Authenticate(%q) failed: %s", test.key, err)
+			continue
+		}
+		if !reflect.DeepEqual(principal, *test.expected) {
+			t.Errorf("Authenticate(%q) = %+v, expected %+v", test.key, principal, *test.expected)
+		}
+	}
+}
+
+func TestNewAuthenticatorRejectsInvalidConfigs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config AuthConfig
+	}{
+		{"nothing configured", AuthConfig{}},
+		{"missing JWKS file", AuthConfig{JWKSFile: filepath.Join(t.TempDir(), "missing.json")}},
+		{"plain HTTP JWKS URL", AuthConfig{JWKSURL: "http://issuer.example.com/jwks.json"}},
+		{"API key line without a hash", AuthConfig{APIKeysFile: writeAPIKeysFile(t, "auth-service sender\n")}},
+		{"API key hash that is not SHA-256", AuthConfig{APIKeysFile: writeAPIKeysFile(t, "auth-service sender abcdef\n")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewAuthenticator(test.config); err == nil {
+				t.Error("NewAuthenticator() succeeded, expected an error")
+			}
+		})
+	}
+
+	if authenticator, err := NewAuthenticator(AuthConfig{Disabled: true}); authenticator != nil || err != nil {
+		t.Errorf("NewAuthenticator() = %v, %v with the authentication disabled, expected nil", authenticator, err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	authenticator, err := NewAuthenticator(AuthConfig{
+		APIKeysFile: writeAPIKeysFile(t, "auth-service sender "+hashAPIKey("sender-key")+"\noperator admin "+hashAPIKey("admin-key")+"\nmonitoring viewer "+hashAPIKey("viewer-key")+"\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requiredRole := func(fullMethod string) string {
+		if fullMethod == "/email.EmailManager/SendMFAEmail" {
+			return RoleSender
+		}
+		return RoleAdmin
+	}
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		method string
+		code   codes.Code
+	}{
+		{"sender calling a sender method", withMetadata("x-api-key", "sender-key"), "SendMFAEmail", codes.OK},
+		{"admin calling a sender method", withMetadata("x-api-key", "admin-key"), "SendMFAEmail", codes.OK},
+		{"admin calling an admin method", withMetadata("x-api-key", "admin-key"), "SetSMTPCredentials", codes.OK},
+		{"sender calling an admin method", withMetadata("x-api-key", "sender-key"), "SetSMTPCredentials", codes.PermissionDenied},
+		{"unknown role calling a sender method", withMetadata("x-api-key", "viewer-key"), "SendMFAEmail", codes.PermissionDenied},
+		{"invalid API key", withMetadata("x-api-key", "other-key"), "SendMFAEmail", codes.Unauthenticated},
+		{"no credentials", context.Background(), "SendMFAEmail", codes.Unauthenticated},
+		{"basic authorization", withMetadata("authorization", "Basic c2VuZGVyOmtleQ=="), "SendMFAEmail", codes.Unauthenticated},
+		{"JWT without a JWKS", withMetadata("authorization", "Bearer token"), "SendMFAEmail", codes.Unauthenticated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, err := authenticator.authorize(test.ctx, "/email.EmailManager/"+test.method, requiredRole)
+			if status.Code(err) != test.code {
+				t.Fatalf("authorize() = %v, expected %s", err, test.code)
+			}
+			if err != nil {
+				return
+			}
+
+			if _, found := PrincipalFromContext(ctx); !found {
+				t.Error("the principal is missing from the context of the call")
+			}
+		})
+	}
+}
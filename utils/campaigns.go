@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+const (
+	CampaignStatusIngesting = "ingesting"
+	CampaignStatusIngested  = "ingested"
+	CampaignStatusAborted   = "aborted"
+)
+
+type Campaign struct {
+	ID        int64
+	Name      string
+	EmailType string
+	Status    string
+	Accepted  int
+	Rejected  int
+	CreatedAt time.Time
+	// QueueStatuses counts the queued emails of the campaign by their status in the queue
+	QueueStatuses map[string]int
+}
+
+// InsertCampaign creates a campaign in the ingesting status and returns its ID
+func InsertCampaign(db *database.DB, name string, emailType string) (int64, error) {
+	return db.InsertID(context.Background(), "INSERT INTO campaigns (name, email_type) VALUES (?, ?)", name, emailType)
+}
+
+// UpdateCampaign stores the ingestion counts and status of a campaign
+func UpdateCampaign(db *database.DB, id int64, status string, accepted int, rejected int) error {
+	_, err := db.Exec("UPDATE campaigns SET status = ?, accepted = ?, rejected = ? WHERE id = ?", status, accepted, rejected, id)
+
+	return err
+}
+
+// GetCampaign loads a campaign along with the number of its emails in every queue status
+func GetCampaign(db *database.DB, id int64) (Campaign, error) {
+	campaign := Campaign{ID: id, QueueStatuses: map[string]int{}}
+
+	err := db.QueryRow(
+		"SELECT name, email_type, status, accepted, rejected, created_at FROM campaigns WHERE id = ?",
+		id,
+	).Scan(&campaign.Name, &campaign.EmailType, &campaign.Status, &campaign.Accepted, &campaign.Rejected, &campaign.CreatedAt)
+	if err != nil {
+		return Campaign{}, err
+	}
+
+	rows, err := db.Query("SELECT status, COUNT(*) FROM email_queue WHERE campaign_id = ? GROUP BY status", id)
+	if err != nil {
+		return Campaign{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return Campaign{}, err
+		}
+		campaign.QueueStatuses[status] = count
+	}
+
+	if err := rows.Err(); err != nil {
+		return Campaign{}, err
+	}
+
+	return campaign, nil
+}
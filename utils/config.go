@@ -0,0 +1,382 @@
+package utils
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+// configSetting is a setting read from a flag, an environment variable or the configuration file, in that order
+// of precedence, and from its default otherwise. The name is the environment variable, the flag is the name in
+// lowercase with dashes and the key in the configuration file is the name in lowercase.
+type configSetting struct {
+	name         string
+	defaultValue string
+	usage        string
+	// redact hides the secret in the value when the configuration is printed
+	redact func(value string) string
+}
+
+func (s configSetting) flagName() string {
+	return strings.ReplaceAll(strings.ToLower(s.name), "_", "-")
+}
+
+func (s configSetting) key() string {
+	return strings.ToLower(s.name)
+}
+
+// redactSecret hides a whole value, leaving it empty when it is not set
+func redactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	return RedactedValue
+}
+
+// configSettings are the settings of the service with their defaults
+var configSettings = []configSetting{
+	{name: "GO_ENV", defaultValue: "development", usage: "environment of the service, the .env file being loaded in development"},
+	{name: "LISTEN_ADDRESS", defaultValue: ":8080", usage: "address the gRPC server listens on"},
+	{name: "MIGRATE_ON_STARTUP", defaultValue: "true", usage: "apply the pending migrations and create the missing settings rows when the server starts"},
+
+	{name: "DB_DRIVER", defaultValue: "mysql", usage: "database the data is stored in: mysql, postgres or sqlite"},
+	{name: "DB_DSN", usage: "connection string replacing the host, port, user, password and database settings", redact: database.RedactDSN},
+	{name: "MYSQL_HOST", usage: "MySQL host"},
+	{name: "MYSQL_PORT", defaultValue: "3306", usage: "MySQL port"},
+	{name: "MYSQL_USER", usage: "MySQL user"},
+	{name: "MYSQL_PASSWORD", usage: "MySQL password", redact: redactSecret},
+	{name: "MYSQL_DATABASE", usage: "MySQL database"},
+	{name: "POSTGRES_HOST", usage: "PostgreSQL host"},
+	{name: "POSTGRES_PORT", defaultValue: "5432", usage: "PostgreSQL port"},
+	{name: "POSTGRES_USER", usage: "PostgreSQL user"},
+	{name: "POSTGRES_PASSWORD", usage: "PostgreSQL password", redact: redactSecret},
+	{name: "POSTGRES_DATABASE", usage: "PostgreSQL database"},
+	{name: "POSTGRES_SSLMODE", usage: "PostgreSQL sslmode, verify-full when db_tls_ca_file is set and disable otherwise"},
+	{name: "SQLITE_PATH", defaultValue: "email-service.db", usage: "SQLite database file"},
+	{name: "DB_TLS_CA_FILE", usage: "CA certificates the database server certificate is verified against, enabling TLS"},
+	{name: "DB_MAX_OPEN_CONNS", defaultValue: "25", usage: "maximum number of open database connections, 0 for no limit"},
+	{name: "DB_MAX_IDLE_CONNS", defaultValue: "10", usage: "maximum number of idle database connections, capped to db_max_open_conns"},
+	{name: "DB_CONN_MAX_LIFETIME", defaultValue: "30m", usage: "duration after which a database connection is closed, 0 for no limit"},
+	{name: "DB_CONN_MAX_IDLE_TIME", defaultValue: "5m", usage: "duration after which an idle database connection is closed, 0 for no limit"},
+	{name: "DB_CONNECT_TIMEOUT", defaultValue: "10s", usage: "timeout of the connection to the database, 0 for no limit"},
+	{name: "DB_READ_TIMEOUT", defaultValue: "30s", usage: "timeout of a read from the database, 0 for no limit"},
+	{name: "DB_WRITE_TIMEOUT", defaultValue: "30s", usage: "timeout of a write to the database, 0 for no limit"},
+
+	{name: "CRYPTOGRAPHY_SERVICE_HOST", defaultValue: "localhost", usage: "host of the cryptography service"},
+	{name: "CRYPTOGRAPHY_SERVICE_PORT", defaultValue: "8094", usage: "port of the cryptography service"},
+	{name: "CRYPTOGRAPHY_SERVICE_TLS_CA_FILE", usage: "CA certificates the cryptography service is verified against, enabling TLS"},
+	{name: "CRYPTOGRAPHY_SERVICE_TLS_CERT_FILE", usage: "client certificate presented to the cryptography service"},
+	{name: "CRYPTOGRAPHY_SERVICE_TLS_KEY_FILE", usage: "key of the client certificate presented to the cryptography service"},
+	{name: "CRYPTOGRAPHY_SERVICE_TLS_SERVER_NAME", usage: "name the cryptography service certificate is verified for, its host by default"},
+
+	{name: "TLS_CERT_FILE", usage: "certificate of the gRPC server, enabling TLS"},
+	{name: "TLS_KEY_FILE", usage: "key of the certificate of the gRPC server"},
+	{name: "TLS_CLIENT_CA_FILE", usage: "CA certificates the client certificates are verified against"},
+	{name: "TLS_CLIENT_AUTH", defaultValue: "require", usage: "whether the clients must present a certificate: require or optional"},
+
+	{name: "AUTH_DISABLED", defaultValue: "false", usage: "let every caller call every RPC"},
+	{name: "AUTH_JWKS_URL", usage: "https URL of the JWKS the JWTs are verified against"},
+	{name: "AUTH_JWKS_FILE", usage: "file of the JWKS the JWTs are verified against, when auth_jwks_url is not set"},
+	{name: "AUTH_JWT_ISSUER", usage: "issuer the JWTs must have"},
+	{name: "AUTH_JWT_AUDIENCE", usage: "audience the JWTs must have"},
+	{name: "AUTH_JWT_ROLES_CLAIM", defaultValue: "roles", usage: "claim holding the roles of the caller in the JWTs"},
+	{name: "AUTH_API_KEYS_FILE", usage: "file of the API keys, one \"<name> <roles> <hex SHA-256 of the key>\" line per key"},
+
+	{name: "SMTP_POOL_SIZE", defaultValue: "4", usage: "number of SMTP connections used to send the queued emails"},
+	{name: "SMTP_SEND_RATE", defaultValue: "10", usage: "maximum number of queued emails sent per second, 0 for no limit"},
+	{name: "SETTINGS_CACHE_TTL", defaultValue: "60", usage: "seconds the SMTP configuration and the templates are cached, 0 disabling the cache"},
+	{name: "EMAIL_MX_CHECK", defaultValue: "false", usage: "look up the mail servers of the recipients in the send RPCs"},
+	{name: "LINK_SIGNING_KEY", usage: "key the redirect URLs with an expiry are signed with", redact: redactSecret},
+	{name: "MFA_CODE_KEY", usage: "key the MFA codes generated by the service are hashed with", redact: redactSecret},
+}
+
+// Config is the configuration of the service
+type Config struct {
+	Environment      string
+	ListenAddress    string
+	MigrateOnStartup bool
+	Database         database.Config
+	CryptoService    CryptoServiceConfig
+	TLS              ServerTLSConfig
+	Auth             AuthConfig
+	SMTPPoolSize     int
+	SMTPSendRate     float64
+	SettingsCacheTTL time.Duration
+	MXCheck          bool
+	// LinkSigningKey is empty when signing the redirect URLs is not configured
+	LinkSigningKey []byte
+	// MFACodeKey is empty when generating the MFA codes is not configured
+	MFACodeKey []byte
+
+	// PrintConfig is set by --print-config, which prints the configuration instead of running the service
+	PrintConfig bool
+	// Args are the arguments left after the flags, such as the migrate subcommand
+	Args []string
+
+	// values are the settings the configuration was parsed from
+	values map[string]string
+}
+
+// CryptoServiceConfig is the connection to the cryptography service
+type CryptoServiceConfig struct {
+	Host          string
+	Port          string
+	TLSCAFile     string
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSServerName string
+}
+
+// ServerTLSConfig is the TLS configuration of the gRPC server
+type ServerTLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ClientAuth   string
+}
+
+// AuthConfig is the authentication of the callers
+type AuthConfig struct {
+	Disabled      bool
+	JWKSURL       string
+	JWKSFile      string
+	JWTIssuer     string
+	JWTAudience   string
+	JWTRolesClaim string
+	APIKeysFile   string
+}
+
+// LoadConfig reads the configuration from the flags in args, the environment variables and the YAML or TOML file
+// given by --config or CONFIG_FILE, in that order of precedence, and validates it. In development the .env file
+// is loaded into the environment first when there is one. Every invalid setting is reported at once.
+func LoadConfig(args []string) (Config, error) {
+	flags := flag.NewFlagSet("email-service", flag.ContinueOnError)
+	configFile := flags.String("config", "", "YAML or TOML configuration file, CONFIG_FILE by default")
+	printConfig := flags.Bool("print-config", false, "print the configuration with the secrets redacted instead of running the service")
+	for _, setting := range configSettings {
+		flags.String(setting.flagName(), setting.defaultValue, setting.usage)
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	flagValues := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		flagValues[f.Name] = f.Value.String()
+	})
+
+	if *configFile == "" {
+		*configFile = os.Getenv("CONFIG_FILE")
+	}
+	fileValues := map[string]string{}
+	if *configFile != "" {
+		var err error
+		fileValues, err = readConfigFile(*configFile)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	// resolve the value of every setting
+	resolve := func() map[string]string {
+		values := map[string]string{}
+		for _, setting := range configSettings {
+			if value, found := flagValues[setting.flagName()]; found {
+				values[setting.name] = value
+			} else if value, found := os.LookupEnv(setting.name); found {
+				values[setting.name] = value
+			} else if value, found := fileValues[setting.name]; found {
+				values[setting.name] = value
+			} else {
+				values[setting.name] = setting.defaultValue
+			}
+		}
+		return values
+	}
+
+	// in development, load the .env file into the environment without overriding it and resolve the settings again
+	values := resolve()
+	if values["GO_ENV"] == "development" {
+		if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return Config{}, fmt.Errorf("failed to load the .env file: %w", err)
+		}
+		values = resolve()
+	}
+
+	config, err := parseConfig(values)
+	config.PrintConfig = *printConfig
+	config.Args = flags.Args()
+
+	return config, err
+}
+
+// parseConfig builds the configuration from the value of every setting
+func parseConfig(values map[string]string) (Config, error) {
+	errs := []error{}
+	parseBool := func(name string) bool {
+		value, err := strconv.ParseBool(values[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s must be true or false, got %q", name, values[name]))
+		}
+		return value
+	}
+	parseInt := func(name string, min int) int {
+		value, err := strconv.Atoi(values[name])
+		if err != nil || value < min {
+			errs = append(errs, fmt.Errorf("%s must be an integer of at least %d, got %q", name, min, values[name]))
+		}
+		return value
+	}
+
+	config := Config{
+		Environment:      values["GO_ENV"],
+		ListenAddress:    values["LISTEN_ADDRESS"],
+		MigrateOnStartup: parseBool("MIGRATE_ON_STARTUP"),
+		CryptoService: CryptoServiceConfig{
+			Host:          values["CRYPTOGRAPHY_SERVICE_HOST"],
+			Port:          values["CRYPTOGRAPHY_SERVICE_PORT"],
+			TLSCAFile:     values["CRYPTOGRAPHY_SERVICE_TLS_CA_FILE"],
+			TLSCertFile:   values["CRYPTOGRAPHY_SERVICE_TLS_CERT_FILE"],
+			TLSKeyFile:    values["CRYPTOGRAPHY_SERVICE_TLS_KEY_FILE"],
+			TLSServerName: values["CRYPTOGRAPHY_SERVICE_TLS_SERVER_NAME"],
+		},
+		TLS: ServerTLSConfig{
+			CertFile:     values["TLS_CERT_FILE"],
+			KeyFile:      values["TLS_KEY_FILE"],
+			ClientCAFile: values["TLS_CLIENT_CA_FILE"],
+			ClientAuth:   values["TLS_CLIENT_AUTH"],
+		},
+		Auth: AuthConfig{
+			Disabled:      parseBool("AUTH_DISABLED"),
+			JWKSURL:       values["AUTH_JWKS_URL"],
+			JWKSFile:      values["AUTH_JWKS_FILE"],
+			JWTIssuer:     values["AUTH_JWT_ISSUER"],
+			JWTAudience:   values["AUTH_JWT_AUDIENCE"],
+			JWTRolesClaim: values["AUTH_JWT_ROLES_CLAIM"],
+			APIKeysFile:   values["AUTH_API_KEYS_FILE"],
+		},
+		SMTPPoolSize:     parseInt("SMTP_POOL_SIZE", 1),
+		SettingsCacheTTL: time.Duration(parseInt("SETTINGS_CACHE_TTL", 0)) * time.Second,
+		MXCheck:          parseBool("EMAIL_MX_CHECK"),
+		LinkSigningKey:   []byte(values["LINK_SIGNING_KEY"]),
+		MFACodeKey:       []byte(values["MFA_CODE_KEY"]),
+		values:           values,
+	}
+
+	var err error
+	config.SMTPSendRate, err = strconv.ParseFloat(values["SMTP_SEND_RATE"], 64)
+	if err != nil || config.SMTPSendRate < 0 {
+		errs = append(errs, fmt.Errorf("SMTP_SEND_RATE must be a number of at least 0, got %q", values["SMTP_SEND_RATE"]))
+	}
+
+	if _, _, err := net.SplitHostPort(config.ListenAddress); err != nil {
+		errs = append(errs, fmt.Errorf("LISTEN_ADDRESS must be a host:port address, got %q", config.ListenAddress))
+	}
+	if port, err := strconv.Atoi(config.CryptoService.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("CRYPTOGRAPHY_SERVICE_PORT must be a port number, got %q", config.CryptoService.Port))
+	}
+	if config.TLS.ClientAuth != "require" && config.TLS.ClientAuth != "optional" {
+		errs = append(errs, fmt.Errorf(`TLS_CLIENT_AUTH must be "require" or "optional", got %q`, config.TLS.ClientAuth))
+	}
+
+	config.Database, err = database.ParseConfig(func(name string) string { return values[name] })
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return config, errors.Join(errs...)
+}
+
+// readConfigFile reads the settings of a YAML or TOML file, chosen by its extension, keyed by their name
+func readConfigFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the configuration file: %w", err)
+	}
+
+	file := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &file)
+	case ".toml":
+		err = toml.Unmarshal(content, &file)
+	default:
+		return nil, fmt.Errorf("the configuration file %s must be a .yaml, .yml or .toml file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the configuration file %s: %w", path, err)
+	}
+
+	names := map[string]bool{}
+	for _, setting := range configSettings {
+		names[setting.name] = true
+	}
+
+	keys := []string{}
+	for key := range file {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := map[string]string{}
+	errs := []error{}
+	for _, key := range keys {
+		name := strings.ToUpper(key)
+		if !names[name] {
+			errs = append(errs, fmt.Errorf("unknown setting %s in %s", key, path))
+			continue
+		}
+
+		switch value := file[key].(type) {
+		case nil:
+			values[name] = ""
+		case string, bool, int, int64, uint64, float64:
+			values[name] = fmt.Sprint(value)
+		default:
+			errs = append(errs, fmt.Errorf("setting %s in %s must be a string, a number or a boolean", key, path))
+		}
+	}
+
+	return values, errors.Join(errs...)
+}
+
+// String returns the configuration as a YAML configuration file, with the usage of every setting and the secrets
+// redacted
+func (c Config) String() string {
+	document := &yaml.Node{Kind: yaml.MappingNode}
+	for _, setting := range configSettings {
+		value := c.values[setting.name]
+		if setting.redact != nil {
+			value = setting.redact(value)
+		}
+
+		document.Content = append(
+			document.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: setting.key(), HeadComment: setting.usage},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: value, Style: yaml.DoubleQuotedStyle},
+		)
+	}
+
+	out, err := yaml.Marshal(document)
+	if err != nil {
+		return err.Error()
+	}
+
+	return string(out)
+}
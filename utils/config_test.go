@@ -0,0 +1,272 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearConfigEnv unsets the environment variables of every setting for the duration of the test,
+// so only the values set by the test are read
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+
+	for _, name := range append([]string{"CONFIG_FILE"}, settingNames()...) {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	// outside of development no .env file is loaded
+	t.Setenv("GO_ENV", "test")
+}
+
+func settingNames() []string {
+	names := []string{}
+	for _, setting := range configSettings {
+		names = append(names, setting.name)
+	}
+	return names
+}
+
+// writeConfigFile writes a configuration file in a temporary directory and returns its path
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		flag     string
+		env      string
+		file     string
+		expected string
+	}{
+		{"default", "", "", "", ":8080"},
+		{"file over default", "", "", "127.0.0.1:1001", "127.0.0.1:1001"},
+		{"environment over file", "", "127.0.0.1:1002", "127.0.0.1:1001", "127.0.0.1:1002"},
+		{"flag over environment", "127.0.0.1:1003", "127.0.0.1:1002", "127.0.0.1:1001", "127.0.0.1:1003"},
+		{"flag over file", "127.0.0.1:1003", "", "127.0.0.1:1001", "127.0.0.1:1003"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			t.Setenv("DB_DRIVER", "sqlite")
+
+			args := []string{}
+			if test.flag != "" {
+				args = append(args, "--listen-address", test.flag)
+			}
+			if test.env != "" {
+				t.Setenv("LISTEN_ADDRESS", test.env)
+			}
+			if test.file != "" {
+				args = append(args, "--config", writeConfigFile(t, "config.yaml", "listen_address: "+test.file+"\n"))
+			}
+
+			config, err := LoadConfig(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ListenAddress != test.expected {
+				t.Errorf("ListenAddress = %q, expected %q", config.ListenAddress, test.expected)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"config.yaml", `
+db_driver: sqlite
+sqlite_path: /var/lib/email-service.db
+smtp_pool_size: 8
+smtp_send_rate: 2.5
+email_mx_check: true
+db_conn_max_lifetime: 1h
+auth_jwt_audience: null
+`},
+		{"config.yml", `
+db_driver: sqlite
+sqlite_path: /var/lib/email-service.db
+smtp_pool_size: 8
+smtp_send_rate: 2.5
+email_mx_check: true
+db_conn_max_lifetime: 1h
+auth_jwt_audience:
+`},
+		{"config.toml", `
+db_driver = "sqlite"
+sqlite_path = "/var/lib/email-service.db"
+smtp_pool_size = 8
+smtp_send_rate = 2.5
+email_mx_check = true
+db_conn_max_lifetime = "1h"
+`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			t.Setenv("CONFIG_FILE", writeConfigFile(t, test.name, test.content))
+
+			config, err := LoadConfig(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if config.Database.Driver != "sqlite" || config.Database.Path != "/var/lib/email-service.db" {
+				t.Errorf("Database = %s, expected the SQLite file of the configuration file", config.Database)
+			}
+			if config.SMTPPoolSize != 8 {
+				t.Errorf("SMTPPoolSize = %d, expected 8", config.SMTPPoolSize)
+			}
+			if config.SMTPSendRate != 2.5 {
+				t.Errorf("SMTPSendRate = %g, expected 2.5", config.SMTPSendRate)
+			}
+			if !config.MXCheck {
+				t.Error("MXCheck = false, expected true")
+			}
+			if config.Database.ConnMaxLifetime != time.Hour {
+				t.Errorf("ConnMaxLifetime = %s, expected 1h", config.Database.ConnMaxLifetime)
+			}
+			if config.Auth.JWTAudience != "" {
+				t.Errorf("JWTAudience = %q, expected it to be empty", config.Auth.JWTAudience)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		file     string
+		content  string
+		expected []string
+	}{
+		{"unknown key", nil, "config.yaml", "db_driver: sqlite\nsmtp_hostname: smtp.example.com\n", []string{"unknown setting smtp_hostname"}},
+		{"unknown key in TOML", nil, "config.toml", "db_driver = \"sqlite\"\n[smtp]\nhost = \"smtp.example.com\"\n", []string{"unknown setting smtp"}},
+		{"nested value", nil, "config.yaml", "db_driver: sqlite\nlisten_address:\n  host: localhost\n", []string{"setting listen_address", "must be a string, a number or a boolean"}},
+		{"unsupported file extension", nil, "config.json", `{"db_driver": "sqlite"}`, []string{"must be a .yaml, .yml or .toml file"}},
+		{"malformed file", nil, "config.yaml", "db_driver: [sqlite\n", []string{"failed to parse the configuration file"}},
+		{"missing file", []string{"--config", "missing.yaml"}, "", "", []string{"failed to read the configuration file"}},
+		{"unknown flag", []string{"--smtp-hostname", "smtp.example.com"}, "", "", []string{"flag provided but not defined"}},
+		{"invalid boolean", []string{"--db-driver", "sqlite", "--email-mx-check", "sometimes"}, "", "", []string{"EMAIL_MX_CHECK must be true or false"}},
+		{"invalid integer", []string{"--db-driver", "sqlite", "--smtp-pool-size", "0"}, "", "", []string{"SMTP_POOL_SIZE must be an integer of at least 1"}},
+		{"negative send rate", []string{"--db-driver", "sqlite", "--smtp-send-rate", "-1"}, "", "", []string{"SMTP_SEND_RATE must be a number of at least 0"}},
+		{"invalid listen address", []string{"--db-driver", "sqlite", "--listen-address", "8080"}, "", "", []string{"LISTEN_ADDRESS must be a host:port address"}},
+		{"invalid client auth", []string{"--db-driver", "sqlite", "--tls-client-auth", "none"}, "", "", []string{`TLS_CLIENT_AUTH must be "require" or "optional"`}},
+		{"unsupported driver", []string{"--db-driver", "oracle"}, "", "", []string{`unsupported DB_DRIVER "oracle"`}},
+		{"missing database connection", []string{"--db-driver", "postgres"}, "", "", []string{"POSTGRES_HOST is required", "POSTGRES_USER is required", "POSTGRES_DATABASE is required"}},
+		{"every invalid setting at once", []string{"--db-driver", "sqlite", "--cryptography-service-port", "0", "--settings-cache-ttl", "soon", "--db-read-timeout", "-1s"}, "", "", []string{
+			"CRYPTOGRAPHY_SERVICE_PORT must be a port number",
+			"SETTINGS_CACHE_TTL must be an integer of at least 0",
+			"DB_READ_TIMEOUT must not be negative",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearConfigEnv(t)
+
+			args := test.args
+			if test.file != "" {
+				args = append([]string{"--config", writeConfigFile(t, test.file, test.content)}, args...)
+			}
+
+			_, err := LoadConfig(args)
+			if err == nil {
+				t.Fatal("LoadConfig() succeeded, expected an error")
+			}
+			for _, expected := range test.expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("LoadConfig() = %q, expected it to contain %q", err, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		secrets  []string
+		expected []string
+	}{
+		{
+			"MySQL DSN and password",
+			[]string{"--db-driver", "mysql", "--db-dsn", "user:p@ss:word@tcp(db:3306)/email", "--mysql-password", "mysql-secret"},
+			[]string{"p@ss:word", "mysql-secret"},
+			[]string{`db_dsn: "user:[redacted]@tcp(db:3306)/email"`, `mysql_password: "[redacted]"`},
+		},
+		{
+			"PostgreSQL URL DSN",
+			[]string{"--db-driver", "postgres", "--db-dsn", "postgres://user:pg-secret@db:5432/email"},
+			[]string{"pg-secret"},
+			[]string{`db_dsn: "postgres://user:xxxxx@db:5432/email"`},
+		},
+		{
+			"PostgreSQL key value DSN",
+			[]string{"--db-driver", "postgres", "--db-dsn", "host=db user=user password='pg secret' dbname=email"},
+			[]string{"pg secret"},
+			[]string{`db_dsn: "host=db user=user password=[redacted] dbname=email"`},
+		},
+		{
+			"link signing key",
+			[]string{"--db-driver", "sqlite", "--link-signing-key", "signing-secret"},
+			[]string{"signing-secret"},
+			[]string{`link_signing_key: "[redacted]"`},
+		},
+		{
+			"MFA code key",
+			[]string{"--db-driver", "sqlite", "--mfa-code-key", "mfa-secret"},
+			[]string{"mfa-secret"},
+			[]string{`mfa_code_key: "[redacted]"`},
+		},
+		{
+			"unset secrets",
+			[]string{"--db-driver", "sqlite"},
+			nil,
+			[]string{`db_dsn: ""`, `mysql_password: ""`, `link_signing_key: ""`, `mfa_code_key: ""`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearConfigEnv(t)
+
+			config, err := LoadConfig(append([]string{"--print-config"}, test.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !config.PrintConfig {
+				t.Error("PrintConfig = false, expected --print-config to set it")
+			}
+
+			printed := config.String()
+			for _, secret := range test.secrets {
+				if strings.Contains(printed, secret) {
+					t.Errorf("the printed configuration contains the secret %q:\n%s", secret, printed)
+				}
+			}
+			for _, expected := range test.expected {
+				if !strings.Contains(printed, expected) {
+					t.Errorf("the printed configuration does not contain %s:\n%s", expected, printed)
+				}
+			}
+		})
+	}
+}
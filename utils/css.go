@@ -0,0 +1,373 @@
+package utils
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// dynamicSelectorPattern matches the selectors that depend on user interaction or target pseudo elements,
+// which cannot be expressed as inline styles and are left in the <style> block
+var dynamicSelectorPattern = regexp.MustCompile(`(?i)::|:(hover|active|focus|focus-within|focus-visible|visited|link|target|before|after|first-letter|first-line|selection|placeholder)\b`)
+
+// cssRule is a style rule of a stylesheet, in the order it appears in the document
+type cssRule struct {
+	selectors    string
+	declarations []cssDeclaration
+}
+
+type cssDeclaration struct {
+	property  string
+	value     string
+	important bool
+}
+
+// styleCandidate is a declaration that applies to an element along with what decides its precedence
+type styleCandidate struct {
+	declaration cssDeclaration
+	inline      bool
+	specificity cascadia.Specificity
+	order       int
+}
+
+// InlineCSS moves the rules of the <style> blocks of an HTML document into the style attributes of the
+// elements they match. At-rules such as media queries, and rules with selectors that cannot be inlined like
+// :hover, are kept in a <style> block for the clients that support them. A <style data-inline="false"> block
+// is left untouched.
+func InlineCSS(document string) (string, error) {
+	root, err := html.Parse(strings.NewReader(document))
+	if err != nil {
+		return "", err
+	}
+
+	styleNodes := []*html.Node{}
+	var findStyles func(*html.Node)
+	findStyles = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Style && getAttribute(n, "data-inline") != "false" {
+			styleNodes = append(styleNodes, n)
+			return
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			findStyles(child)
+		}
+	}
+	findStyles(root)
+
+	// nothing to inline, keep the document as it was rendered
+	if len(styleNodes) == 0 {
+		return document, nil
+	}
+
+	candidates := map[*html.Node][]styleCandidate{}
+	order := 0
+
+	for _, styleNode := range styleNodes {
+		css := ""
+		for child := styleNode.FirstChild; child != nil; child = child.NextSibling {
+			css += child.Data
+		}
+
+		rules, leftover := parseStylesheet(css)
+		kept := []string{}
+
+		for _, rule := range rules {
+			keptSelectors := []string{}
+
+			for _, selector := range splitOutside(rule.selectors, ',') {
+				selector = strings.TrimSpace(selector)
+				if selector == "" {
+					continue
+				}
+
+				sel, err := cascadia.Parse(selector)
+				if err != nil || dynamicSelectorPattern.MatchString(selector) {
+					keptSelectors = append(keptSelectors, selector)
+					continue
+				}
+
+				for _, n := range cascadia.QueryAll(root, sel) {
+					for _, declaration := range rule.declarations {
+						candidates[n] = append(candidates[n], styleCandidate{
+							declaration: declaration,
+							specificity: sel.Specificity(),
+							order:       order,
+						})
+						order++
+					}
+				}
+			}
+
+			if len(keptSelectors) > 0 {
+				kept = append(kept, strings.Join(keptSelectors, ", ")+" { "+formatDeclarations(rule.declarations, true)+" }")
+			}
+		}
+
+		kept = append(kept, leftover...)
+
+		// replace the block with what could not be inlined, or drop it
+		for styleNode.FirstChild != nil {
+			styleNode.RemoveChild(styleNode.FirstChild)
+		}
+		if len(kept) == 0 {
+			styleNode.Parent.RemoveChild(styleNode)
+		} else {
+			styleNode.AppendChild(&html.Node{Type: html.TextNode, Data: strings.Join(kept, "\n")})
+		}
+	}
+
+	for n, nodeCandidates := range candidates {
+		// the existing inline style wins over the stylesheet unless the stylesheet declaration is important
+		for _, declaration := range parseDeclarations(getAttribute(n, "style")) {
+			nodeCandidates = append(nodeCandidates, styleCandidate{declaration: declaration, inline: true, order: order})
+			order++
+		}
+
+		setAttribute(n, "style", formatDeclarations(resolveCascade(nodeCandidates), false))
+	}
+
+	var buffer bytes.Buffer
+	if err := html.Render(&buffer, root); err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+// resolveCascade returns the winning declaration of every property, in the order the properties first appear
+func resolveCascade(candidates []styleCandidate) []cssDeclaration {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.declaration.important != b.declaration.important {
+			return !a.declaration.important
+		}
+		if a.inline != b.inline {
+			return !a.inline
+		}
+		if a.specificity != b.specificity {
+			return a.specificity.Less(b.specificity)
+		}
+		return a.order < b.order
+	})
+
+	declarations := []cssDeclaration{}
+	positions := map[string]int{}
+	for _, candidate := range candidates {
+		// the precedence is already settled, the inlined declaration does not need the flag
+		declaration := candidate.declaration
+		declaration.important = false
+
+		if position, found := positions[declaration.property]; found {
+			declarations[position] = declaration
+			continue
+		}
+		positions[declaration.property] = len(declarations)
+		declarations = append(declarations, declaration)
+	}
+
+	return declarations
+}
+
+// parseStylesheet splits a stylesheet into its style rules and the at-rules, which are returned as text
+func parseStylesheet(css string) ([]cssRule, []string) {
+	css = stripComments(css)
+	rules := []cssRule{}
+	atRules := []string{}
+
+	for {
+		css = strings.TrimSpace(css)
+		if css == "" {
+			break
+		}
+
+		if strings.HasPrefix(css, "@") {
+			// statement at-rules like @import end with a semicolon, the others with a block
+			semicolon := indexOutside(css, ';')
+			brace := indexOutside(css, '{')
+			if semicolon >= 0 && (brace < 0 || semicolon < brace) {
+				atRules = append(atRules, strings.TrimSpace(css[:semicolon+1]))
+				css = css[semicolon+1:]
+				continue
+			}
+
+			end := matchingBrace(css, brace)
+			if brace < 0 || end < 0 {
+				atRules = append(atRules, css)
+				break
+			}
+			atRules = append(atRules, strings.TrimSpace(css[:end+1]))
+			css = css[end+1:]
+			continue
+		}
+
+		brace := indexOutside(css, '{')
+		if brace < 0 {
+			break
+		}
+		end := matchingBrace(css, brace)
+		if end < 0 {
+			break
+		}
+
+		rules = append(rules, cssRule{
+			selectors:    strings.TrimSpace(css[:brace]),
+			declarations: parseDeclarations(css[brace+1 : end]),
+		})
+		css = css[end+1:]
+	}
+
+	return rules, atRules
+}
+
+// parseDeclarations parses the declarations of a rule or of a style attribute
+func parseDeclarations(block string) []cssDeclaration {
+	declarations := []cssDeclaration{}
+
+	for _, part := range splitOutside(block, ';') {
+		property, value, found := strings.Cut(part, ":")
+		if !found {
+			continue
+		}
+
+		declaration := cssDeclaration{
+			property: strings.ToLower(strings.TrimSpace(property)),
+			value:    strings.TrimSpace(value),
+		}
+
+		lowerValue := strings.ToLower(declaration.value)
+		if index := strings.LastIndex(lowerValue, "!important"); index >= 0 && strings.TrimSpace(lowerValue[index+len("!important"):]) == "" {
+			declaration.important = true
+			declaration.value = strings.TrimSpace(declaration.value[:index])
+		}
+
+		if declaration.property == "" || declaration.value == "" {
+			continue
+		}
+		declarations = append(declarations, declaration)
+	}
+
+	return declarations
+}
+
+func formatDeclarations(declarations []cssDeclaration, withImportant bool) string {
+	parts := []string{}
+	for _, declaration := range declarations {
+		part := declaration.property + ": " + declaration.value
+		if withImportant && declaration.important {
+			part += " !important"
+		}
+		parts = append(parts, part)
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+func stripComments(css string) string {
+	for {
+		start := strings.Index(css, "/*")
+		if start < 0 {
+			return css
+		}
+		end := strings.Index(css[start+2:], "*/")
+		if end < 0 {
+			return css[:start]
+		}
+		css = css[:start] + css[start+2+end+2:]
+	}
+}
+
+// splitOutside splits s on sep, ignoring the separators inside quotes, parentheses and brackets
+func splitOutside(s string, sep byte) []string {
+	parts := []string{}
+	for {
+		index := indexOutside(s, sep)
+		if index < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:index])
+		s = s[index+1:]
+	}
+}
+
+// indexOutside returns the index of the first c of s that is not inside quotes, parentheses or brackets
+func indexOutside(s string, c byte) int {
+	var quote byte
+	depth := 0
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == c && depth == 0:
+			return i
+		case s[i] == '(' || s[i] == '[':
+			depth++
+		case (s[i] == ')' || s[i] == ']') && depth > 0:
+			depth--
+		}
+	}
+
+	return -1
+}
+
+// matchingBrace returns the index of the brace closing the one at open
+func matchingBrace(s string, open int) int {
+	if open < 0 {
+		return -1
+	}
+
+	depth := 0
+	var quote byte
+	for i := open; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == '{':
+			depth++
+		case s[i] == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+func getAttribute(n *html.Node, key string) string {
+	for _, attribute := range n.Attr {
+		if attribute.Key == key {
+			return attribute.Val
+		}
+	}
+
+	return ""
+}
+
+func setAttribute(n *html.Node, key string, value string) {
+	for i := range n.Attr {
+		if n.Attr[i].Key == key {
+			n.Attr[i].Val = value
+			return
+		}
+	}
+
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: value})
+}
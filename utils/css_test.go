@@ -0,0 +1,126 @@
+package utils
+
+import "testing"
+
+func TestInlineCSS(t *testing.T) {
+	tests := []struct {
+		name     string
+		style    string
+		body     string
+		expected string
+	}{
+		{
+			"type selector",
+			"p { color: red; margin: 0 }",
+			`<p>Hello</p>`,
+			`<html><head></head><body><p style="color: red; margin: 0">Hello</p></body></html>`,
+		},
+		{
+			"specificity order",
+			"#greeting { color: blue } p.lead { color: green } .lead { color: red } p { color: black }",
+			`<p id="greeting" class="lead">Hello</p>`,
+			`<html><head></head><body><p id="greeting" class="lead" style="color: blue">Hello</p></body></html>`,
+		},
+		{
+			"source order between equal specificities",
+			".lead { color: red } .note { color: green }",
+			`<p class="lead note">Hello</p>`,
+			`<html><head></head><body><p class="lead note" style="color: green">Hello</p></body></html>`,
+		},
+		{
+			"important over specificity",
+			"p { color: red !important } #greeting { color: blue }",
+			`<p id="greeting">Hello</p>`,
+			`<html><head></head><body><p id="greeting" style="color: red">Hello</p></body></html>`,
+		},
+		{
+			"existing style attribute over the stylesheet",
+			"#greeting { color: blue; margin: 0 }",
+			`<p id="greeting" style="color: red">Hello</p>`,
+			`<html><head></head><body><p id="greeting" style="color: red; margin: 0">Hello</p></body></html>`,
+		},
+		{
+			"important over the existing style attribute",
+			"p { color: blue !important }",
+			`<p style="color: red; padding: 4px">Hello</p>`,
+			`<html><head></head><body><p style="color: blue; padding: 4px">Hello</p></body></html>`,
+		},
+		{
+			"important existing style attribute",
+			"p { color: blue !important }",
+			`<p style="color: red !important">Hello</p>`,
+			`<html><head></head><body><p style="color: red">Hello</p></body></html>`,
+		},
+		{
+			"media query preserved",
+			"p { color: red } @media (max-width: 600px) { p { color: blue } }",
+			`<p>Hello</p>`,
+			`<html><head><style>@media (max-width: 600px) { p { color: blue } }</style></head><body><p style="color: red">Hello</p></body></html>`,
+		},
+		{
+			"dynamic selector left alone",
+			"a { color: red } a:hover { color: blue }",
+			`<a href="https://example.com">Link</a>`,
+			`<html><head><style>a:hover { color: blue }</style></head><body><a href="https://example.com" style="color: red">Link</a></body></html>`,
+		},
+		{
+			"pseudo element left alone",
+			"p::first-line { font-weight: bold !important }",
+			`<p>Hello</p>`,
+			`<html><head><style>p::first-line { font-weight: bold !important }</style></head><body><p>Hello</p></body></html>`,
+		},
+		{
+			"unparsable selector left alone",
+			"p { color: red } p:unknown-pseudo, .lead { color: blue }",
+			`<p class="lead">Hello</p>`,
+			`<html><head><style>p:unknown-pseudo { color: blue }</style></head><body><p class="lead" style="color: blue">Hello</p></body></html>`,
+		},
+		{
+			"comments and quoted values",
+			`/* brand */ p { font-family: "Helvetica; Neue", sans-serif; background: url("a;b.png") }`,
+			`<p>Hello</p>`,
+			`<html><head></head><body><p style="font-family: &#34;Helvetica; Neue&#34;, sans-serif; background: url(&#34;a;b.png&#34;)">Hello</p></body></html>`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			document := "<html><head><style>" + test.style + "</style></head><body>" + test.body + "</body></html>"
+
+			inlined, err := InlineCSS(document)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inlined != test.expected {
+				t.Errorf("InlineCSS() = %s, expected %s", inlined, test.expected)
+			}
+		})
+	}
+}
+
+func TestInlineCSSLeavesDocumentsAlone(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		expected string
+	}{
+		{"no style block", `<p style="color: red">Hello</p>`, `<p style="color: red">Hello</p>`},
+		{
+			"style block excluded from inlining",
+			`<html><head><style data-inline="false">p { color: red }</style></head><body><p>Hello</p></body></html>`,
+			`<html><head><style data-inline="false">p { color: red }</style></head><body><p>Hello</p></body></html>`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inlined, err := InlineCSS(test.document)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inlined != test.expected {
+				t.Errorf("InlineCSS() = %s, expected %s", inlined, test.expected)
+			}
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package utils
 
 import (
-	"database/sql"
+	"context"
 	"strconv"
+
+	"github.com/isaacwassou/email-service/database"
 )
 
 type SMTPConfig struct {
@@ -13,21 +15,15 @@ type SMTPConfig struct {
 	Sender   string
 }
 
-func GetSMTPConfig(db *sql.DB) (SMTPConfig, error) {
+func GetSMTPConfig(db *database.DB) (SMTPConfig, error) {
 	smtpConfig := SMTPConfig{}
 
-	rows, err := db.Query("SELECT name, value FROM settings WHERE name IN ('SMTP_HOST', 'SMTP_PORT', 'SMTP_USER', 'SMTP_PASSWORD', 'SMTP_SENDER')")
+	settings, err := db.Repository().GetSettings(context.Background(), []string{"SMTP_HOST", "SMTP_PORT", "SMTP_USER", "SMTP_PASSWORD", "SMTP_SENDER"})
 	if err != nil {
 		return SMTPConfig{}, err
 	}
 
-	for rows.Next() {
-		var name string
-		var value sql.NullString
-		if err := rows.Scan(&name, &value); err != nil {
-			return SMTPConfig{}, err
-		}
-
+	for name, value := range settings {
 		switch name {
 		case "SMTP_HOST":
 			smtpConfig.Host = value.String
@@ -45,10 +41,6 @@ func GetSMTPConfig(db *sql.DB) (SMTPConfig, error) {
 		case "SMTP_SENDER":
 			smtpConfig.Sender = value.String
 		}
-
-		if err := rows.Err(); err != nil {
-			return SMTPConfig{}, err
-		}
 	}
 
 	return smtpConfig, nil
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+func TestGetSMTPConfig(t *testing.T) {
+	db := newTestDBWithConfig(t, database.Config{MaxOpenConns: 1})
+
+	setSettings(t, db, map[string]*string{
+		"SMTP_HOST":     ptr("smtp.example.com"),
+		"SMTP_PORT":     ptr("587"),
+		"SMTP_USER":     ptr("user"),
+		"SMTP_PASSWORD": ptr("encrypted:password"),
+		"SMTP_SENDER":   ptr("Example <noreply@example.com>"),
+	})
+
+	smtpConfig, err := GetSMTPConfig(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := SMTPConfig{Host: "smtp.example.com", Port: 587, User: "user", Password: "encrypted:password", Sender: "Example <noreply@example.com>"}
+	if smtpConfig != expected {
+		t.Errorf("GetSMTPConfig() = %+v, expected %+v", smtpConfig, expected)
+	}
+	if !CheckSMTPConfig(smtpConfig) {
+		t.Error("the SMTP configuration is reported as incomplete")
+	}
+
+	// an invalid port fails the read, which still releases the connection
+	setSettings(t, db, map[string]*string{"SMTP_PORT": ptr("not a port")})
+	for i := 0; i < 2; i++ {
+		if _, err := GetSMTPConfig(db); err == nil {
+			t.Fatal("GetSMTPConfig() succeeded with an invalid port")
+		}
+		requireFreeConnection(t, db)
+	}
+}
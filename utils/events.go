@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+const (
+	DeliveryEventQueued     = "queued"
+	DeliveryEventSent       = "sent"
+	DeliveryEventDeferred   = "deferred"
+	DeliveryEventBounced    = "bounced"
+	DeliveryEventComplained = "complained"
+	DeliveryEventFailed     = "failed"
+)
+
+type DeliveryEvent struct {
+	ID        int64
+	MessageID string
+	EventType string
+	EmailType string
+	Recipient string
+	Detail    string
+	CreatedAt time.Time
+}
+
+type DeliveryEventFilter struct {
+	EventTypes []string
+	EmailTypes []string
+	Recipient  string
+	MessageID  string
+}
+
+// NewMessageID generates a random identifier for an outgoing email
+func NewMessageID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// InsertDeliveryEvent appends an event to the delivery log and returns its ID
+func InsertDeliveryEvent(db *database.DB, event DeliveryEvent) (int64, error) {
+	return db.InsertID(
+		context.Background(),
+		"INSERT INTO delivery_events (message_id, event_type, email_type, recipient, detail) VALUES (?, ?, ?, ?, ?)",
+		event.MessageID,
+		event.EventType,
+		event.EmailType,
+		event.Recipient,
+		sql.NullString{String: event.Detail, Valid: event.Detail != ""},
+	)
+}
+
+// GetDeliveryEventsAfter returns up to limit events with an ID greater than cursor that match the filter
+func GetDeliveryEventsAfter(db *database.DB, cursor int64, filter DeliveryEventFilter, limit int) ([]DeliveryEvent, error) {
+	conditions, args := filter.conditions()
+
+	return getDeliveryEvents(db, "id > ?"+conditions+" ORDER BY id LIMIT ?", append(append([]any{cursor}, args...), limit)...)
+}
+
+// GetRecentDeliveryEventsBefore returns the events with an ID greater than after and lower than cursor created since the
+// given time that match the filter, a zero time not limiting the creation time. An event can commit after an event
+// with a higher ID, so a reader that already moved its cursor past it finds it again this way. The time is compared
+// with the creation time of the events in the clock of the database, so it should be derived from another event.
+func GetRecentDeliveryEventsBefore(db *database.DB, after int64, cursor int64, since time.Time, filter DeliveryEventFilter) ([]DeliveryEvent, error) {
+	conditions, args := filter.conditions()
+
+	where := "id > ? AND id < ?"
+	bounds := []any{after, cursor}
+	if !since.IsZero() {
+		where += " AND created_at >= ?"
+		bounds = append(bounds, since.UTC())
+	}
+
+	return getDeliveryEvents(db, where+conditions+" ORDER BY id", append(bounds, args...)...)
+}
+
+// GetDeliveryEvent returns the event with the given ID, reporting false when it does not exist
+func GetDeliveryEvent(db *database.DB, id int64) (DeliveryEvent, bool, error) {
+	events, err := getDeliveryEvents(db, "id = ?", id)
+	if err != nil || len(events) == 0 {
+		return DeliveryEvent{}, false, err
+	}
+
+	return events[0], true, nil
+}
+
+// GetFirstDeliveryEvent returns the first event recorded for a message, reporting false when the message has none
+func GetFirstDeliveryEvent(db *database.DB, messageID string) (DeliveryEvent, bool, error) {
+	events, err := getDeliveryEvents(db, "message_id = ? ORDER BY id LIMIT 1", messageID)
+	if err != nil || len(events) == 0 {
+		return DeliveryEvent{}, false, err
+	}
+
+	return events[0], true, nil
+}
+
+// conditions returns the conditions of a query matching the filter, each starting with AND, and their arguments
+func (filter DeliveryEventFilter) conditions() (string, []any) {
+	conditions := ""
+	args := []any{}
+
+	if len(filter.EventTypes) > 0 {
+		conditions += " AND event_type IN (" + placeholders(len(filter.EventTypes)) + ")"
+		for _, eventType := range filter.EventTypes {
+			args = append(args, eventType)
+		}
+	}
+
+	if len(filter.EmailTypes) > 0 {
+		conditions += " AND email_type IN (" + placeholders(len(filter.EmailTypes)) + ")"
+		for _, emailType := range filter.EmailTypes {
+			args = append(args, emailType)
+		}
+	}
+
+	if filter.Recipient != "" {
+		conditions += " AND recipient = ?"
+		args = append(args, filter.Recipient)
+	}
+
+	if filter.MessageID != "" {
+		conditions += " AND message_id = ?"
+		args = append(args, filter.MessageID)
+	}
+
+	return conditions, args
+}
+
+func getDeliveryEvents(db *database.DB, where string, args ...any) ([]DeliveryEvent, error) {
+	rows, err := db.Query("SELECT id, message_id, event_type, email_type, recipient, detail, created_at FROM delivery_events WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []DeliveryEvent{}
+	for rows.Next() {
+		var event DeliveryEvent
+		var detail sql.NullString
+		var createdAt sql.NullTime
+		if err := rows.Scan(&event.ID, &event.MessageID, &event.EventType, &event.EmailType, &event.Recipient, &detail, &createdAt); err != nil {
+			return nil, err
+		}
+
+		event.Detail = detail.String
+		event.CreatedAt = createdAt.Time
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// placeholders returns n comma separated query placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// DeliveryEventNotifier wakes up the goroutines waiting for new delivery events
+type DeliveryEventNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func NewDeliveryEventNotifier() *DeliveryEventNotifier {
+	return &DeliveryEventNotifier{ch: make(chan struct{})}
+}
+
+// Wait returns a channel that is closed the next time Notify is called
+func (n *DeliveryEventNotifier) Wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.ch
+}
+
+// Notify wakes up every goroutine currently waiting for new events
+func (n *DeliveryEventNotifier) Notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
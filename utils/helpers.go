@@ -2,9 +2,12 @@ package utils
 
 import (
 	"errors"
-	"os"
+	"net"
+	"sort"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 
 	pbCrypto "github.com/isaacwassou/email-service/protobufs/cryptography_service"
@@ -15,6 +18,15 @@ type EmailTemplateDBFields struct {
 	Subject     string
 	Body        string
 	RedirectURL string
+	Layout      string
+	InlineCSS   string
+	Format      string
+	TokenParam  string
+	LinkTTL     string
+	// CodeLength is only set for the MFA template, and CodeTTL for the MFA and magic link templates,
+	// the ones with secrets generated by the service
+	CodeLength string
+	CodeTTL    string
 }
 
 func GetEmailTemplateDBFields(emailType pb.EmailType) (fields EmailTemplateDBFields, err error) {
@@ -23,18 +35,47 @@ func GetEmailTemplateDBFields(emailType pb.EmailType) (fields EmailTemplateDBFie
 		fields.Subject = "EMAIL_VERIFICATION_SUBJECT"
 		fields.Body = "EMAIL_VERIFICATION_BODY"
 		fields.RedirectURL = "EMAIL_VERIFICATION_REDIRECT_URL"
+		fields.Layout = "EMAIL_VERIFICATION_LAYOUT"
+		fields.InlineCSS = "EMAIL_VERIFICATION_INLINE_CSS"
+		fields.Format = "EMAIL_VERIFICATION_FORMAT"
+		fields.TokenParam = "EMAIL_VERIFICATION_TOKEN_PARAM"
+		fields.LinkTTL = "EMAIL_VERIFICATION_LINK_TTL"
 		break
 
 	case pb.EmailType_PASSWORD_RESET:
 		fields.Subject = "PASSWORD_RESET_SUBJECT"
 		fields.Body = "PASSWORD_RESET_BODY"
 		fields.RedirectURL = "PASSWORD_RESET_REDIRECT_URL"
+		fields.Layout = "PASSWORD_RESET_LAYOUT"
+		fields.InlineCSS = "PASSWORD_RESET_INLINE_CSS"
+		fields.Format = "PASSWORD_RESET_FORMAT"
+		fields.TokenParam = "PASSWORD_RESET_TOKEN_PARAM"
+		fields.LinkTTL = "PASSWORD_RESET_LINK_TTL"
 		break
 
 	case pb.EmailType_MFA:
 		fields.Subject = "MFA_VERIFICATION_SUBJECT"
 		fields.Body = "MFA_VERIFICATION_BODY"
 		fields.RedirectURL = "MFA_VERIFICATION_REDIRECT_URL"
+		fields.Layout = "MFA_VERIFICATION_LAYOUT"
+		fields.InlineCSS = "MFA_VERIFICATION_INLINE_CSS"
+		fields.Format = "MFA_VERIFICATION_FORMAT"
+		fields.TokenParam = "MFA_VERIFICATION_TOKEN_PARAM"
+		fields.LinkTTL = "MFA_VERIFICATION_LINK_TTL"
+		fields.CodeLength = "MFA_VERIFICATION_CODE_LENGTH"
+		fields.CodeTTL = "MFA_VERIFICATION_CODE_TTL"
+		break
+
+	case pb.EmailType_MAGIC_LINK:
+		fields.Subject = "MAGIC_LINK_SUBJECT"
+		fields.Body = "MAGIC_LINK_BODY"
+		fields.RedirectURL = "MAGIC_LINK_REDIRECT_URL"
+		fields.Layout = "MAGIC_LINK_LAYOUT"
+		fields.InlineCSS = "MAGIC_LINK_INLINE_CSS"
+		fields.Format = "MAGIC_LINK_FORMAT"
+		fields.TokenParam = "MAGIC_LINK_TOKEN_PARAM"
+		fields.LinkTTL = "MAGIC_LINK_LINK_TTL"
+		fields.CodeTTL = "MAGIC_LINK_TOKEN_TTL"
 		break
 
 	default:
@@ -44,24 +85,49 @@ func GetEmailTemplateDBFields(emailType pb.EmailType) (fields EmailTemplateDBFie
 	return fields, nil
 }
 
-func NewCryptoServiceClient() (pbCrypto.CryptographyManagerClient, error) {
-	// get host and port from the environment
-	host, found := os.LookupEnv("CRYPTOGRAPHY_SERVICE_HOST")
-	if !found {
-		host = "localhost"
+// RequiredSettings returns the names of the settings rows the admin RPCs update
+func RequiredSettings() []string {
+	names := []string{"SMTP_HOST", "SMTP_PORT", "SMTP_USER", "SMTP_PASSWORD", "SMTP_SENDER"}
+
+	emailTypes := []int32{}
+	for emailType := range pb.EmailType_name {
+		emailTypes = append(emailTypes, emailType)
 	}
+	sort.Slice(emailTypes, func(i, j int) bool { return emailTypes[i] < emailTypes[j] })
 
-	port, found := os.LookupEnv("CRYPTOGRAPHY_SERVICE_PORT")
-	if !found {
-		port = "8094"
+	for _, emailType := range emailTypes {
+		fields, err := GetEmailTemplateDBFields(pb.EmailType(emailType))
+		if err != nil {
+			continue
+		}
+
+		for _, name := range []string{fields.Subject, fields.Body, fields.RedirectURL, fields.Layout, fields.InlineCSS, fields.Format, fields.TokenParam, fields.LinkTTL, fields.CodeLength, fields.CodeTTL} {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
 	}
 
-	connectionURI := host + ":" + port
+	return names
+}
+
+func NewCryptoServiceClient(config CryptoServiceConfig) (pbCrypto.CryptographyManagerClient, error) {
+	connectionURI := net.JoinHostPort(config.Host, config.Port)
+
+	// use TLS when it is configured
+	transportCredentials := insecure.NewCredentials()
+	tlsConfig, err := NewCryptoServiceTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transportCredentials = credentials.NewTLS(tlsConfig)
+	}
 
-	// Create a connection to the email service
+	// Create a connection to the cryptography service
 	conn, err := grpc.Dial(
 		connectionURI,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithTransportCredentials(transportCredentials),
 	)
 	if err != nil {
 		return nil, err
@@ -69,11 +135,16 @@ func NewCryptoServiceClient() (pbCrypto.CryptographyManagerClient, error) {
 	return pbCrypto.NewCryptographyManagerClient(conn), nil
 }
 
-func GetGoEnv() string {
-	environment, found := os.LookupEnv("GO_ENV")
-	if !found {
-		return "development"
+// ExponentialBackoff returns the delay before the next attempt after the given number of failed attempts,
+// starting at base and doubling up to max
+func ExponentialBackoff(base time.Duration, max time.Duration, attempts int) time.Duration {
+	backoff := base
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= max {
+			return max
+		}
 	}
 
-	return environment
+	return backoff
 }
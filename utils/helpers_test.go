@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/isaacwassou/email-service/database"
+	"github.com/isaacwassou/email-service/testutil"
+)
+
+// newTestDB returns a migrated SQLite database that is removed when the test ends
+func newTestDB(t *testing.T) *database.DB {
+	t.Helper()
+
+	return newTestDBWithConfig(t, database.Config{})
+}
+
+// newTestDBWithConfig returns a migrated SQLite database with the pool settings of config
+func newTestDBWithConfig(t *testing.T, config database.Config) *database.DB {
+	t.Helper()
+
+	return testutil.NewDB(t, config).Db
+}
+
+// setSettings stores the settings rows, a nil value being stored as NULL
+func setSettings(t *testing.T, db *database.DB, settings map[string]*string) {
+	t.Helper()
+
+	for name, value := range settings {
+		if _, err := db.Exec(db.Dialect.Upsert("settings", []string{"name", "value"}, []string{"name"}, []string{"value"}), name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// requireFreeConnection fails the test when the only connection of the pool was not released
+func requireFreeConnection(t *testing.T, db *database.DB) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var one int
+	if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		t.Fatalf("the connection was not released: %s", err)
+	}
+}
+
+func ptr(value string) *string {
+	return &value
+}
@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefreshInterval is how often the key set is reloaded from its URL or file
+	jwksRefreshInterval = 10 * time.Minute
+	// jwksMinRefreshInterval limits the reloads triggered by tokens signed with an unknown key
+	jwksMinRefreshInterval = 1 * time.Minute
+)
+
+// JWKS is a JSON Web Key Set loaded from an https URL or a local file and reloaded periodically,
+// or as soon as a token is signed with a key it does not know
+type JWKS struct {
+	source string
+	client *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]any
+	loadedAt time.Time
+	// attemptedAt is when the last reload started, failed reloads being retried after jwksMinRefreshInterval
+	attemptedAt time.Time
+	// reloading is closed once the reload in progress ends, and is nil when there is none
+	reloading chan struct{}
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// errUnsupportedKey is returned for the keys of a type or curve the tokens cannot be verified with
+var errUnsupportedKey = errors.New("unsupported key")
+
+// NewJWKS loads the key set from an https URL or a file path
+func NewJWKS(source string) (*JWKS, error) {
+	return newJWKS(source, &http.Client{Timeout: 10 * time.Second})
+}
+
+func newJWKS(source string, client *http.Client) (*JWKS, error) {
+	// the keys authenticate every caller, so they are not fetched over a connection that could be tampered with
+	if strings.HasPrefix(source, "http://") {
+		return nil, fmt.Errorf("the JWKS URL %s must use https", source)
+	}
+
+	jwks := &JWKS{source: source, client: client}
+	keys, err := jwks.fetch()
+	if err != nil {
+		return nil, err
+	}
+	jwks.keys = keys
+	jwks.loadedAt = time.Now()
+	jwks.attemptedAt = jwks.loadedAt
+
+	return jwks, nil
+}
+
+// Key returns the public key with the given key ID. A known key is returned while the key set reloads,
+// only the tokens signed with an unknown key waiting for the reload.
+func (j *JWKS) Key(kid string) (any, error) {
+	j.mu.Lock()
+	key, found := j.keys[kid]
+	if j.reloading == nil && time.Since(j.attemptedAt) > jwksMinRefreshInterval && (!found || time.Since(j.loadedAt) > jwksRefreshInterval) {
+		j.reloadLocked()
+	}
+	reloaded := j.reloading
+	j.mu.Unlock()
+
+	if !found && reloaded != nil {
+		<-reloaded
+
+		j.mu.Lock()
+		key, found = j.keys[kid]
+		j.mu.Unlock()
+	}
+
+	if !found {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	return key, nil
+}
+
+// reloadLocked starts reloading the key set in the background, reloading being closed once it ends.
+// The previous keys are kept when the reload fails.
+func (j *JWKS) reloadLocked() {
+	reloading := make(chan struct{})
+	j.reloading = reloading
+	j.attemptedAt = time.Now()
+
+	go func() {
+		keys, err := j.fetch()
+
+		j.mu.Lock()
+		if err != nil {
+			log.Printf("failed to reload the JWKS: %v", err)
+		} else {
+			j.keys = keys
+			j.loadedAt = time.Now()
+		}
+		j.reloading = nil
+		j.mu.Unlock()
+
+		close(reloading)
+	}()
+}
+
+// fetch reads and parses the key set, leaving out the keys of an unsupported type or curve
+func (j *JWKS) fetch() (map[string]any, error) {
+	data, err := j.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := map[string]any{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if errors.Is(err, errUnsupportedKey) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWKS: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (j *JWKS) read() ([]byte, error) {
+	if !strings.HasPrefix(j.source, "https://") {
+		return os.ReadFile(j.source)
+	}
+
+	request, err := http.NewRequestWithContext(context.Background(), http.MethodGet, j.source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := j.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching the JWKS returned HTTP %d", response.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(response.Body, 1<<20))
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("%w: curve %q", errUnsupportedKey, k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: key type %q", errUnsupportedKey, k.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestKey returns an ES256 signing key along with its JSON Web Key
+func newTestKey(t *testing.T, kid string) (*ecdsa.PrivateKey, map[string]string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func(n *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32)))
+	}
+
+	return key, map[string]string{"kty": "EC", "kid": kid, "use": "sig", "crv": "P-256", "x": encode(key.X), "y": encode(key.Y)}
+}
+
+// ed25519Key is a JSON Web Key of a type the tokens cannot be verified with
+var ed25519Key = map[string]string{"kty": "OKP", "kid": "ed25519", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+
+// jwksDocument returns a key set with the keys
+func jwksDocument(t *testing.T, keys ...map[string]string) []byte {
+	t.Helper()
+
+	document, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return document
+}
+
+// writeJWKSFile writes a key set in a file and returns its path
+func writeJWKSFile(t *testing.T, keys ...map[string]string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwksDocument(t, keys...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestJWKSSkipsUnsupportedKeys(t *testing.T) {
+	_, signingKey := newTestKey(t, "signing")
+	unknownCurve := map[string]string{"kty": "EC", "kid": "secp256k1", "crv": "secp256k1", "x": "AA", "y": "AA"}
+	encryptionKey := map[string]string{"kty": "EC", "kid": "encryption", "use": "enc", "crv": "P-256", "x": signingKey["x"], "y": signingKey["y"]}
+
+	jwks, err := NewJWKS(writeJWKSFile(t, ed25519Key, unknownCurve, encryptionKey, signingKey))
+	if err != nil {
+		t.Fatalf("NewJWKS() = %v, expected the unsupported keys to be skipped", err)
+	}
+
+	if _, err := jwks.Key("signing"); err != nil {
+		t.Errorf("Key(signing) = %v, expected the supported key", err)
+	}
+	for _, kid := range []string{"ed25519", "secp256k1", "encryption"} {
+		if _, err := jwks.Key(kid); err == nil {
+			t.Errorf("Key(%s) succeeded, expected the key to be skipped", kid)
+		}
+	}
+
+	// a malformed key of a supported type still fails the load
+	malformed := map[string]string{"kty": "RSA", "kid": "malformed", "n": "not base64!", "e": "AQAB"}
+	if _, err := NewJWKS(writeJWKSFile(t, signingKey, malformed)); err == nil {
+		t.Error("NewJWKS() succeeded with a malformed RSA key, expected an error")
+	}
+}
+
+func TestJWKSRejectsPlainHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the JWKS was fetched over plain HTTP")
+	}))
+	defer server.Close()
+
+	if _, err := NewJWKS(server.URL); err == nil {
+		t.Error("NewJWKS() succeeded with an http URL, expected an error")
+	}
+}
+
+func TestJWKSReloadsWithoutBlockingKnownKeys(t *testing.T) {
+	_, firstKey := newTestKey(t, "first")
+	_, secondKey := newTestKey(t, "second")
+
+	var document atomic.Value
+	document.Store(jwksDocument(t, firstKey))
+	// the requests after the first one wait for release, as a slow JWKS endpoint would
+	release := make(chan struct{})
+	var requests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 1 {
+			<-release
+		}
+		w.Write(document.Load().([]byte))
+	}))
+	defer server.Close()
+
+	jwks, err := newJWKS(server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the key set is stale, and the rotated key is published
+	document.Store(jwksDocument(t, firstKey, secondKey))
+	jwks.mu.Lock()
+	jwks.loadedAt = time.Now().Add(-2 * jwksRefreshInterval)
+	jwks.attemptedAt = jwks.loadedAt
+	jwks.mu.Unlock()
+
+	// the known key is served at once while the reload waits on the endpoint
+	done := make(chan error, 1)
+	go func() {
+		_, err := jwks.Key("first")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Key(first) = %v during the reload, expected the known key", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Key(first) waited for the reload of the key set")
+	}
+
+	// a token signed with the rotated key waits for the reload in progress rather than starting another one
+	go func() {
+		_, err := jwks.Key("second")
+		done <- err
+	}()
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Key(second) = %v, expected the key published by the reload", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Key(second) did not return once the key set reloaded")
+	}
+	if count := requests.Load(); count != 2 {
+		t.Errorf("the JWKS was fetched %d times, expected 2", count)
+	}
+
+	// an unknown key does not reload the key set again before jwksMinRefreshInterval
+	if _, err := jwks.Key("third"); err == nil {
+		t.Error("Key(third) succeeded, expected an unknown key error")
+	}
+	if count := requests.Load(); count != 2 {
+		t.Errorf("the JWKS was fetched %d times, expected the reload to be rate limited", count)
+	}
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTokenParam is the query parameter carrying the token when the template does not set one
+	DefaultTokenParam = "code"
+	// LinkExpiresParam and LinkSignatureParam are the query parameters added to signed links
+	LinkExpiresParam   = "expires"
+	LinkSignatureParam = "signature"
+)
+
+// tokenParamPattern restricts the token parameter names to the ones that need no escaping
+var tokenParamPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// ValidateTokenParam checks the name of the query parameter carrying the token, empty meaning DefaultTokenParam
+func ValidateTokenParam(param string) error {
+	if param == "" {
+		return nil
+	}
+
+	if param == LinkExpiresParam || param == LinkSignatureParam || !tokenParamPattern.MatchString(param) {
+		return fmt.Errorf("invalid token parameter %q", param)
+	}
+
+	return nil
+}
+
+// ValidateRedirectURL checks that a redirect URL is an absolute HTTP or HTTPS URL
+func ValidateRedirectURL(redirectURL string) error {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return err
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("redirect URL %s is not an absolute HTTP URL", redirectURL)
+	}
+
+	return nil
+}
+
+// BuildRedirectURL adds the token to the query of the redirect URL, keeping its existing parameters in their order
+// and encoding, and its fragment. When linkTTL is set, the link also carries its expiry time as a Unix timestamp
+// and a signature of the token and the expiry time with signingKey, see SignLink.
+func BuildRedirectURL(redirectURL string, tokenParam string, token string, linkTTL time.Duration, signingKey []byte) (string, error) {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return "", err
+	}
+
+	if tokenParam == "" {
+		tokenParam = DefaultTokenParam
+	}
+
+	params := []string{tokenParam + "=" + url.QueryEscape(token)}
+
+	if linkTTL > 0 {
+		if len(signingKey) == 0 {
+			return "", errors.New("signed links require the LINK_SIGNING_KEY setting")
+		}
+
+		expires := time.Now().Add(linkTTL).Unix()
+		params = append(
+			params,
+			LinkExpiresParam+"="+strconv.FormatInt(expires, 10),
+			LinkSignatureParam+"="+SignLink(signingKey, token, expires),
+		)
+	}
+
+	// the parameters of the redirect URL with the names of the added ones are replaced
+	query := removeQueryParams(u.RawQuery, tokenParam, LinkExpiresParam, LinkSignatureParam)
+	u.RawQuery = strings.Join(append(query, params...), "&")
+
+	return u.String(), nil
+}
+
+// removeQueryParams splits a raw query into its parameters, leaving out the ones with the given names
+func removeQueryParams(rawQuery string, names ...string) []string {
+	params := []string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && slices.Contains(names, unescaped) {
+			continue
+		}
+		params = append(params, param)
+	}
+
+	return params
+}
+
+// SignLink returns the signature of a link, the unpadded base64url encoding of the HMAC-SHA256 of
+// "<token>.<expires>" where expires is the expiry Unix timestamp of the link. The application receiving
+// the link verifies it by computing the signature again and checking the expiry time.
+func SignLink(key []byte, token string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token + "." + strconv.FormatInt(expires, 10)))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseSecondsSetting parses a duration setting such as a link TTL, stored as a number of seconds
+func parseSecondsSetting(value sql.NullString) (time.Duration, error) {
+	if !value.Valid || value.String == "" {
+		return 0, nil
+	}
+
+	seconds, err := strconv.ParseInt(value.String, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid number of seconds %q", value.String)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBuildRedirectURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		redirectURL string
+		tokenParam  string
+		token       string
+		expected    string
+	}{
+		{"default parameter", "https://example.com/verify", "", "token", "https://example.com/verify?code=token"},
+		{"custom parameter", "https://example.com/verify", "t", "token", "https://example.com/verify?t=token"},
+		{"existing query kept in order", "https://example.com/verify?z=1&a=2", "", "token", "https://example.com/verify?z=1&a=2&code=token"},
+		{"existing encoding kept", "https://example.com/verify?next=%2Fhome&q=a+b", "", "token", "https://example.com/verify?next=%2Fhome&q=a+b&code=token"},
+		{"existing token replaced", "https://example.com/verify?code=old&lang=en", "", "token", "https://example.com/verify?lang=en&code=token"},
+		{"fragment kept", "https://example.com/app?lang=en#/verify", "", "token", "https://example.com/app?lang=en&code=token#/verify"},
+		{"token escaped", "https://example.com/verify", "", "a b&c=d/é", "https://example.com/verify?code=a+b%26c%3Dd%2F%C3%A9"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			redirectURL, err := BuildRedirectURL(test.redirectURL, test.tokenParam, test.token, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if redirectURL != test.expected {
+				t.Errorf("BuildRedirectURL() = %s, expected %s", redirectURL, test.expected)
+			}
+
+			u, err := url.Parse(redirectURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			param := test.tokenParam
+			if param == "" {
+				param = DefaultTokenParam
+			}
+			if token := u.Query().Get(param); token != test.token {
+				t.Errorf("the link carries the token %q, expected %q", token, test.token)
+			}
+		})
+	}
+}
+
+func TestBuildSignedRedirectURL(t *testing.T) {
+	key := []byte("signing-key")
+	token := "a b&c"
+
+	before := time.Now().Add(time.Hour).Unix()
+	redirectURL, err := BuildRedirectURL("https://example.com/verify?lang=en&signature=forged#top", "", token, time.Hour, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().Add(time.Hour).Unix()
+
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Fragment != "top" || u.Query().Get("lang") != "en" {
+		t.Errorf("BuildRedirectURL() = %s, expected the query and fragment of the redirect URL to be kept", redirectURL)
+	}
+
+	query := u.Query()
+	if len(query[LinkSignatureParam]) != 1 {
+		t.Fatalf("BuildRedirectURL() = %s, expected a single signature", redirectURL)
+	}
+
+	// the link expires after its TTL
+	expires, err := strconv.ParseInt(query.Get(LinkExpiresParam), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires < before || expires > after {
+		t.Errorf("the link expires at %d, expected between %d and %d", expires, before, after)
+	}
+
+	// the receiving application verifies the signature of the parameters it gets
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(query.Get(DefaultTokenParam) + "." + query.Get(LinkExpiresParam)))
+	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if signature := query.Get(LinkSignatureParam); signature != expected {
+		t.Errorf("the link is signed with %s, expected %s", signature, expected)
+	}
+
+	if _, err := BuildRedirectURL("https://example.com/verify", "", token, time.Hour, nil); err == nil {
+		t.Error("BuildRedirectURL() succeeded without a signing key, expected an error")
+	}
+}
+
+func TestSignLink(t *testing.T) {
+	key := []byte("signing-key")
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	signature := SignLink(key, "token", expires)
+
+	if again := SignLink(key, "token", expires); again != signature {
+		t.Errorf("SignLink() = %s then %s, expected the same signature", signature, again)
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(signature); err != nil || len(signature) != 43 {
+		t.Errorf("SignLink() = %s, expected an unpadded base64url HMAC-SHA256", signature)
+	}
+
+	// any change to the token, the expiry time or the key changes the signature
+	for name, changed := range map[string]string{
+		"token":  SignLink(key, "other-token", expires),
+		"expiry": SignLink(key, "token", expires+1),
+		"key":    SignLink([]byte("other-key"), "token", expires),
+	} {
+		if changed == signature {
+			t.Errorf("changing the %s kept the signature %s", name, signature)
+		}
+	}
+}
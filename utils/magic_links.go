@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+// DefaultMagicLinkTTL is how long a magic link can be used when its template does not set a TTL
+const DefaultMagicLinkTTL = 15 * time.Minute
+
+var (
+	ErrMagicLinkNotFound = errors.New("magic link not found")
+	// ErrMagicLinkUnavailable is returned for the magic links that expired or were already used
+	ErrMagicLinkUnavailable = errors.New("magic link expired or was already used")
+)
+
+// NewMagicLinkToken returns a random 256 bits token encoded as unpadded base64url
+func NewMagicLinkToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// InsertMagicLink stores the hash of the token sent in the given email, valid for ttl or DefaultMagicLinkTTL when zero.
+// The token having 256 bits of entropy, it is hashed without a salt so it can be looked up by its hash.
+func InsertMagicLink(db *database.DB, messageID string, recipient string, token string, ttl time.Duration) error {
+	if ttl == 0 {
+		ttl = DefaultMagicLinkTTL
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO magic_links (token_hash, message_id, recipient, expires_at) VALUES (?, ?, ?, ?)",
+		hashMagicLinkToken(token),
+		messageID,
+		recipient,
+		time.Now().Add(ttl).UTC(),
+	)
+
+	return err
+}
+
+// ConsumeMagicLink burns a magic link token and returns the recipient and message ID of the email it was sent in
+func ConsumeMagicLink(db *database.DB, token string) (string, string, error) {
+	tokenHash := hashMagicLinkToken(token)
+
+	now := time.Now().UTC()
+	result, err := db.Exec(
+		"UPDATE magic_links SET consumed_at = ? WHERE token_hash = ? AND consumed_at IS NULL AND expires_at > ?",
+		now,
+		tokenHash,
+		now,
+	)
+	if err != nil {
+		return "", "", err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", "", err
+	}
+
+	var recipient, messageID string
+	err = db.QueryRow("SELECT recipient, message_id FROM magic_links WHERE token_hash = ?", tokenHash).Scan(&recipient, &messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrMagicLinkNotFound
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	// the token exists but was not burned by this call
+	if rowsAffected == 0 {
+		return "", "", ErrMagicLinkUnavailable
+	}
+
+	return recipient, messageID, nil
+}
+
+func hashMagicLinkToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+const (
+	TemplateFormatHTML     = "html"
+	TemplateFormatMarkdown = "markdown"
+
+	// MarkdownTemplateName is the name the markdown source of a body is defined as in the template set,
+	// the "content" template rendering its conversion to HTML
+	MarkdownTemplateName = "markdown"
+	// DefaultLayoutName is the layout markdown bodies are wrapped in when their template sets none.
+	// A stored layout of the same name replaces the built-in one.
+	DefaultLayoutName = "default"
+)
+
+const defaultLayout = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+</head>
+<body style="margin: 0; padding: 24px; font-family: Helvetica, Arial, sans-serif; font-size: 16px; line-height: 1.5; color: #222222;">
+{{template "content" .}}
+</body>
+</html>`
+
+// markdownSyntax are the ASCII punctuation characters CommonMark lets a backslash escape, less the ones
+// html/template escapes as entities, which markdown renders as text already
+const markdownSyntax = "!#$%()*,-./:;=?@[\\]^_`{|}~"
+
+// markdown converts the GitHub flavored markdown of the template bodies. Raw HTML is left out of the output,
+// the HTML of an email belonging to its layout.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// MarkdownToHTML converts a rendered markdown body to HTML
+func MarkdownToHTML(source string) (string, error) {
+	var buffer bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buffer); err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+// escapeMarkdown escapes the markdown syntax of a value so it renders as the same text, a link or an image
+// in a variable being shown as written rather than rendered. Markdown removes the escapes in a link destination
+// too, so an escaped value still works as a URL the template links to.
+func escapeMarkdown(value string) string {
+	var escaped strings.Builder
+	for _, c := range value {
+		if strings.ContainsRune(markdownSyntax, c) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(c)
+	}
+
+	return escaped.String()
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBodyTemplateEscapesMarkdownVariables(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		// text is what the HTML body must show for the value
+		text string
+	}{
+		{"inline link", "[Reset here](https://evil.example)", "[Reset here](https://evil.example)"},
+		{"image", "![logo](https://evil.example/logo.png)", "![logo](https://evil.example/logo.png)"},
+		{"reference link", "[Reset here][evil]\n\n[evil]: https://evil.example", "[Reset here][evil]"},
+		{"autolink", "<https://evil.example>", "&lt;https://evil.example&gt;"},
+		{"bare URL", "https://evil.example/reset", "https://evil.example/reset"},
+		{"bare domain", "www.evil.example", "www.evil.example"},
+		{"email address", "support@evil.example", "support@evil.example"},
+		{"raw HTML", `<a href="https://evil.example">Reset here</a>`, "&lt;a href=&quot;https://evil.example&quot;&gt;Reset here&lt;/a&gt;"},
+		{"emphasis", "*urgent* _now_", "*urgent* _now_"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			details := EmailTemplateDetails{
+				BodyTemplate: "Hello {{.Variables.name}},\n\n[Verify your email]({{.RedirectURL}})",
+				RedirectURL:  "https://example.com/verify?code=token",
+				Format:       TemplateFormatMarkdown,
+				Variables:    map[string]string{"name": test.value},
+			}
+
+			body, text, err := ParseBodyTemplate(details, "markdown-variables-"+test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Contains(body, "evil.example\"") || strings.Contains(body, "<img") || strings.Count(body, "<a ") != 1 {
+				t.Errorf("the variable was rendered as markdown:\n%s", body)
+			}
+			if !strings.Contains(body, `<a href="https://example.com/verify?code=token">Verify your email</a>`) {
+				t.Errorf("the link of the template is missing:\n%s", body)
+			}
+			if !strings.Contains(body, test.text) {
+				t.Errorf("the body does not show %q:\n%s", test.text, body)
+			}
+			// the plain text shows the value as it was given
+			if !strings.Contains(text, test.value) {
+				t.Errorf("the plain text does not contain %q:\n%s", test.value, text)
+			}
+		})
+	}
+}
+
+func TestParseBodyTemplateLinksToEscapedVariables(t *testing.T) {
+	details := EmailTemplateDetails{
+		BodyTemplate: "[Open your invoice]({{.Variables.invoice_url}})",
+		RedirectURL:  "https://example.com/",
+		Format:       TemplateFormatMarkdown,
+		Variables:    map[string]string{"invoice_url": "https://example.com/invoices/1_2?download=true#top"},
+	}
+
+	body, _, err := ParseBodyTemplate(details, "markdown-variable-link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(body, `<a href="https://example.com/invoices/1_2?download=true#top">Open your invoice</a>`) {
+		t.Errorf("the link to the variable is broken:\n%s", body)
+	}
+}
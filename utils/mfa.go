@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+const (
+	DefaultMFACodeLength = 6
+	MinMFACodeLength     = 4
+	MaxMFACodeLength     = 10
+	DefaultMFACodeTTL    = 10 * time.Minute
+	// MFACodeMaxAttempts is the number of wrong codes after which a code can no longer be verified
+	MFACodeMaxAttempts = 5
+)
+
+var (
+	// ErrMFACodeKeyNotSet is returned when generating a code without the MFA_CODE_KEY setting
+	ErrMFACodeKeyNotSet = errors.New("generated MFA codes require the MFA_CODE_KEY setting")
+	ErrMFACodeNotFound  = errors.New("MFA code not found")
+	// ErrMFACodeUnavailable is returned for the codes that expired, were used or ran out of attempts
+	ErrMFACodeUnavailable = errors.New("MFA code expired, was already used or exceeded its attempts")
+)
+
+// GenerateMFACode returns a random numeric code of the given length, DefaultMFACodeLength when zero
+func GenerateMFACode(length int) (string, error) {
+	if length == 0 {
+		length = DefaultMFACodeLength
+	}
+
+	if length < MinMFACodeLength || length > MaxMFACodeLength {
+		return "", fmt.Errorf("MFA code length must be between %d and %d", MinMFACodeLength, MaxMFACodeLength)
+	}
+
+	code := make([]byte, length)
+	for i := range code {
+		digit, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code[i] = byte('0' + digit.Int64())
+	}
+
+	return string(code), nil
+}
+
+// InsertMFACode stores the HMAC of a code sent in the given email keyed with the server key, valid for ttl
+// or DefaultMFACodeTTL when zero
+func InsertMFACode(db *database.DB, key []byte, messageID string, recipient string, code string, ttl time.Duration) error {
+	if len(key) == 0 {
+		return ErrMFACodeKeyNotSet
+	}
+
+	if ttl == 0 {
+		ttl = DefaultMFACodeTTL
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO mfa_codes (message_id, recipient, code_hash, salt, expires_at) VALUES (?, ?, ?, ?, ?)",
+		messageID,
+		recipient,
+		hashMFACode(key, salt, code),
+		salt,
+		time.Now().Add(ttl).UTC(),
+	)
+
+	return err
+}
+
+// VerifyMFACode checks the code sent in the given email. A wrong code uses up one attempt and the remaining
+// attempts are returned, a right code is consumed so it cannot be verified again.
+func VerifyMFACode(db *database.DB, key []byte, messageID string, code string) (bool, int, error) {
+	var codeHash, salt []byte
+	var attempts int
+	err := db.QueryRow("SELECT code_hash, salt, attempts FROM mfa_codes WHERE message_id = ?", messageID).Scan(&codeHash, &salt, &attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, 0, ErrMFACodeNotFound
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	// count the attempt first so concurrent guesses cannot exceed the limit
+	result, err := db.Exec(
+		"UPDATE mfa_codes SET attempts = attempts + 1 WHERE message_id = ? AND attempts < ? AND consumed_at IS NULL AND expires_at > ?",
+		messageID,
+		MFACodeMaxAttempts,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return false, 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, 0, err
+	}
+	if rowsAffected == 0 {
+		return false, 0, ErrMFACodeUnavailable
+	}
+
+	if !hmac.Equal(hashMFACode(key, salt, code), codeHash) {
+		return false, MFACodeMaxAttempts - attempts - 1, nil
+	}
+
+	result, err = db.Exec("UPDATE mfa_codes SET consumed_at = ? WHERE message_id = ? AND consumed_at IS NULL", time.Now().UTC(), messageID)
+	if err != nil {
+		return false, 0, err
+	}
+
+	rowsAffected, err = result.RowsAffected()
+	if err != nil {
+		return false, 0, err
+	}
+	if rowsAffected == 0 {
+		return false, 0, ErrMFACodeUnavailable
+	}
+
+	return true, 0, nil
+}
+
+// hashMFACode returns the HMAC-SHA256 of a salted code. The codes are too short for a plain hash to hide them,
+// so the hashes cannot be checked against every code without the key, which is not stored in the database.
+func hashMFACode(key []byte, salt []byte, code string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte(code))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// parseMFACodeLength parses the MFA code length setting, zero meaning DefaultMFACodeLength
+func parseMFACodeLength(value sql.NullString) (int, error) {
+	if !value.Valid || value.String == "" {
+		return 0, nil
+	}
+
+	length, err := strconv.Atoi(value.String)
+	if err != nil || length < 0 {
+		return 0, fmt.Errorf("invalid MFA code length %q", value.String)
+	}
+
+	return length, nil
+}
@@ -0,0 +1,16 @@
+package utils
+
+import (
+	"github.com/isaacwassou/email-service/database"
+)
+
+const (
+	TemplatePartialKindLayout  = "layout"
+	TemplatePartialKindPartial = "partial"
+
+	// ContentTemplateName is the name the email body is defined under, layouts render it with {{template "content" .}}
+	ContentTemplateName = "content"
+)
+
+// TemplatePartial is a named layout or partial shared by the email templates
+type TemplatePartial = database.TemplatePartial
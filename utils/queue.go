@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+const (
+	// QueueMaxAttempts is the number of attempts after which a queued email is marked as failed
+	QueueMaxAttempts = 5
+	// queueBaseBackoff is the delay before retrying a queued email the first time
+	queueBaseBackoff = 1 * time.Minute
+	// queueMaxBackoff caps the delay between two attempts of a queued email
+	queueMaxBackoff = 1 * time.Hour
+	// queueLockDuration is how long a replica owns a queued email while sending it
+	queueLockDuration = 5 * time.Minute
+	// queueMarkSentAttempts is the number of attempts at recording that an email was sent, all made well within
+	// queueLockDuration
+	queueMarkSentAttempts = 5
+	// queueMarkSentBackoff is the delay before recording that an email was sent again the first time
+	queueMarkSentBackoff = 1 * time.Second
+)
+
+// QueuedEmail is a rendered email waiting in the queue to be sent
+type QueuedEmail = database.QueuedEmail
+
+// EnqueueEmails stores rendered emails and their attachments to be sent once their send_at time is due
+func EnqueueEmails(db *database.DB, emails []QueuedEmail) error {
+	ctx := context.Background()
+	return WithTx(ctx, db, func(tx *database.Tx) error {
+		return tx.Repository().EnqueueEmails(ctx, emails)
+	})
+}
+
+// ClaimQueuedEmail locks a due email for the caller for queueLockDuration. It reports false when another replica
+// claimed the email first or when it was cancelled in the meantime.
+//
+// The queue delivers at least once: an email whose lock expires before it is marked as sent or failed is claimed
+// and sent again, so it may reach its recipient twice when the replica sending it stops or cannot record the sending.
+func ClaimQueuedEmail(ctx context.Context, db *database.DB, id int64) (QueuedEmail, bool, error) {
+	now := time.Now()
+	return db.Repository().ClaimQueuedEmail(ctx, id, now, now.Add(queueLockDuration))
+}
+
+// MarkQueuedEmailSent records that a claimed email was accepted by the SMTP server. As the email would be sent again
+// once its lock expires, the update is retried while the email is still locked and is not cancelled with ctx.
+func MarkQueuedEmailSent(ctx context.Context, db *database.DB, id int64) error {
+	ctx = context.WithoutCancel(ctx)
+
+	var err error
+	for attempt := 1; attempt <= queueMarkSentAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(ExponentialBackoff(queueMarkSentBackoff, queueLockDuration, attempt-1))
+		}
+
+		if err = db.Repository().MarkQueuedEmailSent(ctx, id); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// MarkQueuedEmailFailed records a failed attempt of a claimed email. The email is retried with backoff
+// until it reaches QueueMaxAttempts, and the returned flag reports whether it was given up on. An email
+// the SMTP server cannot accept, as it does not support SMTPUTF8, is given up on at once.
+func MarkQueuedEmailFailed(ctx context.Context, db *database.DB, email QueuedEmail, sendErr error) (bool, error) {
+	attempts := email.Attempts + 1
+
+	if attempts >= QueueMaxAttempts || errors.Is(sendErr, ErrSMTPUTF8Unsupported) {
+		return true, db.Repository().FailQueuedEmail(ctx, email.ID, attempts, sendErr.Error())
+	}
+
+	sendAt := time.Now().Add(ExponentialBackoff(queueBaseBackoff, queueMaxBackoff, attempts))
+	return false, db.Repository().RetryQueuedEmail(ctx, email.ID, attempts, sendErr.Error(), sendAt)
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEmailQueue(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	err := EnqueueEmails(db, []QueuedEmail{
+		{
+			MessageID:     "due",
+			EmailType:     "EMAIL_VERIFICATION",
+			Recipient:     "user@example.com",
+			RecipientName: "User",
+			Subject:       "Subject",
+			Body:          "<p>Body</p>",
+			TextBody:      "Body",
+			SendAt:        time.Now().Add(-time.Minute),
+			Attachments:   []Attachment{{Filename: "file.txt", ContentType: "text/plain", Content: []byte("content")}},
+		},
+		{MessageID: "scheduled", EmailType: "EMAIL_VERIFICATION", Recipient: "user@example.com", Subject: "Subject", Body: "Body", SendAt: time.Now().Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := db.Repository().GetDueEmailIDs(ctx, time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("%d emails are due, expected only the one whose send_at passed", len(ids))
+	}
+
+	email, claimed, err := ClaimQueuedEmail(ctx, db, ids[0])
+	if err != nil || !claimed {
+		t.Fatalf("ClaimQueuedEmail() = %t, %v, expected the email to be claimed", claimed, err)
+	}
+	if email.MessageID != "due" || email.RecipientName != "User" || email.TextBody != "Body" || len(email.Attachments) != 1 || string(email.Attachments[0].Content) != "content" {
+		t.Errorf("claimed %+v, expected the stored email with its attachment", email)
+	}
+
+	// a claimed email is neither due nor claimed twice until its lock expires
+	if _, claimed, err := ClaimQueuedEmail(ctx, db, ids[0]); err != nil || claimed {
+		t.Errorf("ClaimQueuedEmail() = %t, %v for a claimed email, expected false", claimed, err)
+	}
+	if ids, err := db.Repository().GetDueEmailIDs(ctx, time.Now(), 10); err != nil || len(ids) != 0 {
+		t.Errorf("GetDueEmailIDs() = %v, %v while the email is claimed, expected none", ids, err)
+	}
+
+	// a failed attempt is retried later, until the attempts run out
+	gaveUp, err := MarkQueuedEmailFailed(ctx, db, email, errors.New("connection refused"))
+	if err != nil || gaveUp {
+		t.Fatalf("MarkQueuedEmailFailed() = %t, %v on the first attempt, expected a retry", gaveUp, err)
+	}
+	var status string
+	var sendAt time.Time
+	if err := db.QueryRow("SELECT status, send_at FROM email_queue WHERE id = ?", email.ID).Scan(&status, &sendAt); err != nil {
+		t.Fatal(err)
+	}
+	if status != "pending" || !sendAt.After(time.Now()) {
+		t.Errorf("the failed email is %s to be sent at %s, expected pending in the future", status, sendAt)
+	}
+
+	// an email the server cannot accept is not retried
+	unsupported := fmt.Errorf("%w, required to send to or from δοκιμή@example.com", ErrSMTPUTF8Unsupported)
+	if gaveUp, err := MarkQueuedEmailFailed(ctx, db, email, unsupported); err != nil || !gaveUp {
+		t.Errorf("MarkQueuedEmailFailed() = %t, %v without SMTPUTF8 support, expected the email to be given up on", gaveUp, err)
+	}
+	if err := db.QueryRow("SELECT status FROM email_queue WHERE id = ?", email.ID).Scan(&status); err != nil || status != "failed" {
+		t.Errorf("the email is %s, %v without SMTPUTF8 support, expected failed", status, err)
+	}
+
+	email.Attempts = QueueMaxAttempts - 1
+	if gaveUp, err := MarkQueuedEmailFailed(ctx, db, email, errors.New("connection refused")); err != nil || !gaveUp {
+		t.Errorf("MarkQueuedEmailFailed() = %t, %v on the last attempt, expected the email to be given up on", gaveUp, err)
+	}
+
+	if exists, cancelled, err := db.Repository().CancelQueuedEmail(ctx, "due"); err != nil || !exists || cancelled {
+		t.Errorf("CancelQueuedEmail() = %t, %t, %v for a failed email, expected it to exist and not be cancelled", exists, cancelled, err)
+	}
+	if exists, cancelled, err := db.Repository().CancelQueuedEmail(ctx, "scheduled"); err != nil || !exists || !cancelled {
+		t.Errorf("CancelQueuedEmail() = %t, %t, %v for a pending email, expected it to be cancelled", exists, cancelled, err)
+	}
+	if exists, cancelled, err := db.Repository().CancelQueuedEmail(ctx, "missing"); err != nil || exists || cancelled {
+		t.Errorf("CancelQueuedEmail() = %t, %t, %v for a missing email, expected it not to exist", exists, cancelled, err)
+	}
+}
+
+func TestMarkQueuedEmailSent(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	err := EnqueueEmails(db, []QueuedEmail{{MessageID: "message", EmailType: "MFA", Recipient: "user@example.com", Subject: "Subject", Body: "Body", SendAt: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := db.Repository().GetDueEmailIDs(ctx, time.Now(), 10)
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("GetDueEmailIDs() = %v, %v, expected the queued email", ids, err)
+	}
+	if _, claimed, err := ClaimQueuedEmail(ctx, db, ids[0]); err != nil || !claimed {
+		t.Fatalf("ClaimQueuedEmail() = %t, %v, expected the email to be claimed", claimed, err)
+	}
+
+	// the sending is recorded even when the scheduler is stopping
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := MarkQueuedEmailSent(cancelledCtx, db, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	var status string
+	var attempts int
+	if err := db.QueryRow("SELECT status, attempts FROM email_queue WHERE id = ?", ids[0]).Scan(&status, &attempts); err != nil {
+		t.Fatal(err)
+	}
+	if status != "sent" || attempts != 1 {
+		t.Errorf("the email is %s after %d attempts, expected sent after 1", status, attempts)
+	}
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+type RedirectOrigin struct {
+	Origin    string
+	CreatedAt time.Time
+}
+
+// NormalizeOrigin returns the origin of a URL as scheme://host[:port], lowercased and without the default port
+func NormalizeOrigin(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if (scheme != "http" && scheme != "https") || u.Hostname() == "" || u.User != nil {
+		return "", fmt.Errorf("%s is not an HTTP origin", rawURL)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	port := u.Port()
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host += ":" + port
+	}
+
+	return scheme + "://" + host, nil
+}
+
+// InsertRedirectOrigin adds an origin to the allowlist, reporting false when it was already there
+func InsertRedirectOrigin(db *database.DB, origin string) (bool, error) {
+	result, err := db.Exec(db.Dialect.InsertIgnore("redirect_origins", []string{"origin"}), origin)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+func GetRedirectOrigins(db *database.DB) ([]RedirectOrigin, error) {
+	rows, err := db.Query("SELECT origin, created_at FROM redirect_origins ORDER BY origin")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	origins := []RedirectOrigin{}
+	for rows.Next() {
+		var origin RedirectOrigin
+		if err := rows.Scan(&origin.Origin, &origin.CreatedAt); err != nil {
+			return nil, err
+		}
+		origins = append(origins, origin)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return origins, nil
+}
+
+// IsRedirectOriginAllowed reports whether the origin of a redirect URL is in the allowlist
+func IsRedirectOriginAllowed(db *database.DB, redirectURL string) (bool, error) {
+	origin, err := NormalizeOrigin(redirectURL)
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM redirect_origins WHERE origin = ?", origin).Scan(&count)
+
+	return count > 0, err
+}
+
+// DeleteRedirectOrigin removes an origin from the allowlist, reporting false when it was not there
+func DeleteRedirectOrigin(db *database.DB, origin string) (bool, error) {
+	result, err := db.Exec("DELETE FROM redirect_origins WHERE origin = ?", origin)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// GetRedirectURLSettings returns the redirect URLs of the configured templates by setting name
+func GetRedirectURLSettings(db *database.DB) (map[string]string, error) {
+	// the underscores are escaped with ! rather than a backslash, which MySQL reads as an escape in string literals
+	rows, err := db.Query("SELECT name, value FROM settings WHERE name LIKE '%!_REDIRECT!_URL' ESCAPE '!' AND value IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	redirectURLs := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		redirectURLs[name] = value
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return redirectURLs, nil
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetRedirectURLSettings(t *testing.T) {
+	db := newTestDB(t)
+	setSettings(t, db, map[string]*string{
+		"EMAIL_VERIFICATION_REDIRECT_URL": ptr("https://example.com/verify"),
+		"PASSWORD_RESET_REDIRECT_URL":     ptr("https://example.com/reset"),
+		"MFA_VERIFICATION_REDIRECT_URL":   nil,
+		// matches the pattern only when the underscores are not escaped
+		"SMTPXREDIRECTXURL": ptr("https://example.com/other"),
+	})
+
+	redirectURLs, err := GetRedirectURLSettings(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"EMAIL_VERIFICATION_REDIRECT_URL": "https://example.com/verify",
+		"PASSWORD_RESET_REDIRECT_URL":     "https://example.com/reset",
+	}
+	if !reflect.DeepEqual(redirectURLs, expected) {
+		t.Errorf("GetRedirectURLSettings() = %v, expected %v", redirectURLs, expected)
+	}
+}
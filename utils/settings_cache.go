@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/isaacwassou/email-service/database"
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+)
+
+// settingsVersionCheckInterval is how often the cache compares its version with the one in the database,
+// which bounds how long a replica keeps serving settings changed through another replica
+const settingsVersionCheckInterval = 2 * time.Second
+
+// ErrSMTPConfigNotSet is returned when some of the SMTP settings are missing
+var ErrSMTPConfigNotSet = errors.New("SMTP configuration is not set!")
+
+// SettingsCache keeps the SMTP configuration, with its password decrypted, and the email templates in memory
+// so sending does not query the database and the cryptography service every time. The entries expire after
+// the TTL and are dropped as soon as the settings version in the database changes, which every write to the
+// settings increments.
+type SettingsCache struct {
+	db  *database.DB
+	ttl time.Duration
+
+	mu        sync.Mutex
+	version   int64
+	checkedAt time.Time
+	smtp      *cacheEntry[SMTPConfig]
+	templates map[pb.EmailType]cacheEntry[EmailTemplateDetails]
+}
+
+type cacheEntry[T any] struct {
+	value    T
+	version  int64
+	loadedAt time.Time
+}
+
+// NewSettingsCache creates a cache whose entries expire after ttl, a ttl of zero or less disabling the cache
+func NewSettingsCache(db *database.DB, ttl time.Duration) *SettingsCache {
+	return &SettingsCache{
+		db:        db,
+		ttl:       ttl,
+		templates: map[pb.EmailType]cacheEntry[EmailTemplateDetails]{},
+	}
+}
+
+// GetSMTPConfig returns the SMTP configuration with the password decrypted by decrypt
+func (c *SettingsCache) GetSMTPConfig(ctx context.Context, decrypt func(context.Context, string) (string, error)) (SMTPConfig, error) {
+	version, err := c.currentVersion()
+	if err != nil {
+		return SMTPConfig{}, err
+	}
+
+	c.mu.Lock()
+	entry := c.smtp
+	c.mu.Unlock()
+	if entry != nil && c.fresh(entry.version, entry.loadedAt, version) {
+		return entry.value, nil
+	}
+
+	smtpConfig, err := GetSMTPConfig(c.db)
+	if err != nil {
+		return SMTPConfig{}, err
+	}
+
+	if !CheckSMTPConfig(smtpConfig) {
+		return SMTPConfig{}, ErrSMTPConfigNotSet
+	}
+
+	smtpConfig.Password, err = decrypt(ctx, smtpConfig.Password)
+	if err != nil {
+		return SMTPConfig{}, err
+	}
+
+	c.mu.Lock()
+	c.smtp = &cacheEntry[SMTPConfig]{value: smtpConfig, version: version, loadedAt: time.Now()}
+	c.mu.Unlock()
+
+	return smtpConfig, nil
+}
+
+// GetEmailTemplateDetails returns the template details of the email type along with the layouts and partials
+func (c *SettingsCache) GetEmailTemplateDetails(emailType pb.EmailType) (EmailTemplateDetails, error) {
+	version, err := c.currentVersion()
+	if err != nil {
+		return EmailTemplateDetails{}, err
+	}
+
+	c.mu.Lock()
+	entry, found := c.templates[emailType]
+	c.mu.Unlock()
+	if found && c.fresh(entry.version, entry.loadedAt, version) {
+		return entry.value, nil
+	}
+
+	details, err := GetEmailTemplateDetails(c.db.Repository(), emailType)
+	if err != nil {
+		return EmailTemplateDetails{}, err
+	}
+
+	c.mu.Lock()
+	c.templates[emailType] = cacheEntry[EmailTemplateDetails]{value: details, version: version, loadedAt: time.Now()}
+	c.mu.Unlock()
+
+	return details, nil
+}
+
+// Clear drops the cached entries of this replica, to be called once a change to the settings is committed
+func (c *SettingsCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.smtp = nil
+	c.templates = map[pb.EmailType]cacheEntry[EmailTemplateDetails]{}
+	c.checkedAt = time.Time{}
+}
+
+// fresh reports whether an entry loaded at the given version and time can still be served
+func (c *SettingsCache) fresh(entryVersion int64, loadedAt time.Time, version int64) bool {
+	return c.ttl > 0 && entryVersion == version && time.Since(loadedAt) < c.ttl
+}
+
+// currentVersion returns the settings version, read from the database at most every settingsVersionCheckInterval.
+// The entries are tagged with the version read before they were loaded, so an entry loaded while a change was
+// being committed is dropped at the next check.
+func (c *SettingsCache) currentVersion() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl <= 0 || time.Since(c.checkedAt) < settingsVersionCheckInterval {
+		return c.version, nil
+	}
+
+	version, err := c.db.Repository().GetSettingsVersion(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	c.version = version
+	c.checkedAt = time.Now()
+
+	return version, nil
+}
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+)
+
+func TestSettingsCacheDropsChangedSettings(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	setSettings(t, db, map[string]*string{
+		"MFA_VERIFICATION_SUBJECT":      ptr("Subject"),
+		"MFA_VERIFICATION_BODY":         ptr("{{.Code}}"),
+		"MFA_VERIFICATION_REDIRECT_URL": ptr("https://example.com/"),
+	})
+
+	cache := NewSettingsCache(db, time.Hour)
+	if details, err := cache.GetEmailTemplateDetails(pb.EmailType_MFA); err != nil || details.Subject != "Subject" {
+		t.Fatalf("GetEmailTemplateDetails() = %+v, %v, expected the stored subject", details, err)
+	}
+
+	// a change without a version increment is not seen until the entry expires
+	setSettings(t, db, map[string]*string{"MFA_VERIFICATION_SUBJECT": ptr("Changed subject")})
+	if details, err := cache.GetEmailTemplateDetails(pb.EmailType_MFA); err != nil || details.Subject != "Subject" {
+		t.Errorf("GetEmailTemplateDetails() = %+v, %v, expected the cached subject", details, err)
+	}
+
+	if err := db.Repository().IncrementSettingsVersion(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := db.Repository().GetSettingsVersion(ctx); err != nil || version != 1 {
+		t.Errorf("GetSettingsVersion() = %d, %v, expected 1", version, err)
+	}
+
+	// the version is read again once the check interval passed
+	cache.mu.Lock()
+	cache.checkedAt = time.Time{}
+	cache.mu.Unlock()
+	if details, err := cache.GetEmailTemplateDetails(pb.EmailType_MFA); err != nil || details.Subject != "Changed subject" {
+		t.Errorf("GetEmailTemplateDetails() = %+v, %v, expected the changed subject", details, err)
+	}
+}
+
+func TestSettingsCacheDecryptsOncePerVersion(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	setSettings(t, db, map[string]*string{
+		"SMTP_HOST":     ptr("smtp.example.com"),
+		"SMTP_PORT":     ptr("587"),
+		"SMTP_USER":     ptr("user"),
+		"SMTP_PASSWORD": ptr("encrypted:password"),
+		"SMTP_SENDER":   ptr("Example <noreply@example.com>"),
+	})
+
+	decrypts := 0
+	var decryptErr error
+	decrypt := func(ctx context.Context, ciphertext string) (string, error) {
+		decrypts++
+		if decryptErr != nil {
+			return "", decryptErr
+		}
+		return strings.TrimPrefix(ciphertext, "encrypted:"), nil
+	}
+
+	cache := NewSettingsCache(db, time.Hour)
+	for i := 0; i < 3; i++ {
+		smtpConfig, err := cache.GetSMTPConfig(ctx, decrypt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if smtpConfig.Password != "password" {
+			t.Errorf("GetSMTPConfig() returned the password %q, expected it decrypted", smtpConfig.Password)
+		}
+	}
+	if decrypts != 1 {
+		t.Errorf("the password was decrypted %d times, expected once", decrypts)
+	}
+
+	// a new settings version is decrypted again once it is read
+	if err := db.Repository().IncrementSettingsVersion(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetSMTPConfig(ctx, decrypt); err != nil || decrypts != 1 {
+		t.Errorf("GetSMTPConfig() = %v after %d decryptions, expected the cached password until the version is checked", err, decrypts)
+	}
+	cache.mu.Lock()
+	cache.checkedAt = time.Time{}
+	cache.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetSMTPConfig(ctx, decrypt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if decrypts != 2 {
+		t.Errorf("the password was decrypted %d times, expected once per version", decrypts)
+	}
+
+	// a failed decryption is not cached
+	decryptErr = errors.New("cryptography service unavailable")
+	cache.Clear()
+	if _, err := cache.GetSMTPConfig(ctx, decrypt); !errors.Is(err, decryptErr) {
+		t.Errorf("GetSMTPConfig() = %v, expected the error of the decryption", err)
+	}
+	decryptErr = nil
+	if smtpConfig, err := cache.GetSMTPConfig(ctx, decrypt); err != nil || smtpConfig.Password != "password" || decrypts != 4 {
+		t.Errorf("GetSMTPConfig() = %+v, %v after %d decryptions, expected the password decrypted again", smtpConfig, err, decrypts)
+	}
+
+	// without a TTL the password is decrypted every time
+	uncached := NewSettingsCache(db, 0)
+	decrypts = 0
+	for i := 0; i < 2; i++ {
+		if _, err := uncached.GetSMTPConfig(ctx, decrypt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if decrypts != 2 {
+		t.Errorf("the password was decrypted %d times without a TTL, expected 2", decrypts)
+	}
+}
+
+func TestSettingsCacheIncompleteSMTPConfig(t *testing.T) {
+	db := newTestDB(t)
+	setSettings(t, db, map[string]*string{"SMTP_HOST": ptr("smtp.example.com"), "SMTP_PORT": ptr("587")})
+
+	decrypt := func(ctx context.Context, ciphertext string) (string, error) {
+		t.Error("an incomplete configuration was decrypted")
+		return ciphertext, nil
+	}
+	if _, err := NewSettingsCache(db, time.Hour).GetSMTPConfig(context.Background(), decrypt); !errors.Is(err, ErrSMTPConfigNotSet) {
+		t.Errorf("GetSMTPConfig() = %v, expected ErrSMTPConfigNotSet", err)
+	}
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// SMTPPool sends messages over a bounded set of reusable SMTP connections,
+// throttled to a maximum number of messages per second
+type SMTPPool struct {
+	dialer   *gomail.Dialer
+	slots    chan struct{}
+	throttle *time.Ticker
+
+	mu   sync.Mutex
+	idle []gomail.SendCloser
+}
+
+// NewSMTPPool creates a pool of at most size connections sending at most rate messages per second.
+// A rate of zero or less disables the throttling.
+func NewSMTPPool(dialer *gomail.Dialer, size int, rate float64) *SMTPPool {
+	if size < 1 {
+		size = 1
+	}
+
+	pool := &SMTPPool{
+		dialer: dialer,
+		slots:  make(chan struct{}, size),
+	}
+
+	if rate > 0 {
+		pool.throttle = time.NewTicker(time.Duration(float64(time.Second) / rate))
+	}
+
+	return pool
+}
+
+// Send waits for the throttle and a free connection, then sends the message.
+// A connection that fails is closed and the message is retried once on a fresh one.
+func (p *SMTPPool) Send(ctx context.Context, m *gomail.Message) error {
+	if err := CheckSMTPUTF8(p.dialer, m); err != nil {
+		return err
+	}
+
+	if p.throttle != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.throttle.C:
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case p.slots <- struct{}{}:
+	}
+	defer func() { <-p.slots }()
+
+	conn, reused, err := p.get()
+	if err != nil {
+		return err
+	}
+
+	err = gomail.Send(conn, m)
+	if err != nil && reused {
+		// the idle connection may have been closed by the server, retry on a new one
+		conn.Close()
+		conn, err = p.dialer.Dial()
+		if err != nil {
+			return err
+		}
+		err = gomail.Send(conn, m)
+	}
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.put(conn)
+
+	return nil
+}
+
+// Close closes the idle connections and stops the throttle
+func (p *SMTPPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range p.idle {
+		conn.Close()
+	}
+	p.idle = nil
+
+	if p.throttle != nil {
+		p.throttle.Stop()
+	}
+}
+
+// get returns an idle connection when there is one and dials a new one otherwise
+func (p *SMTPPool) get() (gomail.SendCloser, bool, error) {
+	p.mu.Lock()
+	if len(p.idle) > 0 {
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+		return conn, true, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := p.dialer.Dial()
+	return conn, false, err
+}
+
+func (p *SMTPPool) put(conn gomail.SendCloser) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.idle = append(p.idle, conn)
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/gomail.v2"
+
+	"github.com/isaacwassou/email-service/testutil"
+)
+
+func newTestMessage(to string) *gomail.Message {
+	m := gomail.NewMessage()
+	m.SetHeader("From", "sender@example.com")
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", "Subject")
+	m.SetBody("text/plain", "Body")
+
+	return m
+}
+
+func TestSMTPPoolReusesConnections(t *testing.T) {
+	server := testutil.NewSMTPServer(t)
+	pool := NewSMTPPool(server.Dialer(), 1, 0)
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := pool.Send(context.Background(), newTestMessage(fmt.Sprintf("user%d@example.com", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if messages := server.Messages(); len(messages) != 3 {
+		t.Fatalf("the server got %d messages, expected 3", len(messages))
+	}
+	if connections := server.Connections(); connections != 1 {
+		t.Errorf("the pool opened %d connections, expected the messages to reuse a single one", connections)
+	}
+}
+
+func TestSMTPPoolRedialsClosedConnections(t *testing.T) {
+	server := testutil.NewSMTPServer(t)
+	pool := NewSMTPPool(server.Dialer(), 1, 0)
+	defer pool.Close()
+
+	if err := pool.Send(context.Background(), newTestMessage("first@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	// the server drops the idle connection of the pool
+	server.CloseConnections()
+	if err := pool.Send(context.Background(), newTestMessage("second@example.com")); err != nil {
+		t.Fatalf("Send() = %v, expected the message to be sent over a new connection", err)
+	}
+
+	messages := server.Messages()
+	if len(messages) != 2 || messages[1].To[0] != "second@example.com" {
+		t.Fatalf("the server got %+v, expected both messages", messages)
+	}
+	if connections := server.Connections(); connections != 2 {
+		t.Errorf("the pool opened %d connections, expected 2", connections)
+	}
+}
+
+func TestSMTPPoolBoundsConnections(t *testing.T) {
+	server := testutil.NewSMTPServer(t)
+	pool := NewSMTPPool(server.Dialer(), 2, 0)
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- pool.Send(context.Background(), newTestMessage(fmt.Sprintf("user%d@example.com", i)))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if messages := server.Messages(); len(messages) != 20 {
+		t.Errorf("the server got %d messages, expected 20", len(messages))
+	}
+	if connections := server.Connections(); connections > 2 {
+		t.Errorf("the pool opened %d connections, expected at most 2", connections)
+	}
+}
+
+func TestSMTPPoolThrottles(t *testing.T) {
+	server := testutil.NewSMTPServer(t)
+	// a message every 50ms
+	pool := NewSMTPPool(server.Dialer(), 4, 20)
+	defer pool.Close()
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := pool.Send(context.Background(), newTestMessage("user@example.com")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("5 messages were sent in %s, expected the rate to spread them over at least 200ms", elapsed)
+	}
+}
+
+func TestSMTPPoolSendStopsWithTheContext(t *testing.T) {
+	server := testutil.NewSMTPServer(t)
+	// the first message could only be sent after a minute
+	pool := NewSMTPPool(server.Dialer(), 1, 1.0/60)
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := pool.Send(ctx, newTestMessage("user@example.com")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Send() = %v, expected the deadline of the context to be exceeded", err)
+	}
+	if messages := server.Messages(); len(messages) != 0 {
+		t.Errorf("the server got %d messages, expected none", len(messages))
+	}
+}
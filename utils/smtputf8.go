@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/gomail.v2"
+)
+
+// smtpUTF8CacheDuration is how long the SMTPUTF8 support of a server is remembered
+const smtpUTF8CacheDuration = 1 * time.Hour
+
+var ErrSMTPUTF8Unsupported = errors.New("the SMTP server does not support SMTPUTF8")
+
+type smtpUTF8Support struct {
+	supported bool
+	checkedAt time.Time
+}
+
+var (
+	smtpUTF8CacheMu sync.Mutex
+	smtpUTF8Cache   = map[string]smtpUTF8Support{}
+)
+
+// CheckSMTPUTF8 returns ErrSMTPUTF8Unsupported when an address of the message needs UTF-8 and the server
+// does not advertise SMTPUTF8 in its EHLO response. net/smtp uses the extension by itself when it is advertised.
+func CheckSMTPUTF8(dialer *gomail.Dialer, m *gomail.Message) error {
+	address := ""
+	for _, field := range []string{"From", "To", "Cc", "Bcc"} {
+		for _, value := range m.GetHeader(field) {
+			parsed, err := mail.ParseAddress(value)
+			if err == nil && !isASCII(parsed.Address) {
+				address = parsed.Address
+			}
+		}
+	}
+
+	if address == "" {
+		return nil
+	}
+
+	supported, err := supportsSMTPUTF8(dialer)
+	if err != nil {
+		return err
+	}
+
+	if !supported {
+		return fmt.Errorf("%w, required to send to or from %s", ErrSMTPUTF8Unsupported, address)
+	}
+
+	return nil
+}
+
+// supportsSMTPUTF8 reads the extensions advertised by the server, remembering them for smtpUTF8CacheDuration
+func supportsSMTPUTF8(dialer *gomail.Dialer) (bool, error) {
+	address := net.JoinHostPort(dialer.Host, strconv.Itoa(dialer.Port))
+
+	smtpUTF8CacheMu.Lock()
+	support, found := smtpUTF8Cache[address]
+	smtpUTF8CacheMu.Unlock()
+	if found && time.Since(support.checkedAt) < smtpUTF8CacheDuration {
+		return support.supported, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return false, err
+	}
+
+	if dialer.SSL {
+		tlsConfig := dialer.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: dialer.Host}
+		}
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	c, err := smtp.NewClient(conn, dialer.Host)
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+	defer c.Close()
+
+	if dialer.LocalName != "" {
+		if err := c.Hello(dialer.LocalName); err != nil {
+			return false, err
+		}
+	}
+
+	supported, _ := c.Extension("SMTPUTF8")
+	c.Quit()
+
+	smtpUTF8CacheMu.Lock()
+	smtpUTF8Cache[address] = smtpUTF8Support{supported: supported, checkedAt: time.Now()}
+	smtpUTF8CacheMu.Unlock()
+
+	return supported, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
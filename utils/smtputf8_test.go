@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/isaacwassou/email-service/testutil"
+)
+
+func TestCheckSMTPUTF8(t *testing.T) {
+	tests := []struct {
+		name        string
+		extensions  []string
+		from        string
+		to          string
+		toName      string
+		expected    error
+		connections int
+	}{
+		{"ASCII addresses", nil, "sender@example.com", "user@example.com", "", nil, 0},
+		{"ASCII address with a UTF-8 display name", nil, "sender@example.com", "user@example.com", "Jürgen", nil, 0},
+		{"UTF-8 recipient without SMTPUTF8", []string{"8BITMIME"}, "sender@example.com", "δοκιμή@example.com", "", ErrSMTPUTF8Unsupported, 1},
+		{"UTF-8 sender without SMTPUTF8", []string{"8BITMIME"}, "expéditeur@example.com", "user@example.com", "", ErrSMTPUTF8Unsupported, 1},
+		{"UTF-8 domain without SMTPUTF8", nil, "sender@example.com", "user@bücher.example", "", ErrSMTPUTF8Unsupported, 1},
+		{"UTF-8 recipient with SMTPUTF8", []string{"8BITMIME", "SMTPUTF8"}, "sender@example.com", "δοκιμή@example.com", "Δοκιμή", nil, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := testutil.NewSMTPServer(t, test.extensions...)
+
+			// the addresses are set as the messages of the service set them
+			m := newTestMessage(test.to)
+			m.SetAddressHeader("From", test.from, "")
+			m.SetAddressHeader("To", test.to, test.toName)
+
+			err := CheckSMTPUTF8(server.Dialer(), m)
+			if !errors.Is(err, test.expected) || (test.expected == nil && err != nil) {
+				t.Errorf("CheckSMTPUTF8() = %v, expected %v", err, test.expected)
+			}
+			if connections := server.Connections(); connections != test.connections {
+				t.Errorf("the check opened %d connections, expected %d", connections, test.connections)
+			}
+
+			// the support of the server is remembered
+			if again := CheckSMTPUTF8(server.Dialer(), m); !errors.Is(again, test.expected) || server.Connections() != test.connections {
+				t.Errorf("checking again returned %v after %d connections, expected the remembered support", again, server.Connections())
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"html/template"
+	"sync"
+)
+
+// compiledTemplateSet is a parsed template set along with the version of the sources it was parsed from
+type compiledTemplateSet struct {
+	version [sha256.Size]byte
+	tmpl    *template.Template
+}
+
+// compiledTemplates holds the last template set parsed for every template name, so the emails of a template
+// are rendered without parsing it again until its body, layout, format or partials change
+var compiledTemplates = struct {
+	sync.RWMutex
+	sets map[string]compiledTemplateSet
+}{sets: map[string]compiledTemplateSet{}}
+
+// compiledTemplateSetFor returns the parsed template set of the template details, parsing it only when
+// the cached one was parsed from a different version of the sources
+func compiledTemplateSetFor(details EmailTemplateDetails, templateName string) (*template.Template, error) {
+	version := templateSetVersion(details)
+
+	compiledTemplates.RLock()
+	compiled, found := compiledTemplates.sets[templateName]
+	compiledTemplates.RUnlock()
+	if found && compiled.version == version {
+		return compiled.tmpl, nil
+	}
+
+	tmpl, err := parseTemplateSet(details, templateName)
+	if err != nil {
+		return nil, err
+	}
+
+	compiledTemplates.Lock()
+	compiledTemplates.sets[templateName] = compiledTemplateSet{version: version, tmpl: tmpl}
+	compiledTemplates.Unlock()
+
+	return tmpl, nil
+}
+
+// templateSetVersion hashes everything parseTemplateSet reads, every value being prefixed with its length
+// so different sources cannot produce the same input
+func templateSetVersion(details EmailTemplateDetails) [sha256.Size]byte {
+	hash := sha256.New()
+	write := func(value string) {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(value)))
+		hash.Write(length[:])
+		hash.Write([]byte(value))
+	}
+
+	write(details.Format)
+	write(details.Layout)
+	write(details.BodyTemplate)
+	for _, partial := range details.Partials {
+		write(partial.Name)
+		write(partial.Body)
+	}
+
+	var version [sha256.Size]byte
+	hash.Sum(version[:0])
+
+	return version
+}
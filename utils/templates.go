@@ -2,47 +2,88 @@ package utils
 
 import (
 	"bytes"
-	"database/sql"
+	"context"
 	"fmt"
+	"html"
 	"html/template"
+	"io"
+	"time"
+
+	"github.com/isaacwassou/email-service/database"
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
 )
 
 type EmailTemplateDetails struct {
 	Subject      string
 	RedirectURL  string
 	BodyTemplate string
+	// Layout is the name of the layout the body is rendered into, empty when the body is the whole email
+	Layout string
+	// InlineCSS moves the rules of the <style> blocks of the rendered body into style attributes
+	InlineCSS bool
+	// Format is the format the body is authored in, TemplateFormatHTML when empty
+	Format string
+	// TokenParam is the query parameter of the redirect URL carrying the token, DefaultTokenParam when empty
+	TokenParam string
+	// LinkTTL is how long a signed redirect URL is valid, the URL being unsigned when zero
+	LinkTTL time.Duration
+	// CodeLength and CodeTTL configure the one-time codes generated for MFA emails and CodeTTL the tokens
+	// of magic link emails, zero meaning the defaults
+	CodeLength int
+	CodeTTL    time.Duration
+	// Partials holds the layouts and partials the body and its layout can reference
+	Partials []TemplatePartial
+	// Variables holds the per recipient values available to the template as {{.Variables.name}}
+	Variables map[string]string
+	// Code is the one-time code generated by the service for an MFA email, available to the template as {{.Code}}
+	Code string
 }
 
-func GetVerifyEmailDetails(db *sql.DB) (EmailTemplateDetails, error) {
-	emailTemplate := EmailTemplateDetails{}
+// getEmailTemplateSettings reads the template settings named by fields, only the subject, body and redirect URL
+// being required
+func getEmailTemplateSettings(repository database.Repository, fields EmailTemplateDBFields) (EmailTemplateDetails, error) {
+	names := []string{}
+	for _, name := range []string{fields.Subject, fields.Body, fields.RedirectURL, fields.Layout, fields.InlineCSS, fields.Format, fields.TokenParam, fields.LinkTTL, fields.CodeLength, fields.CodeTTL} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
 
-	rows, err := db.Query("SELECT name, value FROM settings WHERE name in ('EMAIL_VERIFICATION_SUBJECT', 'EMAIL_VERIFICATION_REDIRECT_URL', 'EMAIL_VERIFICATION_BODY')")
+	settings, err := repository.GetSettings(context.Background(), names)
 	if err != nil {
 		return EmailTemplateDetails{}, err
 	}
 
-	for rows.Next() {
-		var name string
-		var value sql.NullString
-		if err := rows.Scan(&name, &value); err != nil {
-			return EmailTemplateDetails{}, err
-		}
-
+	emailTemplate := EmailTemplateDetails{}
+	for name, value := range settings {
 		// if the value is null then return an error
-		if !value.Valid {
+		if !value.Valid && (name == fields.Subject || name == fields.RedirectURL || name == fields.Body) {
 			return EmailTemplateDetails{}, fmt.Errorf("value for %s is null", name)
 		}
 
 		switch name {
-		case "EMAIL_VERIFICATION_SUBJECT":
+		case fields.Subject:
 			emailTemplate.Subject = value.String
-		case "EMAIL_VERIFICATION_REDIRECT_URL":
+		case fields.RedirectURL:
 			emailTemplate.RedirectURL = value.String
-		case "EMAIL_VERIFICATION_BODY":
+		case fields.Body:
 			emailTemplate.BodyTemplate = value.String
+		case fields.Layout:
+			emailTemplate.Layout = value.String
+		case fields.InlineCSS:
+			emailTemplate.InlineCSS = value.String == "true"
+		case fields.Format:
+			emailTemplate.Format = value.String
+		case fields.TokenParam:
+			emailTemplate.TokenParam = value.String
+		case fields.LinkTTL:
+			emailTemplate.LinkTTL, err = parseSecondsSetting(value)
+		case fields.CodeLength:
+			emailTemplate.CodeLength, err = parseMFACodeLength(value)
+		case fields.CodeTTL:
+			emailTemplate.CodeTTL, err = parseSecondsSetting(value)
 		}
-
-		if err := rows.Err(); err != nil {
+		if err != nil {
 			return EmailTemplateDetails{}, err
 		}
 	}
@@ -50,101 +91,179 @@ func GetVerifyEmailDetails(db *sql.DB) (EmailTemplateDetails, error) {
 	return emailTemplate, nil
 }
 
-func GetPasswordResetEmailDetails(db *sql.DB) (EmailTemplateDetails, error) {
-	emailTemplate := EmailTemplateDetails{}
+// ParseBodyTemplate renders the body of an email. The plain text alternative is rendered along with it
+// for the templates authored in markdown, and is empty otherwise.
+func ParseBodyTemplate(details EmailTemplateDetails, templateName string) (body string, text string, err error) {
+	// check if the body or the redirectURL are empty
+	if details.BodyTemplate == "" || details.RedirectURL == "" {
+		return "", "", fmt.Errorf("body template or redirect URL is empty")
+	}
 
-	rows, err := db.Query("SELECT name, value FROM settings WHERE name in ('PASSWORD_RESET_SUBJECT', 'PASSWORD_RESET_REDIRECT_URL', 'PASSWORD_RESET_BODY')")
+	tmpl, err := compiledTemplateSetFor(details, templateName)
 	if err != nil {
-		return EmailTemplateDetails{}, err
+		return "", "", err
 	}
 
-	for rows.Next() {
-		var name string
-		var value sql.NullString
-		if err := rows.Scan(&name, &value); err != nil {
-			return EmailTemplateDetails{}, err
+	// execute the template abd write the output to the body
+	var emailBodyBuffer bytes.Buffer
+	text, err = executeTemplateSet(tmpl, details, &emailBodyBuffer)
+	if err != nil {
+		return "", "", err
+	}
+
+	body = emailBodyBuffer.String()
+
+	// inline the CSS for the clients that strip <style> blocks
+	if details.InlineCSS {
+		body, err = InlineCSS(body)
+		if err != nil {
+			return "", "", err
 		}
+	}
 
-		// if the value is null then return an error
-		if !value.Valid {
-			return EmailTemplateDetails{}, fmt.Errorf("value for %s is null", name)
+	return body, text, nil
+}
+
+// ValidateBodyTemplate checks that the body template parses and renders with its layout and the given partials
+func ValidateBodyTemplate(details EmailTemplateDetails, templateName string) error {
+	tmpl, err := parseTemplateSet(details, templateName)
+	if err != nil {
+		return err
+	}
+
+	details.RedirectURL = "https://example.com/?code=token"
+	details.Code = "123456"
+
+	_, err = executeTemplateSet(tmpl, details, io.Discard)
+	return err
+}
+
+// ValidateTemplateFormat checks that the format of a template is supported, empty meaning HTML
+func ValidateTemplateFormat(format string) error {
+	if format != "" && format != TemplateFormatHTML && format != TemplateFormatMarkdown {
+		return fmt.Errorf("invalid template format %s", format)
+	}
+
+	return nil
+}
+
+// parseTemplateSet parses the partials, the layouts and the body into a single template set,
+// the body being defined as the ContentTemplateName template. A markdown body is defined as the
+// MarkdownTemplateName template instead, and the content template renders its conversion to HTML.
+func parseTemplateSet(details EmailTemplateDetails, templateName string) (*template.Template, error) {
+	if err := ValidateTemplateFormat(details.Format); err != nil {
+		return nil, err
+	}
+
+	tmpl := template.New(templateName)
+
+	if details.Format == TemplateFormatMarkdown {
+		if _, err := tmpl.New(DefaultLayoutName).Parse(defaultLayout); err != nil {
+			return nil, err
 		}
+	}
 
-		switch name {
-		case "PASSWORD_RESET_SUBJECT":
-			emailTemplate.Subject = value.String
-		case "PASSWORD_RESET_REDIRECT_URL":
-			emailTemplate.RedirectURL = value.String
-		case "PASSWORD_RESET_BODY":
-			emailTemplate.BodyTemplate = value.String
+	for _, partial := range details.Partials {
+		if _, err := tmpl.New(partial.Name).Parse(partial.Body); err != nil {
+			return nil, err
 		}
+	}
 
-		if err := rows.Err(); err != nil {
-			return EmailTemplateDetails{}, err
+	if details.Format == TemplateFormatMarkdown {
+		if _, err := tmpl.New(MarkdownTemplateName).Parse(details.BodyTemplate); err != nil {
+			return nil, err
 		}
+		if _, err := tmpl.New(ContentTemplateName).Parse("{{.Content}}"); err != nil {
+			return nil, err
+		}
+	} else if _, err := tmpl.New(ContentTemplateName).Parse(details.BodyTemplate); err != nil {
+		return nil, err
 	}
 
-	return emailTemplate, nil
-}
+	if details.Layout != "" && tmpl.Lookup(details.Layout) == nil {
+		return nil, fmt.Errorf("layout %s does not exist", details.Layout)
+	}
 
-func GetMFAEmailDetails(db *sql.DB) (EmailTemplateDetails, error) {
-	emailTemplate := EmailTemplateDetails{}
+	return tmpl, nil
+}
 
-	rows, err := db.Query("SELECT name, value FROM settings WHERE name in ('MFA_VERIFICATION_SUBJECT', 'MFA_VERIFICATION_REDIRECT_URL', 'MFA_VERIFICATION_BODY')")
-	if err != nil {
-		return EmailTemplateDetails{}, err
+// executeTemplateSet renders the layout of the template set, or the body when there is no layout.
+// A markdown body is rendered first and converted to HTML, the rendered markdown being returned
+// as the plain text of the email, and is wrapped in the default layout when there is no layout.
+func executeTemplateSet(tmpl *template.Template, details EmailTemplateDetails, w io.Writer) (string, error) {
+	data := struct {
+		RedirectURL string
+		Variables   map[string]string
+		Code        string
+		// Content holds the HTML of a markdown body for the content template
+		Content template.HTML
+	}{
+		RedirectURL: details.RedirectURL,
+		Variables:   details.Variables,
+		Code:        details.Code,
 	}
 
-	for rows.Next() {
-		var name string
-		var value sql.NullString
-		if err := rows.Scan(&name, &value); err != nil {
-			return EmailTemplateDetails{}, err
+	entry := ContentTemplateName
+	text := ""
+
+	if details.Format == TemplateFormatMarkdown {
+		var textBuffer bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&textBuffer, MarkdownTemplateName, data); err != nil {
+			return "", err
 		}
 
-		// if the value is null then return an error
-		if !value.Valid {
-			return EmailTemplateDetails{}, fmt.Errorf("value for %s is null", name)
+		// the values are HTML escaped when rendered, which the plain text does not need
+		text = html.UnescapeString(textBuffer.String())
+
+		// html/template only escapes HTML, so the markdown syntax of the per recipient variables is escaped
+		// before the conversion, for them not to add links bypassing the allowed redirect origins
+		markdownData := data
+		markdownData.Variables = map[string]string{}
+		for name, value := range details.Variables {
+			markdownData.Variables[name] = escapeMarkdown(value)
 		}
 
-		switch name {
-		case "MFA_VERIFICATION_SUBJECT":
-			emailTemplate.Subject = value.String
-		case "MFA_VERIFICATION_REDIRECT_URL":
-			emailTemplate.RedirectURL = value.String
-		case "MFA_VERIFICATION_BODY":
-			emailTemplate.BodyTemplate = value.String
+		var markdownBuffer bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&markdownBuffer, MarkdownTemplateName, markdownData); err != nil {
+			return "", err
 		}
 
-		if err := rows.Err(); err != nil {
-			return EmailTemplateDetails{}, err
+		content, err := MarkdownToHTML(markdownBuffer.String())
+		if err != nil {
+			return "", err
 		}
+		data.Content = template.HTML(content)
+		entry = DefaultLayoutName
 	}
 
-	return emailTemplate, nil
+	if details.Layout != "" {
+		entry = details.Layout
+	}
+
+	if err := tmpl.ExecuteTemplate(w, entry, data); err != nil {
+		return "", err
+	}
+
+	return text, nil
 }
 
-func ParseBodyTemplate(details EmailTemplateDetails, templateName string) (string, error) {
-	// check if the body or the redirectURL are empty
-	if details.BodyTemplate == "" || details.RedirectURL == "" {
-		return "", fmt.Errorf("body template or redirect URL is empty")
+// GetEmailTemplateDetails loads the template details of the given email type along with the layouts and partials,
+// reading them in the transaction of the repository if it has one
+func GetEmailTemplateDetails(repository database.Repository, emailType pb.EmailType) (EmailTemplateDetails, error) {
+	fields, err := GetEmailTemplateDBFields(emailType)
+	if err != nil {
+		return EmailTemplateDetails{}, err
 	}
 
-	tmpl, err := template.New(templateName).Parse(details.BodyTemplate)
+	details, err := getEmailTemplateSettings(repository, fields)
 	if err != nil {
-		return "", err
+		return EmailTemplateDetails{}, err
 	}
 
-	// execute the template abd write the output to the body
-	var emailBodyBuffer bytes.Buffer
-	err = tmpl.Execute(&emailBodyBuffer, struct {
-		RedirectURL string
-	}{
-		RedirectURL: details.RedirectURL,
-	})
+	details.Partials, err = repository.GetTemplatePartials(context.Background())
 	if err != nil {
-		return "", err
+		return EmailTemplateDetails{}, err
 	}
 
-	return emailBodyBuffer.String(), nil
+	return details, nil
 }
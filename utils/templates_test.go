@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/isaacwassou/email-service/database"
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+)
+
+func TestGetEmailTemplateDetails(t *testing.T) {
+	tests := []struct {
+		emailType pb.EmailType
+		expected  EmailTemplateDetails
+	}{
+		{pb.EmailType_EMAIL_VERIFICATION, EmailTemplateDetails{LinkTTL: time.Hour}},
+		{pb.EmailType_PASSWORD_RESET, EmailTemplateDetails{LinkTTL: time.Hour}},
+		{pb.EmailType_MFA, EmailTemplateDetails{LinkTTL: time.Hour, CodeLength: 8, CodeTTL: 5 * time.Minute}},
+		{pb.EmailType_MAGIC_LINK, EmailTemplateDetails{LinkTTL: time.Hour, CodeTTL: 5 * time.Minute}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.emailType.String(), func(t *testing.T) {
+			db := newTestDB(t)
+			fields, err := GetEmailTemplateDBFields(test.emailType)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			settings := map[string]*string{
+				fields.Subject:     ptr("Subject"),
+				fields.Body:        ptr("{{.RedirectURL}}"),
+				fields.RedirectURL: ptr("https://example.com/"),
+				fields.Layout:      ptr("base"),
+				fields.InlineCSS:   ptr("true"),
+				fields.Format:      ptr(TemplateFormatMarkdown),
+				fields.TokenParam:  ptr("token"),
+				fields.LinkTTL:     ptr("3600"),
+			}
+			if fields.CodeLength != "" {
+				settings[fields.CodeLength] = ptr("8")
+			}
+			if fields.CodeTTL != "" {
+				settings[fields.CodeTTL] = ptr("300")
+			}
+			setSettings(t, db, settings)
+
+			details, err := GetEmailTemplateDetails(db.Repository(), test.emailType)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := test.expected
+			expected.Subject = "Subject"
+			expected.BodyTemplate = "{{.RedirectURL}}"
+			expected.RedirectURL = "https://example.com/"
+			expected.Layout = "base"
+			expected.InlineCSS = true
+			expected.Format = TemplateFormatMarkdown
+			expected.TokenParam = "token"
+			expected.Partials = []TemplatePartial{}
+			if !reflect.DeepEqual(details, expected) {
+				t.Errorf("GetEmailTemplateDetails() = %+v, expected %+v", details, expected)
+			}
+		})
+	}
+}
+
+func TestGetEmailTemplateDetailsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]*string
+	}{
+		{"null subject", map[string]*string{"MFA_VERIFICATION_SUBJECT": nil}},
+		{"null body", map[string]*string{"MFA_VERIFICATION_BODY": nil}},
+		{"invalid link TTL", map[string]*string{"MFA_VERIFICATION_LINK_TTL": ptr("an hour")}},
+		{"invalid code length", map[string]*string{"MFA_VERIFICATION_CODE_LENGTH": ptr("-1")}},
+		{"invalid code TTL", map[string]*string{"MFA_VERIFICATION_CODE_TTL": ptr("five minutes")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// a single connection shows whether the failed read released it
+			db := newTestDBWithConfig(t, database.Config{MaxOpenConns: 1})
+			setSettings(t, db, map[string]*string{
+				"MFA_VERIFICATION_SUBJECT":      ptr("Subject"),
+				"MFA_VERIFICATION_BODY":         ptr("{{.Code}}"),
+				"MFA_VERIFICATION_REDIRECT_URL": ptr("https://example.com/"),
+			})
+			setSettings(t, db, test.settings)
+
+			if _, err := GetEmailTemplateDetails(db.Repository(), pb.EmailType_MFA); err == nil {
+				t.Error("GetEmailTemplateDetails() succeeded, expected an error")
+			}
+			requireFreeConnection(t, db)
+		})
+	}
+}
+
+// benchmarkTemplateDetails returns a body rendered in a layout with a partial, as the stored templates are
+func benchmarkTemplateDetails() EmailTemplateDetails {
+	return EmailTemplateDetails{
+		BodyTemplate: `<p>Hello,</p>{{template "button" .}}<p>{{.Code}}</p>`,
+		RedirectURL:  "https://example.com/?code=token",
+		Code:         "123456",
+		Layout:       "base",
+		Partials: []TemplatePartial{
+			{Name: "base", Kind: TemplatePartialKindLayout, Body: `<html><body>{{template "content" .}}</body></html>`},
+			{Name: "button", Kind: TemplatePartialKindPartial, Body: `<a href="{{.RedirectURL}}">Continue</a>`},
+		},
+	}
+}
+
+func BenchmarkParseBodyTemplate(b *testing.B) {
+	details := benchmarkTemplateDetails()
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tmpl, err := parseTemplateSet(details, "benchmark")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := executeTemplateSet(tmpl, details, io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tmpl, err := compiledTemplateSetFor(details, "benchmark")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := executeTemplateSet(tmpl, details, io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestCompiledTemplateSetRebuildsOnChange(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(details *EmailTemplateDetails)
+		expected string
+	}{
+		{"body", func(details *EmailTemplateDetails) {
+			details.BodyTemplate = `<p>Welcome,</p>{{template "button" .}}<p>{{.Code}}</p>`
+		}, `<html><body><p>Welcome,</p><a href="https://example.com/?code=token">Continue</a><p>123456</p></body></html>`},
+		{"partial", func(details *EmailTemplateDetails) {
+			details.Partials[1].Body = `<a href="{{.RedirectURL}}">Sign in</a>`
+		}, `<html><body><p>Hello,</p><a href="https://example.com/?code=token">Sign in</a><p>123456</p></body></html>`},
+		{"layout", func(details *EmailTemplateDetails) {
+			details.Partials[0].Body = `<html><body><main>{{template "content" .}}</main></body></html>`
+		}, `<html><body><main><p>Hello,</p><a href="https://example.com/?code=token">Continue</a><p>123456</p></main></body></html>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// every subtest has its own cache entry
+			templateName := "rebuild-" + test.name
+			details := benchmarkTemplateDetails()
+
+			first, err := compiledTemplateSetFor(details, templateName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again, err := compiledTemplateSetFor(details, templateName); err != nil || again != first {
+				t.Fatalf("the unchanged template set was parsed again")
+			}
+
+			test.change(&details)
+			if rebuilt, err := compiledTemplateSetFor(details, templateName); err != nil || rebuilt == first {
+				t.Fatalf("the changed template set was not parsed again")
+			}
+
+			body, _, err := ParseBodyTemplate(details, templateName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body != test.expected {
+				t.Errorf("ParseBodyTemplate() = %q, expected %q", body, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for changes
+const tlsReloadInterval = 30 * time.Second
+
+// tlsFiles is a certificate, its key and a CA bundle used to verify the peer, any of them optional
+type tlsFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+}
+
+// tlsReloader serves the certificate and the CA pool loaded from their files and reloads them when the
+// files change, so renewed certificates are picked up without restarting the service
+type tlsReloader struct {
+	files tlsFiles
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+	modTimes  []time.Time
+	checkedAt time.Time
+}
+
+func newTLSReloader(files tlsFiles) (*tlsReloader, error) {
+	if (files.certFile == "") != (files.keyFile == "") {
+		return nil, errors.New("a certificate file requires a key file and the other way around")
+	}
+
+	reloader := &tlsReloader{files: files}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	reloader.checkedAt = time.Now()
+
+	return reloader, nil
+}
+
+// current returns the certificate and the CA pool, reloading them first when their files changed.
+// A failed reload is logged and the previous ones are kept.
+func (r *tlsReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) > tlsReloadInterval {
+		r.checkedAt = time.Now()
+
+		if modTimes, err := r.fileModTimes(); err != nil || !equalTimes(modTimes, r.modTimes) {
+			if err := r.load(); err != nil {
+				log.Printf("Failed to reload the TLS certificates, keeping the previous ones: %s", err)
+			} else {
+				log.Println("Reloaded the TLS certificates")
+			}
+		}
+	}
+
+	return r.cert, r.pool
+}
+
+func (r *tlsReloader) load() error {
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return err
+	}
+
+	var cert *tls.Certificate
+	if r.files.certFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(r.files.certFile, r.files.keyFile)
+		if err != nil {
+			return err
+		}
+		cert = &keyPair
+	}
+
+	var pool *x509.CertPool
+	if r.files.caFile != "" {
+		data, err := os.ReadFile(r.files.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in %s", r.files.caFile)
+		}
+	}
+
+	r.cert = cert
+	r.pool = pool
+	r.modTimes = modTimes
+
+	return nil
+}
+
+func (r *tlsReloader) fileModTimes() ([]time.Time, error) {
+	modTimes := []time.Time{}
+	for _, path := range []string{r.files.certFile, r.files.keyFile, r.files.caFile} {
+		if path == "" {
+			modTimes = append(modTimes, time.Time{})
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+
+	return modTimes, nil
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// NewServerTLSConfig returns the TLS configuration of the gRPC server from TLS_CERT_FILE and TLS_KEY_FILE,
+// or nil when they are not set. When TLS_CLIENT_CA_FILE is set the client certificates are verified against
+// it, and required unless TLS_CLIENT_AUTH is "optional".
+func NewServerTLSConfig(config ServerTLSConfig) (*tls.Config, error) {
+	files := tlsFiles{
+		certFile: config.CertFile,
+		keyFile:  config.KeyFile,
+		caFile:   config.ClientCAFile,
+	}
+	if files.certFile == "" && files.keyFile == "" {
+		if files.caFile != "" {
+			return nil, errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+
+	clientAuth := tls.NoClientCert
+	if files.caFile != "" {
+		switch config.ClientAuth {
+		case "", "require":
+			clientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			clientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, errors.New(`TLS_CLIENT_AUTH must be "require" or "optional"`)
+		}
+	}
+
+	reloader, err := newTLSReloader(files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// build the configuration of every handshake from the latest certificates
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := reloader.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   clientAuth,
+				NextProtos:   []string{"h2"},
+			}, nil
+		},
+	}, nil
+}
+
+// NewCryptoServiceTLSConfig returns the TLS configuration of the connection to the cryptography service, or nil
+// when CRYPTOGRAPHY_SERVICE_TLS_CA_FILE is not set. The server certificate is verified against that CA bundle,
+// for the name in CRYPTOGRAPHY_SERVICE_TLS_SERVER_NAME or else CRYPTOGRAPHY_SERVICE_HOST, which may be an IP address,
+// and the client certificate in CRYPTOGRAPHY_SERVICE_TLS_CERT_FILE and CRYPTOGRAPHY_SERVICE_TLS_KEY_FILE is
+// presented when set.
+func NewCryptoServiceTLSConfig(config CryptoServiceConfig) (*tls.Config, error) {
+	files := tlsFiles{
+		certFile: config.TLSCertFile,
+		keyFile:  config.TLSKeyFile,
+		caFile:   config.TLSCAFile,
+	}
+	if files.caFile == "" {
+		if files.certFile != "" || files.keyFile != "" {
+			return nil, errors.New("CRYPTOGRAPHY_SERVICE_TLS_CERT_FILE requires CRYPTOGRAPHY_SERVICE_TLS_CA_FILE")
+		}
+		return nil, nil
+	}
+
+	// the name is verified from the configuration rather than from the handshake, which has no server name
+	// when the host is an IP address
+	serverName := config.TLSServerName
+	if serverName == "" {
+		serverName = config.Host
+	}
+	if serverName == "" {
+		return nil, errors.New("CRYPTOGRAPHY_SERVICE_TLS_CA_FILE requires CRYPTOGRAPHY_SERVICE_HOST or CRYPTOGRAPHY_SERVICE_TLS_SERVER_NAME")
+	}
+
+	reloader, err := newTLSReloader(files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := reloader.current()
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+		// the default verification uses a fixed CA pool, verify against the latest one instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			_, pool := reloader.current()
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("the cryptography service sent no certificate")
+			}
+
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       serverName,
+				Roots:         pool,
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}, nil
+}
@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues the certificates of the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testCA{cert: cert, key: key}
+}
+
+// writeFile writes the CA certificate in a PEM file and returns its path
+func (ca testCA) writeFile(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// issue returns a server certificate for the DNS names and IP addresses
+func (ca testCA) issue(t *testing.T, dnsNames []string, ips []net.IP) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshake connects with the client config to a server presenting the certificate
+func handshake(t *testing.T, clientConfig *tls.Config, serverCert tls.Certificate) error {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func TestCryptoServiceTLSConfigVerifiesServerName(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := ca.writeFile(t)
+	otherCA := newTestCA(t)
+
+	loopback := []net.IP{net.ParseIP("127.0.0.1")}
+	tests := []struct {
+		name       string
+		config     CryptoServiceConfig
+		serverCert tls.Certificate
+		valid      bool
+	}{
+		{"IP host matching the certificate", CryptoServiceConfig{Host: "127.0.0.1"}, ca.issue(t, nil, loopback), true},
+		{"IP host not matching the certificate", CryptoServiceConfig{Host: "127.0.0.1"}, ca.issue(t, nil, []net.IP{net.ParseIP("127.0.0.2")}), false},
+		{"IP host of a DNS certificate", CryptoServiceConfig{Host: "127.0.0.1"}, ca.issue(t, []string{"crypto.internal"}, nil), false},
+		{"DNS host matching the certificate", CryptoServiceConfig{Host: "crypto.internal"}, ca.issue(t, []string{"crypto.internal"}, nil), true},
+		{"DNS host not matching the certificate", CryptoServiceConfig{Host: "other.internal"}, ca.issue(t, []string{"crypto.internal"}, nil), false},
+		{"server name matching the certificate", CryptoServiceConfig{Host: "127.0.0.1", TLSServerName: "crypto.internal"}, ca.issue(t, []string{"crypto.internal"}, nil), true},
+		{"server name not matching the certificate", CryptoServiceConfig{Host: "127.0.0.1", TLSServerName: "other.internal"}, ca.issue(t, []string{"crypto.internal"}, loopback), false},
+		{"certificate of another CA", CryptoServiceConfig{Host: "127.0.0.1"}, otherCA.issue(t, nil, loopback), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.TLSCAFile = caFile
+			tlsConfig, err := NewCryptoServiceTLSConfig(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = handshake(t, tlsConfig, test.serverCert)
+			if test.valid && err != nil {
+				t.Errorf("the handshake failed: %s", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("the handshake succeeded, expected the certificate to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"context"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+// WithTx runs f in a transaction that is committed when f succeeds and rolled back otherwise,
+// so a failed write never leaves part of its changes behind or its connection checked out
+func WithTx(ctx context.Context, db *database.DB, f func(tx *database.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// rolling back a committed transaction does nothing
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
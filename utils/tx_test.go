@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/isaacwassou/email-service/database"
+)
+
+func TestWithTx(t *testing.T) {
+	db := newTestDBWithConfig(t, database.Config{MaxOpenConns: 1})
+	ctx := context.Background()
+
+	err := WithTx(ctx, db, func(tx *database.Tx) error {
+		return tx.Repository().UpsertSettings(ctx, map[string]string{"committed": "value"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireFreeConnection(t, db)
+
+	// a write failing after another one rolls both back
+	errWrite := errors.New("write failed")
+	err = WithTx(ctx, db, func(tx *database.Tx) error {
+		if err := tx.Repository().UpsertSettings(ctx, map[string]string{"committed": "changed", "rolled_back": "value"}); err != nil {
+			return err
+		}
+		return errWrite
+	})
+	if !errors.Is(err, errWrite) {
+		t.Errorf("WithTx() = %v, expected the error of the write", err)
+	}
+	requireFreeConnection(t, db)
+
+	settings, err := db.Repository().GetSettings(ctx, []string{"committed", "rolled_back"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings["committed"].String != "value" {
+		t.Errorf("the committed setting is %q, expected the value before the failed transaction", settings["committed"].String)
+	}
+	if _, found := settings["rolled_back"]; found {
+		t.Error("the setting of the failed transaction was stored")
+	}
+}
@@ -0,0 +1,456 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isaacwassou/email-service/database"
+	pbCrypto "github.com/isaacwassou/email-service/protobufs/cryptography_service"
+)
+
+const (
+	// WebhookSignatureHeader carries the HMAC-SHA256 signature of the timestamp and the payload
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	// WebhookTimestampHeader carries the unix timestamp the payload was signed at
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	// WebhookDeliveryHeader carries the ID of the delivery, which stays the same across retries
+	WebhookDeliveryHeader = "X-Webhook-Delivery"
+
+	// webhookMaxAttempts is the number of attempts after which a delivery is marked as failed
+	webhookMaxAttempts = 8
+	// webhookBaseBackoff is the delay before the first retry, doubled after every failed attempt
+	webhookBaseBackoff = 30 * time.Second
+	// webhookMaxBackoff caps the delay between two attempts
+	webhookMaxBackoff = 1 * time.Hour
+	// webhookLockDuration is how long a replica owns a delivery while posting it
+	webhookLockDuration = 1 * time.Minute
+	// webhookBatchSize is the number of due deliveries claimed per poll
+	webhookBatchSize = 50
+	// webhookPollInterval bounds how long the dispatcher sleeps between two polls
+	webhookPollInterval = 5 * time.Second
+)
+
+type WebhookEndpoint struct {
+	ID         int64
+	URL        string
+	EventTypes []string
+	Secret     string
+	CreatedAt  time.Time
+}
+
+type WebhookDeliveryAttempt struct {
+	ID         int64
+	DeliveryID int64
+	EndpointID int64
+	EventID    int64
+	Attempt    int
+	StatusCode int
+	Error      string
+	Succeeded  bool
+	CreatedAt  time.Time
+}
+
+// WebhookPayload is the JSON body posted to the webhook endpoints
+type WebhookPayload struct {
+	EventID   int64     `json:"event_id"`
+	MessageID string    `json:"message_id"`
+	EventType string    `json:"event_type"`
+	EmailType string    `json:"email_type"`
+	Recipient string    `json:"recipient"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewWebhookSecret generates a random secret used to sign the webhook payloads
+func NewWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+// SignWebhookPayload computes the signature sent in the WebhookSignatureHeader.
+// Consumers verify a payload by computing the same value from the timestamp header and the raw body.
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidateWebhookURL checks that the URL is an absolute http or https URL
+func ValidateWebhookURL(rawURL string) error {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return fmt.Errorf("webhook URL must use http or https")
+	}
+
+	if parsedURL.Host == "" {
+		return fmt.Errorf("webhook URL must have a host")
+	}
+
+	return nil
+}
+
+// InsertWebhookEndpoint stores a webhook endpoint whose secret is already encrypted and returns its ID
+func InsertWebhookEndpoint(db *database.DB, endpoint WebhookEndpoint) (int64, error) {
+	return db.InsertID(
+		context.Background(),
+		"INSERT INTO webhook_endpoints (url, event_types, secret) VALUES (?, ?, ?)",
+		endpoint.URL,
+		strings.Join(endpoint.EventTypes, ","),
+		endpoint.Secret,
+	)
+}
+
+// GetWebhookEndpoints returns every registered webhook endpoint without its secret
+func GetWebhookEndpoints(db *database.DB) ([]WebhookEndpoint, error) {
+	rows, err := db.Query("SELECT id, url, event_types, created_at FROM webhook_endpoints ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := []WebhookEndpoint{}
+	for rows.Next() {
+		var endpoint WebhookEndpoint
+		var eventTypes string
+		if err := rows.Scan(&endpoint.ID, &endpoint.URL, &eventTypes, &endpoint.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		endpoint.EventTypes = strings.Split(eventTypes, ",")
+		endpoints = append(endpoints, endpoint)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return endpoints, nil
+}
+
+// DeleteWebhookEndpoint removes a webhook endpoint along with its deliveries and reports whether it existed
+func DeleteWebhookEndpoint(db *database.DB, id int64) (bool, error) {
+	result, err := db.Exec("DELETE FROM webhook_endpoints WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// GetWebhookDeliveryAttempts returns the most recent delivery attempts made to an endpoint
+func GetWebhookDeliveryAttempts(db *database.DB, endpointID int64, limit int) ([]WebhookDeliveryAttempt, error) {
+	rows, err := db.Query(
+		"SELECT id, delivery_id, endpoint_id, event_id, attempt, status_code, error, succeeded, created_at FROM webhook_attempts WHERE endpoint_id = ? ORDER BY id DESC LIMIT ?",
+		endpointID,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []WebhookDeliveryAttempt{}
+	for rows.Next() {
+		var attempt WebhookDeliveryAttempt
+		var statusCode sql.NullInt32
+		var attemptError sql.NullString
+		if err := rows.Scan(&attempt.ID, &attempt.DeliveryID, &attempt.EndpointID, &attempt.EventID, &attempt.Attempt, &statusCode, &attemptError, &attempt.Succeeded, &attempt.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		attempt.StatusCode = int(statusCode.Int32)
+		attempt.Error = attemptError.String
+		attempts = append(attempts, attempt)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+// EnqueueWebhookDeliveries creates a pending delivery of the event for every endpoint subscribed to its type
+func EnqueueWebhookDeliveries(db *database.DB, eventID int64, eventType string) error {
+	// the subscriptions are matched here rather than in SQL as the event types are stored as a comma separated list
+	endpoints, err := GetWebhookEndpoints(db)
+	if err != nil {
+		return err
+	}
+
+	query := "INSERT INTO webhook_deliveries (endpoint_id, event_id) VALUES "
+	args := []any{}
+	for _, endpoint := range endpoints {
+		if !slices.Contains(endpoint.EventTypes, eventType) {
+			continue
+		}
+
+		if len(args) > 0 {
+			query += ", "
+		}
+		query += "(?, ?)"
+		args = append(args, endpoint.ID, eventID)
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	_, err = db.Exec(query, args...)
+
+	return err
+}
+
+// webhookDelivery is a claimed delivery along with everything needed to post it
+type webhookDelivery struct {
+	id       int64
+	attempts int
+	url      string
+	secret   string
+	payload  WebhookPayload
+}
+
+// WebhookDispatcher posts the pending webhook deliveries and retries the failed ones with backoff.
+// Deliveries are claimed with a lock so several replicas can run a dispatcher at the same time.
+type WebhookDispatcher struct {
+	db                  *database.DB
+	cryptoServiceClient pbCrypto.CryptographyManagerClient
+	httpClient          *http.Client
+	notifier            *DeliveryEventNotifier
+}
+
+func NewWebhookDispatcher(db *database.DB, cryptoServiceClient pbCrypto.CryptographyManagerClient, notifier *DeliveryEventNotifier) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		db:                  db,
+		cryptoServiceClient: cryptoServiceClient,
+		httpClient:          &http.Client{Timeout: 10 * time.Second},
+		notifier:            notifier,
+	}
+}
+
+// Run dispatches the due deliveries until the context is cancelled
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	for {
+		notified := d.notifier.Wait()
+
+		if err := d.dispatchDue(ctx); err != nil {
+			log.Printf("Failed to dispatch the webhook deliveries: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-notified:
+		case <-time.After(webhookPollInterval):
+		}
+	}
+}
+
+func (d *WebhookDispatcher) dispatchDue(ctx context.Context) error {
+	now := time.Now().UTC()
+	rows, err := d.db.QueryContext(
+		ctx,
+		"SELECT id FROM webhook_deliveries WHERE (status = 'pending' AND next_attempt_at <= ?) OR (status = 'sending' AND locked_until < ?) ORDER BY id LIMIT ?",
+		now,
+		now,
+		webhookBatchSize,
+	)
+	if err != nil {
+		return err
+	}
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		delivery, claimed, err := d.claim(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		// another replica got to the delivery first
+		if !claimed {
+			continue
+		}
+
+		if err := d.deliver(ctx, delivery); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// claim locks the delivery for this replica and loads its endpoint and event
+func (d *WebhookDispatcher) claim(ctx context.Context, id int64) (webhookDelivery, bool, error) {
+	now := time.Now().UTC()
+	result, err := d.db.ExecContext(
+		ctx,
+		"UPDATE webhook_deliveries SET status = 'sending', locked_until = ? WHERE id = ? AND ((status = 'pending' AND next_attempt_at <= ?) OR (status = 'sending' AND locked_until < ?))",
+		now.Add(webhookLockDuration),
+		id,
+		now,
+		now,
+	)
+	if err != nil {
+		return webhookDelivery{}, false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return webhookDelivery{}, false, err
+	}
+
+	delivery := webhookDelivery{id: id}
+	var detail sql.NullString
+	err = d.db.QueryRowContext(
+		ctx,
+		`SELECT d.attempts, w.url, w.secret, e.id, e.message_id, e.event_type, e.email_type, e.recipient, e.detail, e.created_at
+		FROM webhook_deliveries d
+		JOIN webhook_endpoints w ON w.id = d.endpoint_id
+		JOIN delivery_events e ON e.id = d.event_id
+		WHERE d.id = ?`,
+		id,
+	).Scan(
+		&delivery.attempts,
+		&delivery.url,
+		&delivery.secret,
+		&delivery.payload.EventID,
+		&delivery.payload.MessageID,
+		&delivery.payload.EventType,
+		&delivery.payload.EmailType,
+		&delivery.payload.Recipient,
+		&detail,
+		&delivery.payload.CreatedAt,
+	)
+	if err != nil {
+		return webhookDelivery{}, false, err
+	}
+	delivery.payload.Detail = detail.String
+
+	return delivery, true, nil
+}
+
+// deliver posts the payload once and records the attempt, scheduling a retry when it fails
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery webhookDelivery) error {
+	attempt := delivery.attempts + 1
+	statusCode, postErr := d.post(ctx, delivery)
+
+	var attemptError sql.NullString
+	if postErr != nil {
+		attemptError = sql.NullString{String: postErr.Error(), Valid: true}
+	}
+
+	_, err := d.db.ExecContext(
+		ctx,
+		"INSERT INTO webhook_attempts (delivery_id, endpoint_id, event_id, attempt, status_code, error, succeeded) SELECT id, endpoint_id, event_id, ?, ?, ?, ? FROM webhook_deliveries WHERE id = ?",
+		attempt,
+		sql.NullInt32{Int32: int32(statusCode), Valid: statusCode != 0},
+		attemptError,
+		postErr == nil,
+		delivery.id,
+	)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case postErr == nil:
+		_, err = d.db.ExecContext(ctx, "UPDATE webhook_deliveries SET status = 'succeeded', attempts = ?, locked_until = NULL WHERE id = ?", attempt, delivery.id)
+	case attempt >= webhookMaxAttempts:
+		_, err = d.db.ExecContext(ctx, "UPDATE webhook_deliveries SET status = 'failed', attempts = ?, locked_until = NULL WHERE id = ?", attempt, delivery.id)
+	default:
+		_, err = d.db.ExecContext(
+			ctx,
+			"UPDATE webhook_deliveries SET status = 'pending', attempts = ?, locked_until = NULL, next_attempt_at = ? WHERE id = ?",
+			attempt,
+			time.Now().UTC().Add(WebhookBackoff(attempt)),
+			delivery.id,
+		)
+	}
+
+	return err
+}
+
+// post sends the signed payload to the endpoint and returns the response status code
+func (d *WebhookDispatcher) post(ctx context.Context, delivery webhookDelivery) (int, error) {
+	// decrypt the endpoint secret
+	decryptedSecret, err := d.cryptoServiceClient.Decrypt(ctx, &pbCrypto.DecryptRequest{Ciphertext: delivery.secret})
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := json.Marshal(delivery.payload)
+	if err != nil {
+		return 0, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(delivery.id, 10))
+	request.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(WebhookSignatureHeader, SignWebhookPayload(decryptedSecret.Plaintext, timestamp, body))
+
+	response, err := d.httpClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("webhook endpoint responded with status %d", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
+
+// WebhookBackoff returns the delay before retrying a delivery that failed the given number of times
+func WebhookBackoff(attempts int) time.Duration {
+	return ExponentialBackoff(webhookBaseBackoff, webhookMaxBackoff, attempts)
+}
@@ -0,0 +1,228 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/isaacwassou/email-service/testutil"
+)
+
+// webhookRequest is a request received by the test webhook endpoint
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// newWebhookServer starts an endpoint answering with statusCode and sending the requests it receives to the channel
+func newWebhookServer(t *testing.T, statusCode int) (*httptest.Server, <-chan webhookRequest) {
+	t.Helper()
+
+	requests := make(chan webhookRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- webhookRequest{header: r.Header.Clone(), body: body}
+		w.WriteHeader(statusCode)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+// newWebhookDelivery registers an endpoint subscribed to the sent events and queues a delivery of a sent event to it
+func newWebhookDelivery(t *testing.T, dispatcher *WebhookDispatcher, url string, secret string) (endpointID int64, eventID int64) {
+	t.Helper()
+
+	endpointID, err := InsertWebhookEndpoint(dispatcher.db, WebhookEndpoint{URL: url, EventTypes: []string{DeliveryEventSent}, Secret: "encrypted:" + secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventID, err = InsertDeliveryEvent(dispatcher.db, DeliveryEvent{MessageID: "message", EventType: DeliveryEventSent, EmailType: "EMAIL_VERIFICATION", Recipient: "user@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EnqueueWebhookDeliveries(dispatcher.db, eventID, DeliveryEventSent); err != nil {
+		t.Fatal(err)
+	}
+
+	return endpointID, eventID
+}
+
+func TestWebhookDispatcherSignsPayload(t *testing.T) {
+	dispatcher := NewWebhookDispatcher(newTestDB(t), testutil.CryptoServiceClient{}, NewDeliveryEventNotifier())
+	server, requests := newWebhookServer(t, http.StatusNoContent)
+	_, eventID := newWebhookDelivery(t, dispatcher, server.URL, "webhook secret")
+
+	if err := dispatcher.dispatchDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	request := <-requests
+
+	mac := hmac.New(sha256.New, []byte("webhook secret"))
+	mac.Write([]byte(request.header.Get(WebhookTimestampHeader) + "."))
+	mac.Write(request.body)
+	if signature := "sha256=" + hex.EncodeToString(mac.Sum(nil)); request.header.Get(WebhookSignatureHeader) != signature {
+		t.Errorf("signature is %q, expected %q", request.header.Get(WebhookSignatureHeader), signature)
+	}
+
+	timestamp, err := strconv.ParseInt(request.header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+		t.Errorf("timestamp is %q, expected the current unix time", request.header.Get(WebhookTimestampHeader))
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(request.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.EventID != eventID || payload.EventType != DeliveryEventSent || payload.Recipient != "user@example.com" {
+		t.Errorf("payload is %+v, expected the sent event %d to user@example.com", payload, eventID)
+	}
+
+	var deliveryStatus string
+	if err := dispatcher.db.QueryRow("SELECT status FROM webhook_deliveries WHERE event_id = ?", eventID).Scan(&deliveryStatus); err != nil {
+		t.Fatal(err)
+	}
+	if deliveryStatus != "succeeded" {
+		t.Errorf("delivery status is %q, expected succeeded", deliveryStatus)
+	}
+}
+
+func TestWebhookDispatcherRetriesWithBackoff(t *testing.T) {
+	dispatcher := NewWebhookDispatcher(newTestDB(t), testutil.CryptoServiceClient{}, NewDeliveryEventNotifier())
+	server, requests := newWebhookServer(t, http.StatusInternalServerError)
+	endpointID, eventID := newWebhookDelivery(t, dispatcher, server.URL, "webhook secret")
+
+	previousBackoff := time.Duration(0)
+	for attempt := 1; attempt <= 3; attempt++ {
+		before := time.Now()
+		if err := dispatcher.dispatchDue(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		<-requests
+
+		var deliveryStatus string
+		var attempts int
+		var nextAttemptAt time.Time
+		err := dispatcher.db.QueryRow("SELECT status, attempts, next_attempt_at FROM webhook_deliveries WHERE event_id = ?", eventID).Scan(&deliveryStatus, &attempts, &nextAttemptAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if deliveryStatus != "pending" || attempts != attempt {
+			t.Fatalf("delivery is %s after %d attempts, expected pending after %d attempts", deliveryStatus, attempts, attempt)
+		}
+
+		backoff := nextAttemptAt.Sub(before)
+		if backoff < WebhookBackoff(attempt)-time.Second || backoff > WebhookBackoff(attempt)+time.Second {
+			t.Errorf("attempt %d is retried in %s, expected %s", attempt, backoff, WebhookBackoff(attempt))
+		}
+		if backoff <= previousBackoff {
+			t.Errorf("attempt %d is retried in %s, expected more than the %s of the previous attempt", attempt, backoff, previousBackoff)
+		}
+		previousBackoff = backoff
+
+		// make the retry due
+		if _, err := dispatcher.db.Exec("UPDATE webhook_deliveries SET next_attempt_at = ? WHERE event_id = ?", time.Now().UTC().Add(-time.Second), eventID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attempts, err := GetWebhookDeliveryAttempts(dispatcher.db, endpointID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 3 {
+		t.Fatalf("got %d attempts, expected 3", len(attempts))
+	}
+	for _, attempt := range attempts {
+		if attempt.Succeeded || attempt.StatusCode != http.StatusInternalServerError {
+			t.Errorf("attempt %d succeeded=%t with status %d, expected a failure with status 500", attempt.Attempt, attempt.Succeeded, attempt.StatusCode)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+
+	for _, test := range tests {
+		if backoff := WebhookBackoff(test.attempts); backoff != test.expected {
+			t.Errorf("WebhookBackoff(%d) = %s, expected %s", test.attempts, backoff, test.expected)
+		}
+	}
+}
+
+func TestWebhookEndpoints(t *testing.T) {
+	db := newTestDB(t)
+
+	sentID, err := InsertWebhookEndpoint(db, WebhookEndpoint{URL: "https://example.com/sent", EventTypes: []string{DeliveryEventSent}, Secret: "encrypted:secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failedID, err := InsertWebhookEndpoint(db, WebhookEndpoint{URL: "https://example.com/failed", EventTypes: []string{DeliveryEventDeferred, DeliveryEventFailed}, Secret: "encrypted:secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints, err := GetWebhookEndpoints(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 2 || endpoints[0].ID != sentID || endpoints[1].ID != failedID || endpoints[1].URL != "https://example.com/failed" || len(endpoints[1].EventTypes) != 2 {
+		t.Fatalf("GetWebhookEndpoints() = %+v, expected both endpoints with their event types", endpoints)
+	}
+	if endpoints[0].Secret != "" {
+		t.Error("GetWebhookEndpoints() returned the secret of an endpoint")
+	}
+
+	// only the endpoints subscribed to the event type get a delivery
+	eventID, err := InsertDeliveryEvent(db, DeliveryEvent{MessageID: "message", EventType: DeliveryEventFailed, EmailType: "MFA", Recipient: "user@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EnqueueWebhookDeliveries(db, eventID, DeliveryEventFailed); err != nil {
+		t.Fatal(err)
+	}
+	var endpointID int64
+	if err := db.QueryRow("SELECT endpoint_id FROM webhook_deliveries WHERE event_id = ?", eventID).Scan(&endpointID); err != nil {
+		t.Fatal(err)
+	}
+	if endpointID != failedID {
+		t.Errorf("the delivery went to endpoint %d, expected %d", endpointID, failedID)
+	}
+
+	// the deliveries of a deleted endpoint are deleted with it
+	if deleted, err := DeleteWebhookEndpoint(db, failedID); err != nil || !deleted {
+		t.Fatalf("DeleteWebhookEndpoint() = %t, %v, expected the endpoint to be deleted", deleted, err)
+	}
+	if deleted, err := DeleteWebhookEndpoint(db, failedID); err != nil || deleted {
+		t.Errorf("DeleteWebhookEndpoint() = %t, %v for a deleted endpoint, expected false", deleted, err)
+	}
+	var deliveries int
+	if err := db.QueryRow("SELECT COUNT(*) FROM webhook_deliveries").Scan(&deliveries); err != nil {
+		t.Fatal(err)
+	}
+	if deliveries != 0 {
+		t.Errorf("%d deliveries remain after their endpoint was deleted, expected none", deliveries)
+	}
+}
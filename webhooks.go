@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pbCrypto "github.com/isaacwassou/email-service/protobufs/cryptography_service"
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+const (
+	defaultWebhookAttemptsLimit = 50
+	maxWebhookAttemptsLimit     = 500
+)
+
+// CreateWebhookEndpoint registers an endpoint that receives the delivery events of the subscribed types.
+// The signing secret is generated unless the caller provides one, and is only returned in this response.
+func (s *EmailManagerService) CreateWebhookEndpoint(ctx context.Context, in *pb.CreateWebhookEndpointRequest) (*pb.CreateWebhookEndpointResponse, error) {
+	if err := utils.ValidateWebhookURL(in.Url); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if len(in.EventTypes) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one event type is required")
+	}
+
+	eventTypes := []string{}
+	for _, eventType := range in.EventTypes {
+		name, found := deliveryEventTypes[eventType]
+		if !found {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid delivery event type %d", eventType)
+		}
+		eventTypes = append(eventTypes, name)
+	}
+
+	secret := in.Secret
+	if secret == "" {
+		generatedSecret, err := utils.NewWebhookSecret()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		secret = generatedSecret
+	}
+
+	// Encrypt the secret before storing it in the database
+	encryptedSecret, err := s.cryptoServiceClient.Encrypt(ctx, &pbCrypto.EncryptRequest{Plaintext: secret})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	endpoint := utils.WebhookEndpoint{
+		URL:        in.Url,
+		EventTypes: eventTypes,
+		Secret:     encryptedSecret.Ciphertext,
+	}
+
+	endpoint.ID, err = utils.InsertWebhookEndpoint(s.emailServiceDB.Db, endpoint)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	s.recordAuditEvent(ctx, "CreateWebhookEndpoint", strconv.FormatInt(endpoint.ID, 10), nil, map[string]string{
+		"url":         endpoint.URL,
+		"event_types": strings.Join(eventTypes, ","),
+		"secret":      secret,
+	})
+
+	return &pb.CreateWebhookEndpointResponse{
+		Endpoint: &pb.WebhookEndpoint{
+			Id:         endpoint.ID,
+			Url:        endpoint.URL,
+			EventTypes: in.EventTypes,
+		},
+		Secret: secret,
+	}, nil
+}
+
+func (s *EmailManagerService) ListWebhookEndpoints(ctx context.Context, in *emptypb.Empty) (*pb.ListWebhookEndpointsResponse, error) {
+	endpoints, err := utils.GetWebhookEndpoints(s.emailServiceDB.Db)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.ListWebhookEndpointsResponse{}
+	for _, endpoint := range endpoints {
+		pbEndpoint := &pb.WebhookEndpoint{
+			Id:        endpoint.ID,
+			Url:       endpoint.URL,
+			CreatedAt: timestamppb.New(endpoint.CreatedAt),
+		}
+
+		for _, name := range endpoint.EventTypes {
+			if eventType, found := deliveryEventTypeFromName(name); found {
+				pbEndpoint.EventTypes = append(pbEndpoint.EventTypes, eventType)
+			}
+		}
+
+		response.Endpoints = append(response.Endpoints, pbEndpoint)
+	}
+
+	return response, nil
+}
+
+func (s *EmailManagerService) DeleteWebhookEndpoint(ctx context.Context, in *pb.DeleteWebhookEndpointRequest) (*pb.DeleteWebhookEndpointResponse, error) {
+	deleted, err := utils.DeleteWebhookEndpoint(s.emailServiceDB.Db, in.Id)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !deleted {
+		return nil, status.Errorf(codes.NotFound, "webhook endpoint %d not found", in.Id)
+	}
+
+	s.recordAuditEvent(ctx, "DeleteWebhookEndpoint", strconv.FormatInt(in.Id, 10), nil, nil)
+
+	return &pb.DeleteWebhookEndpointResponse{Message: "Webhook endpoint deleted successfully!"}, nil
+}
+
+// ListWebhookDeliveryAttempts returns the most recent delivery attempts made to an endpoint, newest first
+func (s *EmailManagerService) ListWebhookDeliveryAttempts(ctx context.Context, in *pb.ListWebhookDeliveryAttemptsRequest) (*pb.ListWebhookDeliveryAttemptsResponse, error) {
+	limit := int(in.Limit)
+	if limit <= 0 {
+		limit = defaultWebhookAttemptsLimit
+	}
+	if limit > maxWebhookAttemptsLimit {
+		limit = maxWebhookAttemptsLimit
+	}
+
+	attempts, err := utils.GetWebhookDeliveryAttempts(s.emailServiceDB.Db, in.EndpointId, limit)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.ListWebhookDeliveryAttemptsResponse{}
+	for _, attempt := range attempts {
+		response.Attempts = append(response.Attempts, &pb.WebhookDeliveryAttempt{
+			Id:         attempt.ID,
+			DeliveryId: attempt.DeliveryID,
+			EndpointId: attempt.EndpointID,
+			EventId:    attempt.EventID,
+			Attempt:    int32(attempt.Attempt),
+			StatusCode: int32(attempt.StatusCode),
+			Error:      attempt.Error,
+			Succeeded:  attempt.Succeeded,
+			CreatedAt:  timestamppb.New(attempt.CreatedAt),
+		})
+	}
+
+	return response, nil
+}
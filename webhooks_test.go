@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "github.com/isaacwassou/email-service/protobufs/email_management_service"
+	"github.com/isaacwassou/email-service/utils"
+)
+
+// waitForWebhookAttempts lists the attempts made to an endpoint once there are at least n of them
+func waitForWebhookAttempts(t *testing.T, s *EmailManagerService, endpointID int64, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		response, err := s.ListWebhookDeliveryAttempts(context.Background(), &pb.ListWebhookDeliveryAttemptsRequest{EndpointId: endpointID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Attempts) >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("endpoint %d got %d attempts, expected %d", endpointID, len(response.Attempts), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListWebhookDeliveryAttempts(t *testing.T) {
+	s := newTestService(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go utils.NewWebhookDispatcher(s.emailServiceDB.Db, s.cryptoServiceClient, s.deliveryEvents).Run(ctx)
+
+	succeeding := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer succeeding.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	sentEndpoint, err := s.CreateWebhookEndpoint(ctx, &pb.CreateWebhookEndpointRequest{Url: succeeding.URL, EventTypes: []pb.DeliveryEventType{pb.DeliveryEventType_SENT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allEndpoint, err := s.CreateWebhookEndpoint(ctx, &pb.CreateWebhookEndpointRequest{Url: failing.URL, EventTypes: []pb.DeliveryEventType{pb.DeliveryEventType_SENT, pb.DeliveryEventType_FAILED}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := utils.DeliveryEvent{MessageID: "message", EmailType: pb.EmailType_EMAIL_VERIFICATION.String(), Recipient: "user@example.com"}
+	s.recordDeliveryEvent(event, utils.DeliveryEventSent, "")
+	s.recordDeliveryEvent(event, utils.DeliveryEventFailed, "connection refused")
+
+	waitForWebhookAttempts(t, s, sentEndpoint.Endpoint.Id, 1)
+	waitForWebhookAttempts(t, s, allEndpoint.Endpoint.Id, 2)
+
+	tests := []struct {
+		name       string
+		endpointID int64
+		limit      int32
+		succeeded  []bool
+		statusCode int32
+	}{
+		{"succeeding endpoint", sentEndpoint.Endpoint.Id, 0, []bool{true}, http.StatusOK},
+		{"failing endpoint", allEndpoint.Endpoint.Id, 0, []bool{false, false}, http.StatusServiceUnavailable},
+		{"limit", allEndpoint.Endpoint.Id, 1, []bool{false}, http.StatusServiceUnavailable},
+		{"unknown endpoint", allEndpoint.Endpoint.Id + 1, 0, nil, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := s.ListWebhookDeliveryAttempts(ctx, &pb.ListWebhookDeliveryAttemptsRequest{EndpointId: test.endpointID, Limit: test.limit})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(response.Attempts) != len(test.succeeded) {
+				t.Fatalf("got %d attempts, expected %d", len(response.Attempts), len(test.succeeded))
+			}
+
+			for i, attempt := range response.Attempts {
+				if attempt.EndpointId != test.endpointID || attempt.Succeeded != test.succeeded[i] || attempt.StatusCode != test.statusCode || attempt.Attempt != 1 {
+					t.Errorf("attempt %d is %+v, expected attempt 1 to endpoint %d with succeeded=%t and status %d", i, attempt, test.endpointID, test.succeeded[i], test.statusCode)
+				}
+				// the newest attempts come first
+				if i > 0 && attempt.Id > response.Attempts[i-1].Id {
+					t.Errorf("attempt %d is newer than the attempt before it", attempt.Id)
+				}
+			}
+		})
+	}
+}